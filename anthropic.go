@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// anthropicRequest is the body of Anthropic's POST /v1/messages. Only what
+// the adapter uses is decoded; max_tokens, system and the like are ignored.
+type anthropicRequest struct {
+	Model    string             `json:"model"`
+	Messages []anthropicMessage `json:"messages"`
+	Stream   bool               `json:"stream"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+// UnmarshalJSON accepts content given as a plain string too.
+func (m *anthropicMessage) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m.Role = aux.Role
+	var text string
+	if err := json.Unmarshal(aux.Content, &text); err == nil {
+		m.Content = []anthropicBlock{{Type: "text", Text: text}}
+		return nil
+	}
+	return json.Unmarshal(aux.Content, &m.Content)
+}
+
+type anthropicBlock struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text,omitempty"`
+	Source *anthropicImageSource `json:"source,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"` // base64 or url
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type anthropicResponse struct {
+	ID           string           `json:"id"`
+	Type         string           `json:"type"`
+	Role         string           `json:"role"`
+	Model        string           `json:"model"`
+	Content      []anthropicBlock `json:"content"`
+	StopReason   string           `json:"stop_reason"`
+	StopSequence *string          `json:"stop_sequence"`
+	Usage        struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+// chatMessages converts the conversation to the chat completions form, with
+// base64 images as data URLs, so that it is read like any other.
+func (r anthropicRequest) chatMessages() []Message {
+	var messages []Message
+	for _, m := range r.Messages {
+		msg := Message{Role: m.Role}
+		for _, b := range m.Content {
+			switch {
+			case b.Type == "text":
+				msg.Content = append(msg.Content, ContentPart{Type: "text", Text: b.Text})
+			case b.Type == "image" && b.Source != nil && b.Source.Type == "base64":
+				url := fmt.Sprintf("data:%s;base64,%s", b.Source.MediaType, b.Source.Data)
+				msg.Content = append(msg.Content, ContentPart{Type: "image_url", ImageURL: &ImagePart{URL: url}})
+			case b.Type == "image" && b.Source != nil && b.Source.Type == "url":
+				msg.Content = append(msg.Content, ContentPart{Type: "image_url", ImageURL: &ImagePart{URL: b.Source.URL}})
+			}
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// writeAnthropicError writes an error in the shape of Anthropic's API.
+func writeAnthropicError(w http.ResponseWriter, status int, message string) {
+	errType := "api_error"
+	switch status {
+	case http.StatusBadRequest:
+		errType = "invalid_request_error"
+	case http.StatusNotFound:
+		errType = "not_found_error"
+	case http.StatusTooManyRequests:
+		errType = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		errType = "overloaded_error"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":  "error",
+		"error": map[string]string{"type": errType, "message": message},
+	})
+}
+
+func writeAnthropicJobError(w http.ResponseWriter, err error) {
+	if reqErr, ok := err.(*requestError); ok {
+		writeAnthropicError(w, reqErr.status, reqErr.message)
+		return
+	}
+	writeAnthropicError(w, http.StatusInternalServerError, "Internal server error")
+}
+
+// handleAnthropicMessages serves Anthropic's Messages API at /v1/messages: the
+// last user text is the prompt, image blocks are init images, and the reply
+// holds the generated images as base64 image blocks followed by a text block
+// linking to them.
+func handleAnthropicMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req anthropicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if req.Stream {
+		writeAnthropicError(w, http.StatusBadRequest, "stream is not supported")
+		return
+	}
+
+	ctx := r.Context()
+	prompt, images, err := extractPromptAndImages(ctx, req.chatMessages(), externalBaseURL(r))
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if prompt == "" {
+		writeAnthropicError(w, http.StatusBadRequest, "No user prompt provided")
+		return
+	}
+	fmt.Println("Anthropic prompt:", prompt)
+
+	j, _, err := chatJob(ctx, ChatRequest{Model: req.Model}, prompt, images)
+	if err != nil {
+		writeAnthropicJobError(w, err)
+		return
+	}
+	setQueueHeaders(w, j)
+	result, err := runJob(ctx, j)
+	if err != nil {
+		writeAnthropicJobError(w, err)
+		return
+	}
+
+	resp := anthropicResponse{
+		ID:         "msg_" + j.id,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      req.Model,
+		StopReason: "end_turn",
+	}
+	for _, meta := range result.Images {
+		data, err := store.Get(ctx, meta.Name)
+		if err != nil {
+			log.Printf("Failed to load %s: %v", meta.Name, err)
+			writeAnthropicError(w, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		resp.Content = append(resp.Content, anthropicBlock{
+			Type:   "image",
+			Source: &anthropicImageSource{Type: "base64", MediaType: "image/png", Data: base64.StdEncoding.EncodeToString(data)},
+		})
+	}
+	markdown, _ := jobMarkdown(result, "output")
+	resp.Content = append(resp.Content, anthropicBlock{Type: "text", Text: strings.TrimSpace(markdown)})
+	writeJSON(w, resp)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// AuthConfig enables authentication of API requests. With neither API keys, an
+// OIDC issuer nor -tls-client-ca configured, the API is open and requests are
+// anonymous.
+type AuthConfig struct {
+	APIKeys []APIKey    `json:"api_keys"`
+	OIDC    *OIDCConfig `json:"oidc"`
+
+	// Admins are the users who may use the /admin/ endpoints however they
+	// authenticate, e.g. the common name of a client certificate or the
+	// user claim of a token.
+	Admins []string `json:"admins"`
+}
+
+// isAdmin reports whether the user is listed in admins.
+func (c AuthConfig) isAdmin(user string) bool {
+	return user != "" && slices.Contains(c.Admins, user)
+}
+
+// APIKey is a static bearer token and the user it authenticates. Models
+// restricts the key to the named model profiles; it may use all if empty.
+// Keys with Admin set, or of a user listed in AuthConfig.Admins, may use the
+// /admin/ endpoints.
+type APIKey struct {
+	Key    string   `json:"key"`
+	User   string   `json:"user"`
+	Models []string `json:"models"`
+	Admin  bool     `json:"admin"`
+}
+
+func (c AuthConfig) enabled() bool {
+	return len(c.APIKeys) > 0 || c.OIDC != nil || tlsClientCA != ""
+}
+
+func (c AuthConfig) validate() error {
+	for i, k := range c.APIKeys {
+		if k.Key == "" || k.User == "" {
+			return fmt.Errorf("api_keys[%d]: key and user are required", i)
+		}
+	}
+	if c.OIDC != nil {
+		if err := c.OIDC.validate(); err != nil {
+			return fmt.Errorf("oidc: %w", err)
+		}
+	}
+	return nil
+}
+
+// identity is the authenticated caller of a request, used for quotas,
+// tenancy and the audit log.
+type identity struct {
+	User   string
+	Method string // api_key, jwt, mtls or anonymous
+	Claims map[string]interface{}
+	Models []string // model profiles the caller may use, all if empty
+	Admin  bool     // may use the /admin/ endpoints
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, id identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// identityFrom returns the caller of the request ctx belongs to.
+func identityFrom(ctx context.Context) identity {
+	if id, ok := ctx.Value(identityKey{}).(identity); ok {
+		return id
+	}
+	return identity{Method: "anonymous"}
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header, or of
+// the x-api-key header Anthropic clients send or the x-goog-api-key header
+// Gemini clients send instead.
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		if key := r.Header.Get("X-Api-Key"); key != "" {
+			return strings.TrimSpace(key)
+		}
+		return strings.TrimSpace(r.Header.Get("X-Goog-Api-Key"))
+	}
+	return strings.TrimSpace(token)
+}
+
+// authenticate resolves the caller of r from its client certificate or bearer
+// token. API keys are tried first, then the token is validated as a JWT of the
+// OIDC issuer.
+func authenticate(r *http.Request) (identity, error) {
+	if id, ok := clientCertIdentity(r.TLS); ok {
+		return id, nil
+	}
+	token := bearerToken(r)
+	if token == "" {
+		return identity{}, fmt.Errorf("missing bearer token")
+	}
+	for _, k := range config.Auth.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(k.Key)) == 1 {
+			return identity{User: k.User, Method: "api_key", Models: k.Models, Admin: k.Admin || config.Auth.isAdmin(k.User)}, nil
+		}
+	}
+	if oidc != nil && strings.Count(token, ".") == 2 {
+		claims, err := oidc.verify(r.Context(), token)
+		if err != nil {
+			return identity{}, err
+		}
+		user, _ := claims[oidc.cfg.UserClaim].(string)
+		if user == "" {
+			return identity{}, fmt.Errorf("token has no %q claim", oidc.cfg.UserClaim)
+		}
+		admin := config.Auth.isAdmin(user) || oidc.cfg.isAdmin(claims)
+		return identity{User: user, Method: "jwt", Claims: claims, Admin: admin}, nil
+	}
+	return identity{}, fmt.Errorf("unknown API key")
+}
+
+// requireAuth rejects unauthenticated requests to h when authentication is
+// configured and records the caller in the request context.
+func requireAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !config.Auth.enabled() {
+			h(w, r)
+			return
+		}
+		id, err := authenticate(r)
+		if err != nil {
+			log.Printf("Rejected %s %s from %s: %v", r.Method, r.URL.Path, clientIP(r), err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sd-adapter"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("%s %s by %s (%s) from %s", r.Method, r.URL.Path, id.User, id.Method, clientIP(r))
+		h(w, r.WithContext(withIdentity(r.Context(), id)))
+	}
+}
+
+// requireAdmin lets only admins through to h: callers with an admin API key,
+// users listed in the auth config's admins and members of the OIDC admin
+// group. The admin endpoints expose every user's requests, so they are closed
+// while authentication is not configured.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if !config.Auth.enabled() {
+			http.Error(w, "Admin endpoints require authentication to be configured", http.StatusForbidden)
+			return
+		}
+		if id := identityFrom(r.Context()); !id.Admin {
+			log.Printf("Rejected %s %s by %s: not an admin", r.Method, r.URL.Path, id.User)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// modelAllowed reports whether the caller of ctx may use the model profile.
+func modelAllowed(ctx context.Context, profile string) bool {
+	models := identityFrom(ctx).Models
+	return len(models) == 0 || slices.Contains(models, profile)
+}
+
+// authorizeModel rejects the use of a model profile the caller's API key is
+// not allowed to use.
+func authorizeModel(ctx context.Context, profile string) error {
+	if modelAllowed(ctx, profile) {
+		return nil
+	}
+	return &requestError{http.StatusForbidden, fmt.Sprintf("Your API key is not allowed to use model %q", profile)}
+}
+
+// allowedModel picks the profile a request runs on when the caller is
+// restricted: the one asked for by name is kept as it is, for authorizeModel
+// to reject if need be, while one routed to by the prompt falls back to the
+// first profile the caller may use.
+func allowedModel(ctx context.Context, requested, routed string) string {
+	if _, ok := findProfile(requested); ok || modelAllowed(ctx, routed) {
+		return routed
+	}
+	for _, p := range modelProfiles() {
+		if modelAllowed(ctx, p.Name) {
+			fmt.Printf("Model %s is not allowed for %s, using %s\n", routed, identityFrom(ctx).User, p.Name)
+			return p.Name
+		}
+	}
+	return routed
+}
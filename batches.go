@@ -0,0 +1,556 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Batches run a JSONL file of chat and images API requests in the background,
+// like OpenAI's Batch API, for dataset generation. They yield to interactive
+// requests: a batch request only starts once no other job is waiting.
+
+const (
+	maxBatchBytes    = 100 << 20
+	maxBatchRequests = 10000
+	maxQueuedBatches = 64
+	batchRetention   = 24 * time.Hour // finished batches are forgotten after this
+	batchIdlePoll    = 500 * time.Millisecond
+)
+
+// batchEndpoints are the APIs the lines of a batch may call.
+var batchEndpoints = map[string]http.HandlerFunc{
+	"/v1/chat/completions":   handleChatCompletion,
+	"/v1/images/generations": handleImageGenerations,
+}
+
+// batchRequest is a line of the input file, e.g.
+//
+//	{"custom_id": "cat-1", "method": "POST", "url": "/v1/images/generations", "body": {"prompt": "a cat"}}
+type batchRequest struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// batchResult is a line of the output file.
+type batchResult struct {
+	ID       string               `json:"id"`
+	CustomID string               `json:"custom_id"`
+	Response *batchResultResponse `json:"response"`
+	Error    *batchError          `json:"error"`
+
+	images []string // generated images, for the zip
+}
+
+type batchResultResponse struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type batchError struct {
+	Message string `json:"message"`
+}
+
+type batchCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+type batchResponse struct {
+	ID            string      `json:"id"`
+	Object        string      `json:"object"`
+	Status        string      `json:"status"` // in_progress, cancelling, cancelled or completed
+	CreatedAt     int64       `json:"created_at"`
+	CompletedAt   int64       `json:"completed_at,omitempty"`
+	CancelledAt   int64       `json:"cancelled_at,omitempty"`
+	RequestCounts batchCounts `json:"request_counts"`
+	OutputURL     string      `json:"output_url"`
+	ImagesURL     string      `json:"images_url"`
+}
+
+type batch struct {
+	id       string
+	owner    identity
+	created  time.Time
+	requests []batchRequest
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// The submitting request, for the base URL of image links.
+	host       string
+	tls        *tls.ConnectionState
+	remoteAddr string
+	forwarded  http.Header
+
+	mu       sync.Mutex
+	status   string
+	finished time.Time
+	results  []batchResult
+	counts   batchCounts
+}
+
+func (b *batch) response() batchResponse {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	resp := batchResponse{
+		ID:            b.id,
+		Object:        "batch",
+		Status:        b.status,
+		CreatedAt:     b.created.Unix(),
+		RequestCounts: b.counts,
+		OutputURL:     "/v1/batches/" + b.id + "/output",
+		ImagesURL:     "/v1/batches/" + b.id + "/images.zip",
+	}
+	switch b.status {
+	case "completed":
+		resp.CompletedAt = b.finished.Unix()
+	case "cancelled":
+		resp.CancelledAt = b.finished.Unix()
+	}
+	return resp
+}
+
+var (
+	batchesMu  sync.Mutex
+	batches    = map[string]*batch{}
+	batchQueue = make(chan *batch, maxQueuedBatches)
+)
+
+// findBatch returns a batch of the caller of ctx.
+func findBatch(ctx context.Context, id string) (*batch, bool) {
+	batchesMu.Lock()
+	defer batchesMu.Unlock()
+	b, ok := batches[id]
+	if !ok || b.owner.User != identityFrom(ctx).User {
+		return nil, false
+	}
+	return b, true
+}
+
+// pruneBatchesLocked forgets the batches that finished before the retention.
+func pruneBatchesLocked() {
+	cutoff := time.Now().Add(-batchRetention)
+	for id, b := range batches {
+		b.mu.Lock()
+		expired := !b.finished.IsZero() && b.finished.Before(cutoff)
+		b.mu.Unlock()
+		if expired {
+			delete(batches, id)
+		}
+	}
+}
+
+// runBatches works through the submitted batches one after another.
+func runBatches() {
+	for b := range batchQueue {
+		b.run()
+	}
+}
+
+func (b *batch) run() {
+	defer b.cancel()
+	fmt.Printf("Running batch %s (%d requests)\n", b.id, len(b.requests))
+	for i, req := range b.requests {
+		if err := waitForIdle(b.ctx); err != nil {
+			break
+		}
+		res := b.runRequest(i, req)
+		if b.ctx.Err() != nil {
+			break // the request was cut short by the cancellation
+		}
+		b.mu.Lock()
+		b.results = append(b.results, res)
+		if res.Error == nil {
+			b.counts.Completed++
+		} else {
+			b.counts.Failed++
+		}
+		b.mu.Unlock()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status = "completed"
+	if b.ctx.Err() != nil {
+		b.status = "cancelled"
+	}
+	b.finished = time.Now()
+	b.requests = nil
+	fmt.Printf("Batch %s %s: %d completed, %d failed\n", b.id, b.status, b.counts.Completed, b.counts.Failed)
+}
+
+// waitForIdle blocks until no job is waiting or running, which gives
+// interactive requests priority over batches.
+func waitForIdle(ctx context.Context) error {
+	for !line.idle() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(batchIdlePoll):
+		}
+	}
+	return ctx.Err()
+}
+
+// runRequest calls the endpoint of a line as the owner of the batch.
+func (b *batch) runRequest(i int, req batchRequest) batchResult {
+	var images []string
+	ctx := withImageSink(withIdentity(b.ctx, b.owner), &images)
+	res := batchResult{ID: fmt.Sprintf("%s_req_%d", b.id, i), CustomID: req.CustomID}
+
+	sub, err := http.NewRequestWithContext(ctx, http.MethodPost, req.URL, bytes.NewReader(req.Body))
+	if err != nil {
+		res.Error = &batchError{Message: err.Error()}
+		return res
+	}
+	sub.Host = b.host
+	sub.TLS = b.tls
+	sub.RemoteAddr = b.remoteAddr
+	sub.Header = b.forwarded.Clone()
+	sub.Header.Set("Content-Type", "application/json")
+
+	rec := &bufferedResponse{header: http.Header{}}
+	batchEndpoints[req.URL](rec, sub)
+
+	body := bytes.TrimSpace(rec.body.Bytes())
+	status := rec.statusCode()
+	if status >= 300 {
+		res.Error = &batchError{Message: string(body)}
+		if json.Valid(body) {
+			res.Error.Message = http.StatusText(status)
+		}
+	}
+	if !json.Valid(body) {
+		body, _ = json.Marshal(map[string]batchError{"error": {Message: string(body)}})
+	}
+	res.Response = &batchResultResponse{StatusCode: status, Body: body}
+	res.images = images
+	return res
+}
+
+// bufferedResponse collects the response of an endpoint called by a batch.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) statusCode() int {
+	if b.status == 0 {
+		return http.StatusOK
+	}
+	return b.status
+}
+
+type imageSinkKey struct{}
+
+// withImageSink makes runJob append the names of the images it generates
+// under ctx to sink.
+func withImageSink(ctx context.Context, sink *[]string) context.Context {
+	return context.WithValue(ctx, imageSinkKey{}, sink)
+}
+
+// collectImages adds the images of a finished job to the sink of ctx, if any.
+func collectImages(ctx context.Context, result jobResult) {
+	sink, ok := ctx.Value(imageSinkKey{}).(*[]string)
+	if !ok {
+		return
+	}
+	if result.GridName != "" {
+		*sink = append(*sink, result.GridName)
+	}
+	for _, meta := range result.Images {
+		*sink = append(*sink, meta.Name)
+	}
+}
+
+// parseBatch reads and checks the lines of a batch file up front, so that a
+// typo fails the submission rather than a request hours into the batch.
+func parseBatch(data []byte) ([]batchRequest, error) {
+	var requests []batchRequest
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, maxBatchBytes)
+	for n := 1; sc.Scan(); n++ {
+		text := bytes.TrimSpace(sc.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var req batchRequest
+		if err := json.Unmarshal(text, &req); err != nil {
+			return nil, fmt.Errorf("line %d: invalid JSON: %v", n, err)
+		}
+		switch {
+		case req.CustomID == "":
+			return nil, fmt.Errorf("line %d: custom_id is required", n)
+		case seen[req.CustomID]:
+			return nil, fmt.Errorf("line %d: duplicate custom_id %q", n, req.CustomID)
+		case req.Method != "" && req.Method != http.MethodPost:
+			return nil, fmt.Errorf("line %d: method must be POST", n)
+		case batchEndpoints[req.URL] == nil:
+			return nil, fmt.Errorf("line %d: url must be /v1/chat/completions or /v1/images/generations", n)
+		}
+		var target interface{} = &ChatRequest{}
+		if req.URL == "/v1/images/generations" {
+			target = &imagesRequest{}
+		}
+		if err := validateRequest(req.Body, target); err != nil {
+			return nil, fmt.Errorf("line %d: body: %v", n, err)
+		}
+		var streaming struct {
+			Stream bool `json:"stream"`
+		}
+		if json.Unmarshal(req.Body, &streaming); streaming.Stream {
+			return nil, fmt.Errorf("line %d: stream is not supported in batches", n)
+		}
+		seen[req.CustomID] = true
+		requests = append(requests, req)
+		if len(requests) > maxBatchRequests {
+			return nil, fmt.Errorf("a batch must not have more than %d requests", maxBatchRequests)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("the batch has no requests")
+	}
+	return requests, nil
+}
+
+// handleBatches routes /v1/batches and below:
+//
+//	POST /v1/batches                  submit a JSONL file, as the body or form field "file"
+//	GET  /v1/batches                  list batches
+//	GET  /v1/batches/{id}             status of a batch
+//	POST /v1/batches/{id}/cancel      stop a batch after the running request
+//	GET  /v1/batches/{id}/output      output JSONL of the finished requests
+//	GET  /v1/batches/{id}/images.zip  the generated images and the output
+func handleBatches(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/batches"), "/")
+	if path == "" {
+		switch r.Method {
+		case http.MethodPost:
+			submitBatch(w, r)
+		case http.MethodGet:
+			listBatches(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	id, action, _ := strings.Cut(path, "/")
+	b, ok := findBatch(r.Context(), id)
+	if !ok {
+		http.Error(w, "Unknown batch", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, b.response())
+	case action == "cancel" && r.Method == http.MethodPost:
+		cancelBatch(w, b)
+	case action == "output" && r.Method == http.MethodGet:
+		writeBatchOutput(w, b)
+	case action == "images.zip" && r.Method == http.MethodGet:
+		writeBatchZip(w, r, b)
+	case action == "" || action == "cancel" || action == "output" || action == "images.zip":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func submitBatch(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBytes)
+	var data []byte
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		file, _, ferr := r.FormFile("file")
+		if ferr != nil {
+			http.Error(w, "Missing file form field", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err = io.ReadAll(file)
+	} else {
+		data, err = io.ReadAll(r.Body)
+	}
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	requests, err := parseBatch(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &batch{
+		id:         fmt.Sprintf("batch_%d", time.Now().UnixNano()),
+		owner:      identityFrom(r.Context()),
+		created:    time.Now(),
+		requests:   requests,
+		ctx:        ctx,
+		cancel:     cancel,
+		host:       r.Host,
+		tls:        r.TLS,
+		remoteAddr: r.RemoteAddr,
+		forwarded:  http.Header{},
+		status:     "in_progress",
+		counts:     batchCounts{Total: len(requests)},
+	}
+	for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host"} {
+		if values := r.Header.Values(name); len(values) > 0 {
+			b.forwarded[name] = values
+		}
+	}
+
+	batchesMu.Lock()
+	pruneBatchesLocked()
+	select {
+	case batchQueue <- b:
+		batches[b.id] = b
+	default:
+		batchesMu.Unlock()
+		cancel()
+		http.Error(w, "Too many batches queued, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	batchesMu.Unlock()
+	log.Printf("Batch %s of %d requests submitted by %s", b.id, len(requests), b.owner.User)
+	writeJSON(w, b.response())
+}
+
+func listBatches(w http.ResponseWriter, r *http.Request) {
+	user := identityFrom(r.Context()).User
+	batchesMu.Lock()
+	var own []*batch
+	for _, b := range batches {
+		if b.owner.User == user {
+			own = append(own, b)
+		}
+	}
+	batchesMu.Unlock()
+	sort.Slice(own, func(i, j int) bool { return own[i].created.After(own[j].created) })
+
+	list := struct {
+		Object string          `json:"object"`
+		Data   []batchResponse `json:"data"`
+	}{Object: "list", Data: []batchResponse{}}
+	for _, b := range own {
+		list.Data = append(list.Data, b.response())
+	}
+	writeJSON(w, list)
+}
+
+func cancelBatch(w http.ResponseWriter, b *batch) {
+	b.mu.Lock()
+	if b.status == "in_progress" {
+		b.status = "cancelling"
+		b.cancel()
+	}
+	b.mu.Unlock()
+	writeJSON(w, b.response())
+}
+
+// batchResults returns the results of the requests finished so far.
+func (b *batch) batchResults() []batchResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]batchResult(nil), b.results...)
+}
+
+func writeBatchOutput(w http.ResponseWriter, b *batch) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.jsonl"`, b.id))
+	enc := json.NewEncoder(w)
+	for _, res := range b.batchResults() {
+		if err := enc.Encode(res); err != nil {
+			return
+		}
+	}
+}
+
+// writeBatchZip streams the images of the finished requests, in a folder per
+// custom_id, together with output.jsonl.
+func writeBatchZip(w http.ResponseWriter, r *http.Request, b *batch) {
+	results := b.batchResults()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, b.id))
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	out, err := zw.Create("output.jsonl")
+	if err != nil {
+		return
+	}
+	enc := json.NewEncoder(out)
+	for _, res := range results {
+		enc.Encode(res)
+	}
+	for i, res := range results {
+		dir := zipSafeName(res.CustomID)
+		if dir == "" {
+			dir = fmt.Sprintf("request_%d", i)
+		}
+		for _, name := range res.images {
+			data, err := store.Get(r.Context(), name)
+			if err != nil {
+				// Headers are gone already; leave the image out.
+				log.Printf("Batch %s: failed to load %s: %v", b.id, name, err)
+				continue
+			}
+			f, err := zw.CreateHeader(&zip.FileHeader{Name: dir + "/" + path.Base(name), Method: zip.Store})
+			if err != nil {
+				return
+			}
+			f.Write(data)
+		}
+	}
+}
+
+// zipSafeName keeps letters, digits, dots, dashes and underscores of a
+// custom_id for use as a folder name.
+func zipSafeName(s string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-", c) {
+			sb.WriteRune(c)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	return strings.Trim(sb.String(), ".")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdTimingPatterns extract the phase durations sd reports in verbose mode.
+var sdTimingPatterns = map[string]*regexp.Regexp{
+	"load":     regexp.MustCompile(`loading tensors completed, taking ([\d.]+)s`),
+	"sampling": regexp.MustCompile(`sampling completed, taking ([\d.]+)s`),
+	"decode":   regexp.MustCompile(`decode_first_stage completed, taking ([\d.]+)s`),
+}
+
+// parseSDTimings fills in the phase durations found in sd's output. Phases
+// repeated in a batch are summed.
+func parseSDTimings(output string, t *timings) {
+	for phase, pattern := range sdTimingPatterns {
+		var total float64
+		for _, m := range pattern.FindAllStringSubmatch(output, -1) {
+			if v, err := strconv.ParseFloat(m[1], 64); err == nil {
+				total += v
+			}
+		}
+		switch phase {
+		case "load":
+			t.Load = total
+		case "sampling":
+			t.Sampling = total
+		case "decode":
+			t.Decode = total
+		}
+	}
+}
+
+// benchmarkCase is one reference generation of a benchmark, on the default
+// model profile unless Profile names another.
+type benchmarkCase struct {
+	Name     string  `json:"name"`
+	Profile  string  `json:"profile,omitempty"`
+	Prompt   string  `json:"prompt"`
+	Size     string  `json:"size"`
+	Steps    int     `json:"steps,omitempty"`
+	Sampler  string  `json:"sampler,omitempty"`
+	CfgScale float64 `json:"cfg_scale,omitempty"`
+}
+
+type benchmarkRequest struct {
+	Cases  []benchmarkCase `json:"cases"`
+	Repeat int             `json:"repeat"`
+}
+
+// benchmarkCaseReport holds the average phase durations in seconds.
+type benchmarkCaseReport struct {
+	benchmarkCase
+	DiffusionModel  string  `json:"diffusion_model"`
+	Runs            int     `json:"runs"`
+	Load            float64 `json:"load"`
+	Sampling        float64 `json:"sampling"`
+	Decode          float64 `json:"decode"`
+	Total           float64 `json:"total"`
+	ImagesPerMinute float64 `json:"images_per_minute"`
+	Error           string  `json:"error,omitempty"`
+}
+
+type benchmarkReport struct {
+	StartedAt       time.Time             `json:"started_at"`
+	Cases           []benchmarkCaseReport `json:"cases"`
+	Images          int                   `json:"images"`
+	ImagesPerMinute float64               `json:"images_per_minute"`
+	Profiles        []benchmarkProfile    `json:"profiles"`
+}
+
+// benchmarkProfile sums up the cases run on a model profile.
+type benchmarkProfile struct {
+	Name            string  `json:"name"`
+	DiffusionModel  string  `json:"diffusion_model"`
+	Images          int     `json:"images"`
+	ImagesPerMinute float64 `json:"images_per_minute"`
+
+	seconds float64
+}
+
+var defaultBenchmarkCases = []benchmarkCase{
+	{Name: "1024-20", Prompt: "a photo of a red apple on a wooden table", Size: "1024x1024", Steps: 20},
+	{Name: "512-20", Prompt: "a photo of a red apple on a wooden table", Size: "512x512", Steps: 20},
+}
+
+// handleBenchmark runs a set of reference generations and reports how long
+// each phase took, for comparing quantizations, flags and machines. Cases
+// come from the request body, falling back to the config file and then to a
+// built-in set.
+func handleBenchmark(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req benchmarkRequest
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(string(body)) != "" {
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	if len(req.Cases) == 0 {
+		req.Cases = config.Benchmark
+	}
+	if len(req.Cases) == 0 {
+		req.Cases = defaultBenchmarkCases
+	}
+	req.Repeat = max(1, req.Repeat)
+
+	gens := make([]generation, len(req.Cases))
+	for i, c := range req.Cases {
+		size, err := parseResolution(c.Size)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cases[%d]: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		if c.Profile != "" {
+			if _, ok := findProfile(c.Profile); !ok {
+				http.Error(w, fmt.Sprintf("cases[%d]: unknown model profile %q", i, c.Profile), http.StatusBadRequest)
+				return
+			}
+		}
+		gens[i] = generation{Profile: resolveProfile(c.Profile).Name, Prompt: c.Prompt, Size: size, Seed: 42, Steps: c.Steps, Sampler: c.Sampler, CfgScale: c.CfgScale}
+	}
+
+	report := benchmarkReport{StartedAt: time.Now().UTC()}
+	profiles := map[string]*benchmarkProfile{}
+	var order []string // profile names in the order of the cases
+	var totalSeconds float64
+	for i, c := range req.Cases {
+		profile := resolveProfile(c.Profile)
+		caseReport := benchmarkCaseReport{benchmarkCase: c, DiffusionModel: filepath.Base(profile.DiffusionModel)}
+		caseReport.Profile = profile.Name
+		for run := 0; run < req.Repeat; run++ {
+			fmt.Printf("Benchmark %q, run %d/%d\n", c.Name, run+1, req.Repeat)
+			images, err := runGeneration(r.Context(), gens[i])
+			if err != nil {
+				log.Printf("Benchmark %q failed: %v", c.Name, err)
+				caseReport.Error = err.Error()
+				break
+			}
+			t := images[0].Meta.Timings
+			caseReport.Runs++
+			caseReport.Load += t.Load
+			caseReport.Sampling += t.Sampling
+			caseReport.Decode += t.Decode
+			caseReport.Total += t.Generation
+		}
+		if caseReport.Runs > 0 {
+			report.Images += caseReport.Runs
+			totalSeconds += caseReport.Total
+			sum := profiles[profile.Name]
+			if sum == nil {
+				sum = &benchmarkProfile{Name: profile.Name, DiffusionModel: caseReport.DiffusionModel}
+				profiles[profile.Name] = sum
+				order = append(order, profile.Name)
+			}
+			sum.Images += caseReport.Runs
+			sum.seconds += caseReport.Total
+			n := float64(caseReport.Runs)
+			caseReport.ImagesPerMinute = imagesPerMinute(caseReport.Runs, caseReport.Total)
+			caseReport.Load /= n
+			caseReport.Sampling /= n
+			caseReport.Decode /= n
+			caseReport.Total /= n
+		}
+		report.Cases = append(report.Cases, caseReport)
+	}
+	report.ImagesPerMinute = imagesPerMinute(report.Images, totalSeconds)
+	for _, name := range order {
+		sum := profiles[name]
+		sum.ImagesPerMinute = imagesPerMinute(sum.Images, sum.seconds)
+		report.Profiles = append(report.Profiles, *sum)
+	}
+	writeJSON(w, report)
+}
+
+// imagesPerMinute returns the throughput of images generated in seconds, 0 if
+// no time was measured, as with the mock backend without delay.
+func imagesPerMinute(images int, seconds float64) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return 60 * float64(images) / seconds
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	sdCredential *syscall.Credential // resolved -sd-user and -sd-group
+	sdCgroupSeq  atomic.Int64
+)
+
+// lookupSDCredential resolves -sd-user and -sd-group, keeping the user's
+// supplementary groups (e.g. video or render for GPU access).
+func lookupSDCredential() (*syscall.Credential, error) {
+	if sdUser == "" {
+		if sdGroup != "" {
+			return nil, errors.New("-sd-group requires -sd-user")
+		}
+		return nil, nil
+	}
+	u, err := user.Lookup(sdUser)
+	if err != nil {
+		if u, err = user.LookupId(sdUser); err != nil {
+			return nil, fmt.Errorf("unknown -sd-user %q", sdUser)
+		}
+	}
+	gid := u.Gid
+	if sdGroup != "" {
+		g, err := user.LookupGroup(sdGroup)
+		if err != nil {
+			if g, err = user.LookupGroupId(sdGroup); err != nil {
+				return nil, fmt.Errorf("unknown -sd-group %q", sdGroup)
+			}
+		}
+		gid = g.Gid
+	}
+	cred := &syscall.Credential{}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("non-numeric UID %q of -sd-user", u.Uid)
+	}
+	g, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("non-numeric GID %q", gid)
+	}
+	cred.Uid, cred.Gid = uint32(uid), uint32(g)
+	groups, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the groups of -sd-user: %w", err)
+	}
+	for _, id := range groups {
+		if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+			cred.Groups = append(cred.Groups, uint32(g))
+		}
+	}
+	return cred, nil
+}
+
+// checkSDCgroup verifies that -sd-cgroup is a cgroup v2 directory and enables
+// the memory controller for the cgroups created in it.
+func checkSDCgroup() error {
+	if sdCgroupDir == "" {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(sdCgroupDir, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("-sd-cgroup %s is not a cgroup v2 directory: %w", sdCgroupDir, err)
+	}
+	if sdMemoryMB > 0 {
+		if err := os.WriteFile(filepath.Join(sdCgroupDir, "cgroup.subtree_control"), []byte("+memory"), 0); err != nil {
+			return fmt.Errorf("failed to enable the memory controller in %s (the adapter must not run in it): %w", sdCgroupDir, err)
+		}
+	}
+	return nil
+}
+
+// prepareSDProcess makes cmd run as -sd-user and in a fresh child cgroup of
+// -sd-cgroup, so that exceeding -sd-memory-mb only kills the generation. The
+// returned function, called with the result of the run, removes the cgroup
+// and explains a failure caused by the memory ceiling.
+func prepareSDProcess(cmd *exec.Cmd) (func(error) error, error) {
+	if sdCredential != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: sdCredential}
+		// sd writes its output to the run's temp directory.
+		if err := os.Chown(cmd.Dir, int(sdCredential.Uid), int(sdCredential.Gid)); err != nil {
+			return nil, fmt.Errorf("failed to hand the temp directory to -sd-user: %w", err)
+		}
+	}
+	if sdCgroupDir == "" {
+		return func(err error) error { return err }, nil
+	}
+
+	dir := filepath.Join(sdCgroupDir, fmt.Sprintf("sd-%d-%d", os.Getpid(), sdCgroupSeq.Add(1)))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	if err := configureSDCgroup(dir); err != nil {
+		syscall.Rmdir(dir)
+		return nil, err
+	}
+	fd, err := syscall.Open(dir, oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		syscall.Rmdir(dir)
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = fd
+
+	return func(runErr error) error {
+		syscall.Close(fd)
+		if runErr != nil && sdCgroupOOMKilled(dir) {
+			runErr = fmt.Errorf("sd exceeded the memory limit of %d MiB: %w", sdMemoryMB, runErr)
+		}
+		// Anything sd left behind would keep the cgroup busy.
+		os.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0)
+		if err := syscall.Rmdir(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove cgroup %s: %v\n", dir, err)
+		}
+		return runErr
+	}, nil
+}
+
+// configureSDCgroup sets the memory ceiling of a run's cgroup. Swap is
+// disabled so the limit isn't dodged by swapping, and the OOM killer takes
+// down the whole group.
+func configureSDCgroup(dir string) error {
+	if sdMemoryMB == 0 {
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.Itoa(sdMemoryMB<<20)), 0); err != nil {
+		return fmt.Errorf("failed to set cgroup memory limit: %w", err)
+	}
+	// Missing without swap accounting.
+	os.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0)
+	if err := os.WriteFile(filepath.Join(dir, "memory.oom.group"), []byte("1"), 0); err != nil {
+		return fmt.Errorf("failed to set cgroup OOM group: %w", err)
+	}
+	return nil
+}
+
+// sdCgroupOOMKilled reports whether the OOM killer struck in a run's cgroup.
+func sdCgroupOOMKilled(dir string) bool {
+	events, err := os.ReadFile(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(events), "\n") {
+		if name, count, ok := strings.Cut(line, " "); ok && name == "oom_kill" {
+			return count != "0"
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// checkProbeName is written to and removed from storage by -check-config.
+const checkProbeName = ".check-config"
+
+// configCheck collects the results of -check-config.
+type configCheck struct {
+	failures int
+	warnings int
+}
+
+func (c *configCheck) ok(format string, args ...interface{}) {
+	fmt.Printf("ok    %s\n", fmt.Sprintf(format, args...))
+}
+
+func (c *configCheck) warn(format string, args ...interface{}) {
+	c.warnings++
+	fmt.Printf("warn  %s\n", fmt.Sprintf(format, args...))
+}
+
+func (c *configCheck) fail(format string, args ...interface{}) {
+	c.failures++
+	fmt.Printf("FAIL  %s\n", fmt.Sprintf(format, args...))
+}
+
+// runConfigCheck checks what the flags and config refer to, printing a line
+// per check, and returns the exit code: 1 if anything failed. Invalid flags
+// and config sections have made startup fail before.
+func runConfigCheck(ctx context.Context) int {
+	c := &configCheck{}
+	if configPath != "" {
+		c.ok("config %s is valid", configPath)
+	}
+
+	runsSD := len(backends) == 0 && role != roleCoordinator
+	profiles := modelProfiles()
+	if runsSD && len(profiles) == 0 {
+		c.fail("no model profiles")
+	}
+	for _, p := range profiles {
+		c.checkProfile(ctx, p, runsSD)
+	}
+
+	c.checkStorage(ctx)
+	if tempDir != "" {
+		c.checkWritableDir("-temp-dir", tempDir)
+	}
+	c.checkAuth(ctx)
+	if config.Telegram.Token != "" && len(config.Telegram.AllowedChats) == 0 {
+		c.warn("telegram: allowed_chats is empty, the bot answers anyone on Telegram")
+	}
+
+	for _, tool := range []struct{ flag, path string }{
+		{"-face-restore-bin", faceRestoreBin},
+		{"-caption-bin", captionBin},
+		{"-convert-bin", convertBin},
+	} {
+		if tool.path != "" {
+			c.checkExecutable(tool.flag, tool.path)
+		}
+	}
+	if wildcardsDir != "" {
+		if info, err := os.Stat(wildcardsDir); err != nil || !info.IsDir() {
+			c.fail("-wildcards-dir %s is not a directory", wildcardsDir)
+		} else {
+			c.ok("-wildcards-dir %s", wildcardsDir)
+		}
+	}
+	for _, file := range []struct{ flag, path string }{
+		{"-tls-cert", tlsCert},
+		{"-tls-key", tlsKey},
+		{"-tls-client-ca", tlsClientCA},
+	} {
+		if file.path != "" {
+			c.checkReadable(file.flag, file.path)
+		}
+	}
+
+	if c.failures > 0 {
+		fmt.Printf("%d check(s) failed, %d warning(s)\n", c.failures, c.warnings)
+		return 1
+	}
+	fmt.Printf("All checks passed, %d warning(s)\n", c.warnings)
+	return 0
+}
+
+func (c *configCheck) checkProfile(ctx context.Context, p ModelProfile, runsSD bool) {
+	if generationBackend == backendMock {
+		c.ok("model %s: mock backend", p.Name)
+		return
+	}
+	if p.ServerURL != "" {
+		c.checkReachable(fmt.Sprintf("model %s: server_url", p.Name), p.ServerURL)
+		return
+	}
+	for _, f := range p.files() {
+		c.checkReadable(fmt.Sprintf("model %s:", p.Name), f)
+	}
+	if !runsSD {
+		return
+	}
+	if image := containerImage(p); image != "" {
+		runtime := config.Container.Runtime
+		if runtime == "" {
+			runtime = "docker"
+		}
+		c.checkExecutable(fmt.Sprintf("model %s: container runtime", p.Name), runtime)
+		return
+	}
+	c.checkExecutable(fmt.Sprintf("model %s: -sd-bin", p.Name), sdBinPath)
+}
+
+func (c *configCheck) checkReadable(what, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		c.fail("%s %v", what, err)
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		c.fail("%s %s is not a file", what, path)
+		return
+	}
+	c.ok("%s %s", what, path)
+}
+
+func (c *configCheck) checkExecutable(what, path string) {
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		c.fail("%s %v", what, err)
+		return
+	}
+	c.ok("%s %s", what, resolved)
+}
+
+func (c *configCheck) checkWritableDir(what, dir string) {
+	f, err := os.CreateTemp(dir, checkProbeName)
+	if err != nil {
+		c.fail("%s %s is not writable: %v", what, dir, err)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+	c.ok("%s %s is writable", what, dir)
+}
+
+// checkStorage stores and removes a probe file, which covers both a local
+// -output-dir and the credentials of remote storage.
+func (c *configCheck) checkStorage(ctx context.Context) {
+	what := "-output-dir " + outputDir
+	if config.Storage.Type != "" && config.Storage.Type != "local" {
+		what = config.Storage.Type + " storage"
+	}
+	if err := store.Put(ctx, checkProbeName, []byte("ok"), "text/plain"); err != nil {
+		c.fail("%s is not writable: %v", what, err)
+		return
+	}
+	if err := store.Delete(ctx, checkProbeName); err != nil {
+		c.warn("%s: failed to remove %s: %v", what, checkProbeName, err)
+		return
+	}
+	c.ok("%s is writable", what)
+}
+
+func (c *configCheck) checkAuth(ctx context.Context) {
+	if !config.Auth.enabled() {
+		c.warn("authentication is disabled, anyone reaching port %s can generate images", port)
+		return
+	}
+	seen := make(map[string]bool)
+	for i, k := range config.Auth.APIKeys {
+		if seen[k.Key] {
+			c.fail("auth: api_keys[%d] repeats an earlier key", i)
+		}
+		seen[k.Key] = true
+	}
+	if len(config.Auth.APIKeys) > 0 {
+		c.ok("auth: %d API key(s)", len(config.Auth.APIKeys))
+	}
+	if oidc != nil {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if keys, err := oidc.fetchKeys(ctx); err != nil {
+			c.fail("auth: OIDC issuer %s: %v", config.Auth.OIDC.Issuer, err)
+		} else {
+			c.ok("auth: OIDC issuer %s with %d signing key(s)", config.Auth.OIDC.Issuer, len(keys))
+		}
+	}
+}
+
+// checkReachable reports whether a server answers at all; its status code
+// doesn't matter.
+func (c *configCheck) checkReachable(what, url string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		c.fail("%s %s is unreachable: %v", what, url, err)
+		return
+	}
+	resp.Body.Close()
+	c.ok("%s %s is reachable", what, url)
+}
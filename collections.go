@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collections are named groups of generations, kept as tags in the metadata
+// sidecars so that images can be in several of them without being copied.
+// A collection index per tenant lists the members, so that the collection
+// endpoints don't have to read every sidecar.
+
+const maxCollectionName = 64
+
+// collectionIndexName is the storage name of the collection index, below the
+// tenant's directory with -tenant-isolation.
+const collectionIndexName = "collections.json"
+
+// collectionsMu serializes the read-modify-write of sidecars and the
+// collection index.
+var collectionsMu sync.Mutex
+
+// collectionMember is an image in the collection index.
+type collectionMember struct {
+	Image     string    `json:"image"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// collectionIndex maps the collections of a tenant to their images, oldest
+// first.
+type collectionIndex map[string][]collectionMember
+
+func (idx collectionIndex) add(collection string, meta imageMetadata) {
+	members := idx[collection]
+	i, found := slices.BinarySearchFunc(members, meta.Name, func(m collectionMember, name string) int {
+		return strings.Compare(m.Image, name)
+	})
+	if !found {
+		idx[collection] = slices.Insert(members, i, collectionMember{Image: meta.Name, CreatedAt: meta.CreatedAt})
+	}
+}
+
+// remove takes an image out of a collection, or out of all of them if
+// collection is empty, and reports whether it was in any.
+func (idx collectionIndex) remove(collection, image string) bool {
+	removed := false
+	for c, members := range idx {
+		if collection != "" && c != collection {
+			continue
+		}
+		kept := slices.DeleteFunc(members, func(m collectionMember) bool { return m.Image == image })
+		if len(kept) == len(members) {
+			continue
+		}
+		removed = true
+		if len(kept) == 0 {
+			delete(idx, c)
+		} else {
+			idx[c] = kept
+		}
+	}
+	return removed
+}
+
+// readCollectionIndex reads the caller's collection index, an error wrapping
+// os.ErrNotExist if there is none yet.
+func readCollectionIndex(ctx context.Context) (collectionIndex, error) {
+	data, err := store.Get(ctx, tenantName(ctx, collectionIndexName))
+	if err != nil {
+		return nil, err
+	}
+	idx := collectionIndex{}
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("invalid collection index: %w", err)
+	}
+	return idx, nil
+}
+
+// loadCollectionIndex reads the caller's collection index, building it from
+// the sidecars the first time. collectionsMu must be held.
+func loadCollectionIndex(ctx context.Context) (collectionIndex, error) {
+	idx, err := readCollectionIndex(ctx)
+	if !errors.Is(err, os.ErrNotExist) {
+		return idx, err
+	}
+	idx = collectionIndex{}
+	err = walkHistory(ctx, timeRange{}, func(meta imageMetadata) bool {
+		for _, c := range meta.Collections {
+			idx.add(c, meta)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return idx, saveCollectionIndex(ctx, idx)
+}
+
+func saveCollectionIndex(ctx context.Context, idx collectionIndex) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, tenantName(ctx, collectionIndexName), data, "application/json")
+}
+
+// indexCollections adds newly generated images to the collections they were
+// requested for.
+func indexCollections(ctx context.Context, images []imageMetadata) error {
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+	idx, err := loadCollectionIndex(ctx)
+	if err != nil {
+		return err
+	}
+	for _, meta := range images {
+		for _, c := range meta.Collections {
+			idx.add(c, meta)
+		}
+	}
+	return saveCollectionIndex(ctx, idx)
+}
+
+// unindexImage removes a deleted image from the collection index.
+func unindexImage(ctx context.Context, image string) error {
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+	idx, err := readCollectionIndex(ctx)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // built from the remaining sidecars when first needed
+	}
+	if err != nil || !idx.remove("", image) {
+		return err
+	}
+	return saveCollectionIndex(ctx, idx)
+}
+
+// validCollectionName allows names like "Project X" or "ads-2024.q3".
+func validCollectionName(name string) bool {
+	if name == "" || len(name) > maxCollectionName || strings.TrimSpace(name) != name {
+		return false
+	}
+	for _, c := range name {
+		ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(" ._-", c)
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+type collectionSummary struct {
+	Name      string    `json:"name"`
+	Count     int       `json:"count"`
+	UpdatedAt time.Time `json:"updated_at"` // creation time of the newest image
+}
+
+type collectionResponse struct {
+	Name string                   `json:"name"`
+	Data []generationResponseItem `json:"data"`
+}
+
+// addImagesRequest is the body of POST /v1/collections/{name}/images. Images
+// are given by name, like the ids of /v1/generations.
+type addImagesRequest struct {
+	Images []string `json:"images"`
+}
+
+// handleCollections routes /v1/collections and below:
+//
+//	GET    /v1/collections                     list collections
+//	GET    /v1/collections/{name}              list the images of a collection
+//	DELETE /v1/collections/{name}              remove the collection, not its images
+//	POST   /v1/collections/{name}/images       add images
+//	DELETE /v1/collections/{name}/images/{id}  remove an image from the collection
+func handleCollections(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/collections"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		listCollections(w, r)
+		return
+	}
+	name, rest, _ := strings.Cut(path, "/")
+	if !validCollectionName(name) {
+		http.Error(w, "Invalid collection name", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		showCollection(w, r, name)
+	case rest == "" && r.Method == http.MethodDelete:
+		deleteCollection(w, r, name)
+	case rest == "images" && r.Method == http.MethodPost:
+		addToCollection(w, r, name)
+	case strings.HasPrefix(rest, "images/") && r.Method == http.MethodDelete:
+		removeFromCollection(w, r, name, strings.TrimPrefix(rest, "images/"))
+	case rest == "" || rest == "images" || strings.HasPrefix(rest, "images/"):
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// lockedCollectionIndex loads the caller's collection index under
+// collectionsMu.
+func lockedCollectionIndex(ctx context.Context) (collectionIndex, error) {
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+	return loadCollectionIndex(ctx)
+}
+
+func listCollections(w http.ResponseWriter, r *http.Request) {
+	idx, err := lockedCollectionIndex(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data := []collectionSummary{}
+	for _, name := range sortedKeys(idx) {
+		s := collectionSummary{Name: name, Count: len(idx[name])}
+		for _, m := range idx[name] {
+			if m.CreatedAt.After(s.UpdatedAt) {
+				s.UpdatedAt = m.CreatedAt
+			}
+		}
+		data = append(data, s)
+	}
+	writeJSON(w, map[string]interface{}{"data": data})
+}
+
+func showCollection(w http.ResponseWriter, r *http.Request, name string) {
+	idx, err := lockedCollectionIndex(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := collectionResponse{Name: name, Data: []generationResponseItem{}}
+	for _, m := range idx[name] {
+		meta, err := loadMetadata(r.Context(), m.Image)
+		if err != nil {
+			log.Printf("Skipping %s in collection %s: %v", m.Image, name, err)
+			continue
+		}
+		resp.Data = append(resp.Data, generationResponseItem{URL: generatedURL(meta.Name), Params: meta})
+	}
+	if len(resp.Data) == 0 {
+		http.Error(w, "Unknown collection", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func deleteCollection(w http.ResponseWriter, r *http.Request, name string) {
+	ctx := r.Context()
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+	idx, err := loadCollectionIndex(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(idx[name]) == 0 {
+		http.Error(w, "Unknown collection", http.StatusNotFound)
+		return
+	}
+	for _, m := range idx[name] {
+		_, err := tagImage(ctx, m.Image, name, false)
+		var reqErr *requestError
+		if err != nil && !(errors.As(err, &reqErr) && reqErr.status == http.StatusNotFound) {
+			writeError(w, err)
+			return
+		}
+	}
+	delete(idx, name)
+	if err := saveCollectionIndex(ctx, idx); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func addToCollection(w http.ResponseWriter, r *http.Request, name string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	var req addImagesRequest
+	if err := validateRequest(body, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil || len(req.Images) == 0 {
+		http.Error(w, "images must list at least one image", http.StatusBadRequest)
+		return
+	}
+	for _, id := range req.Images {
+		image, ok := generationName(r.Context(), id)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown generation %s", id), http.StatusNotFound)
+			return
+		}
+		if err := updateCollections(r.Context(), image, name, true); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	showCollection(w, r, name)
+}
+
+func removeFromCollection(w http.ResponseWriter, r *http.Request, name, id string) {
+	image, ok := generationName(r.Context(), id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if err := updateCollections(r.Context(), image, name, false); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// generationName turns the id of a generation, with or without the .png
+// extension, into the name of an image the caller may access.
+func generationName(ctx context.Context, id string) (string, bool) {
+	name := id
+	if !strings.HasSuffix(name, ".png") {
+		name += ".png"
+	}
+	return name, validImageName(name) && ownsImage(ctx, name)
+}
+
+// updateCollections adds an image to or removes it from a collection.
+func updateCollections(ctx context.Context, image, collection string, add bool) error {
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+	idx, err := loadCollectionIndex(ctx)
+	if err != nil {
+		return err
+	}
+	meta, err := tagImage(ctx, image, collection, add)
+	if err != nil {
+		return err
+	}
+	if add {
+		idx.add(collection, meta)
+	} else if !idx.remove(collection, image) {
+		return nil
+	}
+	return saveCollectionIndex(ctx, idx)
+}
+
+// tagImage adds a collection to or removes it from the sidecar of an image.
+// collectionsMu must be held.
+func tagImage(ctx context.Context, image, collection string, add bool) (imageMetadata, error) {
+	meta, err := loadGenerationMetadata(ctx, image)
+	if err != nil {
+		return meta, err
+	}
+	if meta.inCollection(collection) == add {
+		return meta, nil
+	}
+	if add {
+		meta.Collections = append(meta.Collections, collection)
+		sort.Strings(meta.Collections)
+	} else {
+		kept := meta.Collections[:0]
+		for _, c := range meta.Collections {
+			if c != collection {
+				kept = append(kept, c)
+			}
+		}
+		meta.Collections = kept
+	}
+	return meta, saveMetadata(ctx, meta)
+}
+
+func (m imageMetadata) inCollection(name string) bool {
+	for _, c := range m.Collections {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxCompareModels = 4
+
+// compareRequest is the body of POST /v1/compare. Steps, CFG scale and
+// sampler default to the flags, as the quality tiers of the profiles would
+// make the runs differ.
+type compareRequest struct {
+	Models         []string `json:"models"` // two profiles, or up to maxCompareModels
+	Prompt         string   `json:"prompt"`
+	NegativePrompt string   `json:"negative_prompt"`
+	Seed           *int64   `json:"seed"`
+	Size           string   `json:"size"`
+	Style          string   `json:"style"`
+	Steps          int      `json:"steps"`
+	CfgScale       float64  `json:"cfg_scale"`
+	Sampler        string   `json:"sampler"`
+	Sheet          bool     `json:"sheet"` // compose the images side by side, labeled with the models
+}
+
+type compareResponse struct {
+	Created  int64               `json:"created"`
+	Prompt   string              `json:"prompt"`
+	Seed     int64               `json:"seed"`
+	Results  []compareResultItem `json:"results"`
+	SheetURL string              `json:"sheet_url,omitempty"`
+}
+
+type compareResultItem struct {
+	Model   string  `json:"model"`
+	URL     string  `json:"url"`
+	Seconds float64 `json:"seconds"` // generation time, for comparing speed
+}
+
+// handleCompare runs the same prompt, seed and parameters on several model
+// profiles as one job, for evaluating checkpoints against each other.
+func handleCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	var req compareRequest
+	if err := validateRequest(body, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	prompt := strings.TrimSpace(req.Prompt)
+	switch {
+	case prompt == "":
+		http.Error(w, "prompt is required", http.StatusBadRequest)
+		return
+	case len(req.Models) < 2 || len(req.Models) > maxCompareModels:
+		http.Error(w, fmt.Sprintf("models must list 2 to %d model profiles", maxCompareModels), http.StatusBadRequest)
+		return
+	case req.Steps < 0 || req.CfgScale < 0:
+		http.Error(w, "steps and cfg_scale must be positive", http.StatusBadRequest)
+		return
+	case req.Sampler != "" && !sdSamplers[req.Sampler]:
+		http.Error(w, fmt.Sprintf("Unknown sampler %q", req.Sampler), http.StatusBadRequest)
+		return
+	}
+	for i, name := range req.Models {
+		if _, ok := findProfile(name); !ok {
+			http.Error(w, fmt.Sprintf("Unknown model %q", name), http.StatusBadRequest)
+			return
+		}
+		for _, other := range req.Models[:i] {
+			if other == name {
+				http.Error(w, fmt.Sprintf("Model %q is listed twice", name), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	fmt.Printf("Comparing %s: %s\n", strings.Join(req.Models, ", "), prompt)
+
+	// The job is built for the first model; the others get a copy of its
+	// generation, with the same expanded prompt and seed.
+	chatReq := ChatRequest{
+		Model:          req.Models[0],
+		NegativePrompt: req.NegativePrompt,
+		Seed:           req.Seed,
+		Size:           req.Size,
+		Style:          req.Style,
+		Grid:           req.Sheet,
+	}
+	j, _, err := chatJob(r.Context(), chatReq, prompt, nil)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	gen := j.gen
+	if req.Steps > 0 {
+		gen.Steps = req.Steps
+	}
+	if req.CfgScale > 0 {
+		gen.CfgScale = req.CfgScale
+	}
+	if req.Sampler != "" {
+		gen.Sampler = req.Sampler
+	}
+	for _, name := range req.Models {
+		run := gen
+		run.Profile = name
+		if fitted, err := resolveProfile(name).fitSize(run.Size, false); err != nil || fitted != run.Size {
+			http.Error(w, fmt.Sprintf("Size %s is not supported by model %s", run.Size, name), http.StatusBadRequest)
+			return
+		}
+		j.runs = append(j.runs, run)
+	}
+	j.labels = req.Models
+	j.model = "" // each image records its profile
+
+	setQueueHeaders(w, j)
+	result, err := runJob(r.Context(), j)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	baseURL := externalBaseURL(r)
+	resp := compareResponse{Created: time.Now().Unix(), Prompt: gen.Prompt, Seed: gen.Seed}
+	for i, meta := range result.Images {
+		resp.Results = append(resp.Results, compareResultItem{
+			Model:   req.Models[i],
+			URL:     baseURL + generatedURL(meta.Name),
+			Seconds: meta.Timings.Generation,
+		})
+	}
+	if result.GridName != "" {
+		resp.SheetURL = baseURL + generatedURL(result.GridName)
+	}
+	writeJSON(w, resp)
+}
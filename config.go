@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Config holds settings that are too structured for command-line flags. It is
+// loaded from the JSON file given by -config; every section is optional.
+type Config struct {
+	PostProcess []PostProcessStep      `json:"post_process"`
+	Benchmark   []benchmarkCase        `json:"benchmark"`
+	Storage     StorageConfig          `json:"storage"`
+	Auth        AuthConfig             `json:"auth"`
+	Models      []ModelProfile         `json:"models"`
+	Quality     map[string]QualityTier `json:"quality"`
+	Styles      map[string]ImageStyle  `json:"styles"`
+	Routing     RoutingConfig          `json:"routing"`
+	Container   ContainerConfig        `json:"container"`
+	Telegram    TelegramConfig         `json:"telegram"`
+	Discord     DiscordConfig          `json:"discord"`
+	Slack       SlackConfig            `json:"slack"`
+	Schedules   []ScheduledJob         `json:"schedules"`
+	Pools       []WorkerPool           `json:"pools"`
+
+	ResolutionKeywords map[string]string `json:"resolution_keywords"`
+}
+
+var config Config
+
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config: %w", err)
+	}
+	for i := range cfg.PostProcess {
+		if err := cfg.PostProcess[i].validate(); err != nil {
+			return cfg, fmt.Errorf("post_process[%d]: %w", i, err)
+		}
+	}
+	for i, p := range cfg.Models {
+		if err := p.validate(); err != nil {
+			return cfg, fmt.Errorf("models[%d]: %w", i, err)
+		}
+	}
+	if err := validatePools(cfg.Pools, cfg.Models); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Auth.validate(); err != nil {
+		return cfg, fmt.Errorf("auth: %w", err)
+	}
+	if err := cfg.Discord.validate(); err != nil {
+		return cfg, fmt.Errorf("discord: %w", err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+// ContainerConfig runs sd inside a container image (docker run or podman run)
+// for every generation, keeping GPU toolchains off the host and letting
+// profiles use different sd builds. The run directory and the profile's model
+// files are mounted at their host paths. Resource limits, -sd-sandbox,
+// -sd-user and -sd-cgroup don't apply to container runs.
+type ContainerConfig struct {
+	Runtime string            `json:"runtime"` // docker or podman binary, docker if empty
+	Image   string            `json:"image"`   // default image, profiles may set their own
+	SDBin   string            `json:"sd_bin"`  // sd inside the image, sd if empty
+	GPUs    string            `json:"gpus"`    // --gpus, e.g. "all" with the NVIDIA toolkit
+	Devices []string          `json:"devices"` // --device, e.g. /dev/kfd and /dev/dri for ROCm
+	Volumes []string          `json:"volumes"` // extra host:container[:options] mounts
+	Env     map[string]string `json:"env"`
+	Network string            `json:"network"` // none if empty
+	User    string            `json:"user"`    // uid:gid of the adapter if empty
+	Args    []string          `json:"args"`    // further run options
+}
+
+// containerPathFlags are the sd options taking a model file.
+var containerPathFlags = map[string]bool{
+	"--diffusion-model": true,
+	"--vae":             true,
+	"--clip_l":          true,
+	"--t5xxl":           true,
+	"--taesd":           true,
+}
+
+// containerImage returns the image sd runs in for a profile, empty to run the
+// local binary.
+func containerImage(profile ModelProfile) string {
+	if profile.Image != "" {
+		return profile.Image
+	}
+	return config.Container.Image
+}
+
+// containerCommand returns the command running sd with the given arguments in
+// a container of image, with dir as its working directory.
+func containerCommand(ctx context.Context, image string, profile ModelProfile, dir string, args []string) (*exec.Cmd, error) {
+	c := config.Container
+	runtime := c.Runtime
+	if runtime == "" {
+		runtime = "docker"
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	name := "sd-adapter-" + newJobID()
+	network := c.Network
+	if network == "" {
+		network = "none"
+	}
+	user := c.User
+	if user == "" {
+		// Outputs must be readable and removable by the adapter.
+		user = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	}
+
+	runArgs := []string{"run", "--rm", "--name", name, "--network", network, "--user", user,
+		"-v", absDir + ":" + absDir, "-w", absDir}
+	if c.GPUs != "" {
+		runArgs = append(runArgs, "--gpus", c.GPUs)
+	}
+	for _, device := range c.Devices {
+		runArgs = append(runArgs, "--device", device)
+	}
+	for _, volume := range c.Volumes {
+		runArgs = append(runArgs, "-v", volume)
+	}
+
+	// Model files are mounted read-only at their absolute host path, which
+	// relative paths in the arguments are rewritten to.
+	files := profile.files()
+	if taesdPath != "" {
+		files = append(files, taesdPath)
+	}
+	mounted := make(map[string]string)
+	for _, f := range files {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := mounted[f]; !ok {
+			mounted[f] = abs
+			runArgs = append(runArgs, "-v", abs+":"+abs+":ro")
+		}
+	}
+
+	keys := make([]string, 0, len(c.Env))
+	for k := range c.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		runArgs = append(runArgs, "-e", k+"="+c.Env[k])
+	}
+	if device := deviceFrom(ctx); device != "" {
+		for _, name := range deviceEnvVars {
+			runArgs = append(runArgs, "-e", name+"="+device)
+		}
+	}
+	runArgs = append(runArgs, c.Args...)
+
+	sdBin := c.SDBin
+	if sdBin == "" {
+		sdBin = "sd"
+	}
+	runArgs = append(runArgs, image, sdBin)
+	for i, arg := range args {
+		if abs, ok := mounted[arg]; ok && i > 0 && containerPathFlags[args[i-1]] {
+			arg = abs
+		}
+		runArgs = append(runArgs, arg)
+	}
+
+	cmd := exec.CommandContext(ctx, runtime, runArgs...)
+	// Killing the client would leave the container running.
+	cmd.Cancel = func() error {
+		if err := exec.Command(runtime, "rm", "-f", name).Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove container %s: %v\n", name, err)
+		}
+		return cmd.Process.Kill()
+	}
+	return cmd, nil
+}
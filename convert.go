@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// isoImageBrands maps the ftyp brands of HEIF containers to the format they
+// hold. The standard library decodes neither.
+var isoImageBrands = map[string]string{
+	"heic": "heic", "heix": "heic", "heim": "heic", "heis": "heic",
+	"hevc": "heic", "hevx": "heic", "hevm": "heic", "hevs": "heic",
+	"mif1": "heic", "msf1": "heic",
+	"avif": "avif", "avis": "avif",
+}
+
+// isoImageFormat returns "heic" or "avif" for images in a HEIF container, as
+// iPhones and modern browsers send them, and "" for anything else.
+func isoImageFormat(data []byte) string {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return ""
+	}
+	return isoImageBrands[string(data[8:12])]
+}
+
+// convertImage turns HEIC and AVIF images into PNG with -convert-bin and
+// passes other images through.
+func convertImage(ctx context.Context, data []byte) ([]byte, error) {
+	format := isoImageFormat(data)
+	if format == "" {
+		return data, nil
+	}
+	if convertBin == "" {
+		return nil, fmt.Errorf("%s images are not supported without -convert-bin", format)
+	}
+	converted, err := runConverter(ctx, data, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert %s image: %w", format, err)
+	}
+	fmt.Printf("Converted %s image to PNG (%d -> %d bytes)\n", format, len(data), len(converted))
+	return converted, nil
+}
+
+func runConverter(ctx context.Context, data []byte, format string) ([]byte, error) {
+	tmpDir, err := os.MkdirTemp(tempDir, "convert-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	inputPath := filepath.Join(tmpDir, "input."+format)
+	outputPath := filepath.Join(tmpDir, "output.png")
+	if err := os.WriteFile(inputPath, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write input: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, convertTimeout)
+	defer cancel()
+
+	args := expandArgs(convertArgs, map[string]string{
+		"input":  inputPath,
+		"output": outputPath,
+		"dir":    tmpDir,
+	})
+	cmd := exec.CommandContext(ctx, convertBin, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("command failed: %w", err)
+	}
+
+	converted, err := os.ReadFile(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read output: %w", err)
+	}
+	if !bytes.HasPrefix(converted, []byte("\x89PNG\r\n\x1a\n")) {
+		return nil, fmt.Errorf("tool did not produce a PNG")
+	}
+	return converted, nil
+}
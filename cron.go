@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day of
+// month, month and day of week, each a set of allowed values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow [61]bool
+	domAny, dowAny                bool // "*", for the day matching rule
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses expressions like "30 7 * * 1-5" or "*/15 * * * *" and the
+// macros @hourly, @daily, @weekly, @monthly and @yearly.
+func parseCron(expr string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[strings.TrimSpace(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields (minute hour day month weekday), got %d", len(fields))
+	}
+	s := &cronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	for i, f := range []struct {
+		name     string
+		set      *[61]bool
+		min, max int
+	}{
+		{"minute", &s.minute, 0, 59},
+		{"hour", &s.hour, 0, 23},
+		{"day of month", &s.dom, 1, 31},
+		{"month", &s.month, 1, 12},
+		{"day of week", &s.dow, 0, 7},
+	} {
+		if err := parseCronField(fields[i], f.set, f.min, f.max); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	if s.dow[7] {
+		s.dow[0] = true // both 0 and 7 are Sunday
+	}
+	return s, nil
+}
+
+// parseCronField sets the values of a comma-separated list of *, N, N-M and
+// either with a /STEP.
+func parseCronField(field string, set *[61]bool, min, max int) error {
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loStr); err != nil {
+				return fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiStr); err != nil {
+					return fmt.Errorf("invalid value %q", part)
+				}
+			} else if hasStep {
+				hi = max // "5/15" is 5, 20, 35, 50
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// dayMatches applies cron's rule that with both day fields restricted, a day
+// matching either of them is enough.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom[t.Day()], s.dow[int(t.Weekday())]
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after t the schedule fires, in t's location,
+// or the zero time if it never does (e.g. on February 30). It steps through
+// wall-clock times, so times a DST change skips are skipped and times it
+// repeats fire once.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	limit := t.AddDate(5, 0, 0)
+	year, month, day := t.Date()
+	hour, minute := t.Hour(), t.Minute()+1
+	for {
+		c := time.Date(year, month, day, hour, minute, 0, 0, t.Location())
+		if !c.Before(limit) {
+			return time.Time{}
+		}
+		year, month, day = c.Date()
+		hour, minute = c.Hour(), c.Minute()
+		switch {
+		case !s.month[int(month)]:
+			month, day, hour, minute = month+1, 1, 0, 0
+		case !s.dayMatches(c):
+			day, hour, minute = day+1, 0, 0
+		case !s.hour[hour]:
+			hour, minute = hour+1, 0
+		case !s.minute[minute] || !c.After(t):
+			minute++
+		default:
+			return c
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+		"@fortnightly",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := func(s string) time.Time {
+		at, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+	tests := []struct {
+		expr, from, want string
+	}{
+		{"* * * * *", "2026-01-01 10:00", "2026-01-01 10:01"},
+		{"30 7 * * *", "2026-01-01 07:30", "2026-01-02 07:30"},
+		{"30 7 * * *", "2026-01-01 07:29", "2026-01-01 07:30"},
+		{"*/15 * * * *", "2026-01-01 10:07", "2026-01-01 10:15"},
+		{"5/20 * * * *", "2026-01-01 10:26", "2026-01-01 10:45"},
+		{"0 9,17 * * *", "2026-01-01 09:00", "2026-01-01 17:00"},
+		{"@hourly", "2026-01-01 10:59", "2026-01-01 11:00"},
+		{"@daily", "2026-12-31 23:59", "2027-01-01 00:00"},
+		{"@monthly", "2026-01-15 00:00", "2026-02-01 00:00"},
+		{"@yearly", "2026-01-01 00:00", "2027-01-01 00:00"},
+
+		// 2026-01-01 is a Thursday.
+		{"30 7 * * 1-5", "2026-01-02 08:00", "2026-01-05 07:30"},
+		{"0 0 * * 0", "2026-01-01 00:00", "2026-01-04 00:00"},
+		{"0 0 * * 7", "2026-01-01 00:00", "2026-01-04 00:00"},
+		{"@weekly", "2026-01-04 00:00", "2026-01-11 00:00"},
+
+		// With both day fields restricted, either matches.
+		{"0 0 13 * 5", "2026-01-01 00:00", "2026-01-02 00:00"},
+		{"0 0 13 * 5", "2026-01-10 00:00", "2026-01-13 00:00"},
+		// With one of them "*", only the other counts.
+		{"0 0 13 * *", "2026-01-01 00:00", "2026-01-13 00:00"},
+		{"0 0 * * 5", "2026-01-10 00:00", "2026-01-16 00:00"},
+
+		{"0 0 31 * *", "2026-01-31 00:00", "2026-03-31 00:00"},
+		{"0 0 29 2 *", "2026-01-01 00:00", "2028-02-29 00:00"},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := s.next(utc(tt.from)); !got.Equal(utc(tt.want)) {
+			t.Errorf("%q after %s: got %s, want %s", tt.expr, tt.from, got.Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	s, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.next(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+		t.Errorf("February 30 fires at %s", got)
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	// Clocks go from 02:00 to 03:00 on 2026-03-29 and from 03:00 back to
+	// 02:00 on 2026-10-25.
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, berlin)
+	}
+	tests := []struct {
+		name       string
+		expr       string
+		from, want time.Time
+	}{
+		{"skipped time is skipped", "30 2 * * *", at(3, 29, 1, 0), at(3, 30, 2, 30)},
+		{"hour after the gap", "0 3 * * *", at(3, 29, 1, 0), at(3, 29, 3, 0)},
+		{"every minute across the gap", "* * * * *", at(3, 29, 1, 59), at(3, 29, 3, 0)},
+		{"hour after the repeat", "0 3 * * *", at(10, 25, 1, 0), at(10, 25, 3, 0)},
+		{"every minute out of the repeat", "* * * * *", time.Date(2026, 10, 25, 1, 59, 0, 0, time.UTC).In(berlin), at(10, 25, 3, 0)},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%s: %q after %s: got %s, want %s", tt.name, tt.expr, tt.from, got, tt.want)
+		}
+	}
+
+	// Times in the repeated hour fire once, whichever pass it starts in.
+	s, err := parseCron("30 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, from := range []time.Time{
+		at(10, 25, 1, 0),
+		time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC).In(berlin), // 02:00 CEST
+		time.Date(2026, 10, 25, 1, 0, 0, 0, time.UTC).In(berlin), // 02:00 CET
+	} {
+		first := s.next(from)
+		if first.Day() != 25 || first.Hour() != 2 || first.Minute() != 30 {
+			t.Errorf("after %s: got %s, want 02:30 on the 25th", from, first)
+			continue
+		}
+		if second := s.next(first); !second.Equal(at(10, 26, 2, 30)) {
+			t.Errorf("after %s: fires again at %s", first, second)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiscordConfig enables the /imagine and /edit slash commands, received at
+// /discord/interactions (the application's Interactions Endpoint URL).
+type DiscordConfig struct {
+	PublicKey     string `json:"public_key"`     // hex, verifies the interaction signatures
+	ApplicationID string `json:"application_id"` // needed to register the commands
+	BotToken      string `json:"bot_token"`      // registers the commands at startup if set
+	Model         string `json:"model"`          // profile to use, routed by prompt if empty
+	RateLimit     int    `json:"rate_limit"`     // commands per channel and minute, unlimited if 0
+	APIURL        string `json:"api_url"`        // https://discord.com/api/v10 if empty
+}
+
+const (
+	discordPing               = 1
+	discordApplicationCommand = 2
+	discordPong               = 1
+	discordChannelMessage     = 4
+	discordDeferredMessage    = 5
+	discordEphemeral          = 64
+	discordOptionString       = 3
+	discordOptionAttachment   = 11
+)
+
+const (
+	discordProgressInterval = 3 * time.Second
+	discordMaxRequestBytes  = 1 << 20
+)
+
+var discordCommands = []map[string]interface{}{
+	{
+		"name":        "imagine",
+		"description": "Generate an image",
+		"options": []map[string]interface{}{
+			{"type": discordOptionString, "name": "prompt", "description": "What to draw", "required": true},
+		},
+	},
+	{
+		"name":        "edit",
+		"description": "Edit an image",
+		"options": []map[string]interface{}{
+			{"type": discordOptionAttachment, "name": "image", "description": "Image to edit", "required": true},
+			{"type": discordOptionString, "name": "prompt", "description": "How to change it", "required": true},
+		},
+	},
+}
+
+type discordUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+type discordInteraction struct {
+	Type          int    `json:"type"`
+	ApplicationID string `json:"application_id"`
+	Token         string `json:"token"`
+	ChannelID     string `json:"channel_id"`
+	Member        *struct {
+		User discordUser `json:"user"`
+	} `json:"member"`
+	User *discordUser `json:"user"` // in DMs
+	Data struct {
+		Name    string `json:"name"`
+		Options []struct {
+			Name  string          `json:"name"`
+			Value json.RawMessage `json:"value"`
+		} `json:"options"`
+		Resolved struct {
+			Attachments map[string]struct {
+				URL string `json:"url"`
+			} `json:"attachments"`
+		} `json:"resolved"`
+	} `json:"data"`
+}
+
+// option returns the string value of a command option.
+func (in *discordInteraction) option(name string) string {
+	for _, o := range in.Data.Options {
+		if o.Name == name {
+			var s string
+			json.Unmarshal(o.Value, &s)
+			return s
+		}
+	}
+	return ""
+}
+
+func (in *discordInteraction) user() discordUser {
+	if in.Member != nil {
+		return in.Member.User
+	}
+	if in.User != nil {
+		return *in.User
+	}
+	return discordUser{}
+}
+
+// channelLimiter allows at most limit events per key within a minute.
+type channelLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	events map[string][]time.Time
+}
+
+func (l *channelLimiter) allow(key string) bool {
+	if l.limit <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := time.Now().Add(-time.Minute)
+	recent := l.events[key][:0]
+	for _, t := range l.events[key] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= l.limit {
+		l.events[key] = recent
+		return false
+	}
+	l.events[key] = append(recent, time.Now())
+	return true
+}
+
+var discordLimiter *channelLimiter
+
+func (c DiscordConfig) validate() error {
+	if c.PublicKey == "" {
+		if c.BotToken != "" {
+			return fmt.Errorf("public_key is required")
+		}
+		return nil
+	}
+	if key, err := hex.DecodeString(c.PublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("public_key must be a hex Ed25519 key")
+	}
+	if c.BotToken != "" && c.ApplicationID == "" {
+		return fmt.Errorf("application_id is required to register the commands")
+	}
+	return nil
+}
+
+func discordAPIURL() string {
+	if config.Discord.APIURL != "" {
+		return strings.TrimSuffix(config.Discord.APIURL, "/")
+	}
+	return "https://discord.com/api/v10"
+}
+
+// registerDiscordCommands installs the slash commands of the application.
+func registerDiscordCommands(ctx context.Context) error {
+	body, err := json.Marshal(discordCommands)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/applications/%s/commands", discordAPIURL(), config.Discord.ApplicationID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bot "+config.Discord.BotToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("discord returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// verifyDiscordSignature checks the Ed25519 signature Discord puts on every
+// interaction.
+func verifyDiscordSignature(r *http.Request, body []byte) bool {
+	key, err := hex.DecodeString(config.Discord.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	if err != nil {
+		return false
+	}
+	msg := append([]byte(r.Header.Get("X-Signature-Timestamp")), body...)
+	return ed25519.Verify(ed25519.PublicKey(key), msg, sig)
+}
+
+// handleDiscordInteraction answers slash commands with a deferred response
+// and runs the job in the background, editing the reply with the queue
+// progress and finally the image.
+func handleDiscordInteraction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, discordMaxRequestBytes))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if !verifyDiscordSignature(r, body) {
+		http.Error(w, "Invalid request signature", http.StatusUnauthorized)
+		return
+	}
+	var in discordInteraction
+	if err := json.Unmarshal(body, &in); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case in.Type == discordPing:
+		writeJSON(w, map[string]int{"type": discordPong})
+		return
+	case in.Type != discordApplicationCommand || (in.Data.Name != "imagine" && in.Data.Name != "edit"):
+		http.Error(w, "Unsupported interaction", http.StatusBadRequest)
+		return
+	}
+	if !discordLimiter.allow(in.ChannelID) {
+		writeJSON(w, map[string]interface{}{
+			"type": discordChannelMessage,
+			"data": map[string]interface{}{
+				"content": fmt.Sprintf("This channel is limited to %d images a minute, please wait a moment.", config.Discord.RateLimit),
+				"flags":   discordEphemeral,
+			},
+		})
+		return
+	}
+
+	writeJSON(w, map[string]int{"type": discordDeferredMessage})
+	go runDiscordCommand(&in)
+}
+
+func runDiscordCommand(in *discordInteraction) {
+	user := in.user()
+	// Usernames can be changed and then taken by someone else, IDs are
+	// permanent.
+	ctx := withIdentity(context.Background(), identity{User: "discord:" + user.ID, Method: "discord"})
+	prompt := strings.TrimSpace(in.option("prompt"))
+	fmt.Printf("Discord /%s from %s: %s\n", in.Data.Name, user.Username, prompt)
+
+	var images [][]byte
+	if in.Data.Name == "edit" {
+		attachment, ok := in.Data.Resolved.Attachments[in.option("image")]
+		if !ok {
+			editDiscordReply(ctx, in, "The image to edit is missing.", nil)
+			return
+		}
+		data, err := fetchImage(ctx, attachment.URL, "")
+		if err != nil {
+			log.Printf("Failed to fetch Discord attachment: %v", err)
+			editDiscordReply(ctx, in, "Failed to download the image.", nil)
+			return
+		}
+		images = append(images, data)
+	}
+
+	j, _, err := chatJob(ctx, ChatRequest{Model: config.Discord.Model}, prompt, images)
+	if err == nil {
+		progressCtx, stopProgress := context.WithCancel(ctx)
+		go reportDiscordProgress(progressCtx, in, j.id)
+		var result jobResult
+		result, err = runJob(ctx, j)
+		stopProgress()
+		if err == nil {
+			if len(result.Images) == 0 {
+				editDiscordReply(ctx, in, "No image was generated.", nil)
+				return
+			}
+			meta := result.Images[0]
+			data, err := store.Get(ctx, meta.Name)
+			if err != nil {
+				log.Printf("Failed to load %s: %v", meta.Name, err)
+				editDiscordReply(ctx, in, "Failed to load the generated image.", nil)
+				return
+			}
+			content := fmt.Sprintf("**%s** (seed %d)", prompt, meta.Seed)
+			editDiscordReply(ctx, in, content, &discordFile{Name: path.Base(meta.Name), Data: data})
+			return
+		}
+	}
+	text := "Generation failed."
+	if reqErr, ok := err.(*requestError); ok {
+		text = reqErr.message
+	}
+	editDiscordReply(ctx, in, text, nil)
+}
+
+// reportDiscordProgress edits the deferred reply whenever the job's queue
+// status changes, until ctx is done.
+func reportDiscordProgress(ctx context.Context, in *discordInteraction, jobID string) {
+	ticker := time.NewTicker(discordProgressInterval)
+	defer ticker.Stop()
+	last := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		status, ok := line.status(jobID)
+		if !ok {
+			continue
+		}
+		text := "Generating…"
+		if status.Status == "queued" {
+			text = fmt.Sprintf("Queued at position %d", status.Position)
+		}
+		if status.ETASeconds >= 0 {
+			text += fmt.Sprintf(", about %.0fs left", status.ETASeconds)
+		}
+		if text != last {
+			editDiscordReply(ctx, in, text, nil)
+			last = text
+		}
+	}
+}
+
+type discordFile struct {
+	Name string
+	Data []byte
+}
+
+// editDiscordReply replaces the content of the interaction's reply,
+// attaching file if given.
+func editDiscordReply(ctx context.Context, in *discordInteraction, content string, file *discordFile) {
+	payload := map[string]interface{}{"content": content}
+	if file != nil {
+		payload["attachments"] = []map[string]interface{}{{"id": 0, "filename": file.Name}}
+	}
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("payload_json", string(payloadJSON))
+	if file != nil {
+		part, err := mw.CreateFormFile("files[0]", file.Name)
+		if err != nil {
+			return
+		}
+		part.Write(file.Data)
+	}
+	mw.Close()
+
+	url := fmt.Sprintf("%s/webhooks/%s/%s/messages/@original", discordAPIURL(), in.ApplicationID, in.Token)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url, &body)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Failed to edit Discord reply: request failed")
+		}
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		log.Printf("Failed to edit Discord reply: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
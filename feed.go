@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultFeedEntries = 50
+	maxFeedEntries     = 500
+	thumbnailSize      = 256 // longest side in pixels
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  *atomAuthor `xml:"author,omitempty"`
+	Links   []atomLink  `xml:"link"`
+	Content atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// handleFeed serves the most recent generations as an Atom feed at
+// /generated/feed.xml, newest first, with a thumbnail and the parameters of
+// every image. The limit parameter sets the number of entries.
+func handleFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultFeedEntries
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxFeedEntries {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxFeedEntries), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	var recent []imageMetadata // newest first
+	err := walkRecentHistory(r.Context(), func(meta imageMetadata) bool {
+		recent = append(recent, meta)
+		return len(recent) < limit
+	})
+	if err != nil {
+		log.Printf("Failed to read history for the feed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	base := externalBaseURL(r)
+	feed := atomFeed{
+		Title:   "Recent generations",
+		ID:      base + basePath + "/generated/feed.xml",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "self", Type: "application/atom+xml", Href: base + basePath + r.URL.RequestURI()}},
+	}
+	if len(recent) > 0 {
+		feed.Updated = recent[0].CreatedAt.UTC().Format(time.RFC3339)
+	}
+	for _, meta := range recent {
+		feed.Entries = append(feed.Entries, feedEntry(base, meta))
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		log.Printf("Failed to write feed: %v", err)
+	}
+}
+
+// feedEntry describes one image; the content is HTML with the thumbnail
+// linking to the image and a table of the parameters.
+func feedEntry(base string, meta imageMetadata) atomEntry {
+	imageURL := base + generatedURL(meta.Name)
+	title := meta.Prompt
+	if r := []rune(title); len(r) > 80 {
+		title = string(r[:80]) + "…"
+	}
+	if title == "" {
+		title = meta.Name
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, `<p><a href="%s"><img src="%s/thumb" alt="%s"></a></p>`,
+		html.EscapeString(imageURL), html.EscapeString(imageURL), html.EscapeString(meta.Name))
+	body.WriteString("<table>")
+	row := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&body, "<tr><th>%s</th><td>%s</td></tr>", name, html.EscapeString(value))
+		}
+	}
+	row("Prompt", meta.Prompt)
+	row("Negative prompt", meta.NegativePrompt)
+	row("Model", meta.Profile)
+	row("Mode", meta.Mode)
+	row("Size", fmt.Sprintf("%dx%d", meta.Width, meta.Height))
+	row("Seed", strconv.FormatInt(meta.Seed, 10))
+	row("Sampler", fmt.Sprintf("%s, %d steps, CFG %g", meta.Sampler, meta.Steps, meta.CfgScale))
+	row("Generation time", fmt.Sprintf("%.1fs", meta.Timings.Generation))
+	body.WriteString("</table>")
+
+	entry := atomEntry{
+		Title:   title,
+		ID:      imageURL,
+		Updated: meta.CreatedAt.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "alternate", Type: "image/png", Href: imageURL},
+			{Rel: "related", Type: "application/json", Href: imageURL + "/params"},
+		},
+		Content: atomContent{Type: "html", Body: body.String()},
+	}
+	if meta.User != "" {
+		entry.Author = &atomAuthor{Name: meta.User}
+	}
+	return entry
+}
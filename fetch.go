@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetchError is a failed image download; retry tells whether another attempt
+// may succeed.
+type fetchError struct {
+	err   error
+	retry bool
+}
+
+func (e *fetchError) Error() string {
+	return e.err.Error()
+}
+
+// fetchImage downloads an image by absolute URL or by a path relative to the
+// image URL prefix, falling back to baseURL. The adapter's own outputs are
+// read from storage instead. Unparseable or scheme-less URLs yield no data
+// and no error. Downloads are cached and revalidated by ETag, and transient
+// failures are retried with exponential backoff.
+func fetchImage(ctx context.Context, imageURL, baseURL string) ([]byte, error) {
+	if name, ok := generatedImageName(imageURL, baseURL); ok {
+		return loadGeneratedImage(ctx, name)
+	}
+	finalURL := imageURL
+	if strings.HasPrefix(finalURL, "/") {
+		prefix := imageURLPrefix
+		if prefix == "" {
+			prefix = baseURL
+		}
+		finalURL = prefix + finalURL
+	}
+	// Validate URL
+	u, err := url.Parse(finalURL)
+	if err != nil || u.Scheme == "" {
+		return nil, nil
+	}
+
+	cached, fresh := remoteImages.get(finalURL)
+	if fresh {
+		return cached.data, nil
+	}
+
+	client := fetchClient()
+	var lastErr *fetchError
+	for attempt := 0; attempt <= fetchRetries; attempt++ {
+		if attempt > 0 {
+			delay := fetchBackoff << (attempt - 1)
+			log.Printf("Fetching %s failed (%v), retrying in %s", finalURL, lastErr, delay)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+		data, err := fetchImageOnce(ctx, client, finalURL, cached)
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+		if !err.retry || ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// fetchClient returns the client shared by all image downloads, so that their
+// connections are reused and idle ones closed.
+var fetchClient = sync.OnceValue(func() *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if fetchInsecure {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{Transport: tr, Timeout: fetchTimeout}
+})
+
+// generatedImageName returns the name of the stored image a URL refers to if
+// it is one of the adapter's own /generated/ URLs, relative or absolute; the
+// name is validated when the image is loaded. In
+// proxy mode the images are the backends' and have to be downloaded.
+func generatedImageName(imageURL, baseURL string) (string, bool) {
+	if len(backends) > 0 {
+		return "", false
+	}
+	path := imageURL
+	for _, prefix := range []string{imageURLPrefix, baseURL} {
+		if prefix != "" && strings.HasPrefix(path, prefix+"/") {
+			path = strings.TrimPrefix(path, prefix)
+			break
+		}
+	}
+	path, ok := strings.CutPrefix(path, basePath+"/generated/")
+	if !ok {
+		return "", false
+	}
+	return path, true
+}
+
+// loadGeneratedImage reads one of the caller's images from storage.
+func loadGeneratedImage(ctx context.Context, name string) ([]byte, error) {
+	if !validImageName(name) || !ownsImage(ctx, name) {
+		return nil, fmt.Errorf("unknown image %s", name)
+	}
+	data, err := store.Get(ctx, name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("unknown image %s", name)
+		}
+		return nil, fmt.Errorf("failed to read image %s: %w", name, err)
+	}
+	return data, nil
+}
+
+func fetchImageOnce(ctx context.Context, client *http.Client, imageURL string, cached *cachedImage) ([]byte, *fetchError) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return nil, &fetchError{err: fmt.Errorf("invalid image URL: %w", err)}
+	}
+	if cached != nil && cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, classifyFetchError(req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		remoteImages.refresh(imageURL)
+		return cached.data, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+		return nil, &fetchError{err: fmt.Errorf("image URL returned status: %s", resp.Status), retry: retry}
+	}
+
+	imgData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &fetchError{err: fmt.Errorf("failed to read image data from response: %w", err), retry: true}
+	}
+	remoteImages.put(imageURL, imgData, resp.Header.Get("ETag"))
+	return imgData, nil
+}
+
+// classifyFetchError turns a transport error into a message telling DNS, TLS,
+// timeout and connection failures apart. Only DNS lookups that found no such
+// host and TLS failures are considered permanent.
+func classifyFetchError(host string, err error) *fetchError {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsNotFound {
+			return &fetchError{err: fmt.Errorf("failed to fetch image: host %s not found", dnsErr.Name)}
+		}
+		return &fetchError{err: fmt.Errorf("failed to fetch image: DNS lookup of %s failed: %v", dnsErr.Name, dnsErr.Err), retry: true}
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &alertErr):
+		return &fetchError{err: fmt.Errorf("failed to fetch image: TLS handshake with %s failed: %v", host, err)}
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return &fetchError{err: fmt.Errorf("failed to fetch image: %s did not respond within %s", host, fetchTimeout), retry: true}
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return &fetchError{err: fmt.Errorf("failed to fetch image: could not connect to %s: %v", host, opErr.Err), retry: true}
+	default:
+		return &fetchError{err: fmt.Errorf("failed to fetch image from URL: %w", err), retry: true}
+	}
+}
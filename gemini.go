@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// geminiRequest is the body of Gemini's generateContent. The REST API accepts
+// field names in camelCase and snake_case, so both are decoded.
+type geminiRequest struct {
+	Contents         []geminiContent `json:"contents"`
+	GenerationConfig struct {
+		CandidateCount      int `json:"candidateCount"`
+		CandidateCountSnake int `json:"candidate_count"`
+	} `json:"generationConfig"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text            string      `json:"text,omitempty"`
+	InlineData      *geminiBlob `json:"inlineData,omitempty"`
+	InlineDataSnake *geminiBlob `json:"inline_data,omitempty"`
+	FileData        *struct {
+		FileURI      string `json:"fileUri"`
+		FileURISnake string `json:"file_uri"`
+	} `json:"fileData,omitempty"`
+}
+
+type geminiBlob struct {
+	MimeType      string `json:"mimeType,omitempty"`
+	MimeTypeSnake string `json:"mime_type,omitempty"`
+	Data          string `json:"data"`
+}
+
+type geminiCandidate struct {
+	Content      geminiContent `json:"content"`
+	FinishReason string        `json:"finishReason"`
+	Index        int           `json:"index"`
+}
+
+// chatMessages converts the conversation to the chat completions form, with
+// inline images as data URLs, so that it is read like any other.
+func (r geminiRequest) chatMessages() []Message {
+	var messages []Message
+	for _, c := range r.Contents {
+		msg := Message{Role: "user"}
+		if c.Role == "model" {
+			msg.Role = "assistant"
+		}
+		for _, p := range c.Parts {
+			blob := p.InlineData
+			if blob == nil {
+				blob = p.InlineDataSnake
+			}
+			switch {
+			case blob != nil:
+				mimeType := blob.MimeType
+				if mimeType == "" {
+					mimeType = blob.MimeTypeSnake
+				}
+				url := fmt.Sprintf("data:%s;base64,%s", mimeType, blob.Data)
+				msg.Content = append(msg.Content, ContentPart{Type: "image_url", ImageURL: &ImagePart{URL: url}})
+			case p.FileData != nil:
+				uri := p.FileData.FileURI
+				if uri == "" {
+					uri = p.FileData.FileURISnake
+				}
+				msg.Content = append(msg.Content, ContentPart{Type: "image_url", ImageURL: &ImagePart{URL: uri}})
+			case p.Text != "":
+				msg.Content = append(msg.Content, ContentPart{Type: "text", Text: p.Text})
+			}
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// writeGeminiError writes an error in the shape of Google's APIs.
+func writeGeminiError(w http.ResponseWriter, status int, message string) {
+	statusName := "INTERNAL"
+	switch status {
+	case http.StatusBadRequest:
+		statusName = "INVALID_ARGUMENT"
+	case http.StatusNotFound:
+		statusName = "NOT_FOUND"
+	case http.StatusMethodNotAllowed:
+		statusName = "UNIMPLEMENTED"
+	case http.StatusTooManyRequests:
+		statusName = "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable:
+		statusName = "UNAVAILABLE"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": message, "status": statusName},
+	})
+}
+
+func writeGeminiJobError(w http.ResponseWriter, err error) {
+	if reqErr, ok := err.(*requestError); ok {
+		writeGeminiError(w, reqErr.status, reqErr.message)
+		return
+	}
+	writeGeminiError(w, http.StatusInternalServerError, "Internal server error")
+}
+
+// handleGemini serves Gemini's POST /v1beta/models/{model}:generateContent:
+// the last user text is the prompt, inline images are init images and every
+// generated image is a candidate with an inlineData part, candidateCount
+// giving the number of images.
+func handleGemini(w http.ResponseWriter, r *http.Request) {
+	model, method, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1beta/models/"), ":")
+	if !ok || method != "generateContent" {
+		writeGeminiError(w, http.StatusNotFound, "Unknown method, only generateContent is supported")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeGeminiError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req geminiRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeGeminiError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	ctx := r.Context()
+	prompt, images, err := extractPromptAndImages(ctx, req.chatMessages(), externalBaseURL(r))
+	if err != nil {
+		writeGeminiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if prompt == "" {
+		writeGeminiError(w, http.StatusBadRequest, "No user prompt provided")
+		return
+	}
+	fmt.Println("Gemini prompt:", prompt)
+
+	n := max(req.GenerationConfig.CandidateCount, req.GenerationConfig.CandidateCountSnake)
+	j, _, err := chatJob(ctx, ChatRequest{Model: model, N: n}, prompt, images)
+	if err != nil {
+		writeGeminiJobError(w, err)
+		return
+	}
+	setQueueHeaders(w, j)
+	result, err := runJob(ctx, j)
+	if err != nil {
+		writeGeminiJobError(w, err)
+		return
+	}
+
+	var candidates []geminiCandidate
+	for i, meta := range result.Images {
+		data, err := store.Get(ctx, meta.Name)
+		if err != nil {
+			log.Printf("Failed to load %s: %v", meta.Name, err)
+			writeGeminiError(w, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		candidates = append(candidates, geminiCandidate{
+			Content: geminiContent{Role: "model", Parts: []geminiPart{
+				{InlineData: &geminiBlob{MimeType: "image/png", Data: base64.StdEncoding.EncodeToString(data)}},
+				{Text: fmt.Sprintf("![seed %d](%s)", meta.Seed, generatedURL(meta.Name))},
+			}},
+			FinishReason: "STOP",
+			Index:        i,
+		})
+	}
+	writeJSON(w, map[string]interface{}{"candidates": candidates, "modelVersion": model})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// generation describes a single sd invocation. BatchCount images are produced,
+// with consecutive seeds starting at Seed.
+type generation struct {
+	Profile        string // model profile name, the default profile if unknown
+	Prompt         string
+	NegativePrompt string
+	Images         [][]byte // fitted init/reference images, most recent last
+	InitImage      []byte   // img2img init image, takes precedence over Images
+	Strength       float64  // img2img denoising strength
+	StyleImage     []byte   // style reference, passed to sd as a reference image
+	Size           resolution
+	Seed           int64
+	BatchCount     int
+	Sampler        string
+	Steps          int
+	CfgScale       float64
+	FastDecode     bool // decode with -taesd if set, for previews
+
+	// Edit-mode knobs; when nil the -edit-* flag defaults apply.
+	ImageGuidance *float64
+	Guidance      *float64
+}
+
+// generatedImage is one image produced by a generation, along with the
+// parameters that produced it.
+type generatedImage struct {
+	Data []byte
+	Meta imageMetadata
+}
+
+func randomSeed() int64 {
+	return rand.Int63n(math.MaxUint32)
+}
+
+// editArgs returns the edit-mode specific sd arguments, preferring values from
+// the generation over the flag defaults.
+func editArgs(gen generation) []string {
+	var args []string
+	imgCfgScale := editImgCfgScale
+	if gen.ImageGuidance != nil {
+		imgCfgScale = strconv.FormatFloat(*gen.ImageGuidance, 'f', -1, 64)
+	}
+	if imgCfgScale != "" {
+		args = append(args, "--img-cfg-scale", imgCfgScale)
+	}
+	guidance := editGuidance
+	if gen.Guidance != nil {
+		guidance = strconv.FormatFloat(*gen.Guidance, 'f', -1, 64)
+	}
+	if guidance != "" {
+		args = append(args, "--guidance", guidance)
+	}
+	return args
+}
+
+// batchOutputPath returns the file sd writes the i-th image of a batch to in
+// dir.
+func batchOutputPath(dir string, i int) string {
+	if i == 0 {
+		return filepath.Join(dir, "output.png")
+	}
+	return filepath.Join(dir, fmt.Sprintf("output_%d.png", i+1))
+}
+
+// runDir returns the directory a local sd run keeps its input and output
+// images in and a function removing it afterwards: a fresh directory below
+// -temp-dir, which is best on a tmpfs, or the system's temp directory. Runs
+// of different pools may overlap, so they never share a directory.
+func runDir() (string, func(), error) {
+	dir, err := os.MkdirTemp(tempDir, "sd-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }, nil
+}
+
+// withDefaults fills in the parameters the request left to the flag defaults.
+func (gen generation) withDefaults() generation {
+	if gen.BatchCount < 1 {
+		gen.BatchCount = 1
+	}
+	if gen.Sampler == "" {
+		gen.Sampler = defaultSampler
+	}
+	if gen.Steps <= 0 {
+		gen.Steps = defaultSteps
+	}
+	if gen.CfgScale <= 0 {
+		gen.CfgScale = defaultCfgScale
+	}
+	return gen
+}
+
+// runGeneration runs a generation on a worker in coordinator mode and with the
+// local sd binary otherwise. Local runs wait for a slot of the pool of their
+// profile and are restricted to its devices.
+func runGeneration(ctx context.Context, gen generation) ([]generatedImage, error) {
+	if role == roleCoordinator {
+		return dispatchGeneration(ctx, gen)
+	}
+	pool := poolOf(gen)
+	device, err := pool.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.release(device)
+	return runLocalGeneration(withDevice(ctx, device), gen)
+}
+
+// runLocalGeneration runs sd, or hands off to the profile's sd server, for the
+// given generation and returns the images it produced.
+func runLocalGeneration(ctx context.Context, gen generation) ([]generatedImage, error) {
+	gen = gen.withDefaults()
+
+	profile := resolveProfile(gen.Profile)
+	meta := imageMetadata{
+		Profile:        profile.Name,
+		Mode:           "txt2img",
+		Prompt:         gen.Prompt,
+		NegativePrompt: gen.NegativePrompt,
+		Width:          gen.Size.Width,
+		Height:         gen.Size.Height,
+		Sampler:        gen.Sampler,
+		Steps:          gen.Steps,
+		CfgScale:       gen.CfgScale,
+	}
+
+	if profile.DiffusionModel != "" {
+		meta.DiffusionModel = filepath.Base(profile.DiffusionModel)
+	}
+	if chunks := splitPromptChunks(gen.Prompt); len(chunks) > 1 {
+		meta.PromptChunks = chunks
+	}
+	if generationBackend == backendMock {
+		return runMockGeneration(ctx, gen, meta)
+	}
+	if profile.ServerURL != "" {
+		return runRemoteGeneration(ctx, profile.ServerURL, gen, meta)
+	}
+
+	dir, cleanup, err := runDir()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	args := append(profile.args(),
+		"-p", gen.Prompt,
+		"--cfg-scale", strconv.FormatFloat(gen.CfgScale, 'f', -1, 64),
+		"--sampling-method", gen.Sampler,
+		"--seed", strconv.FormatInt(gen.Seed, 10),
+		"--diffusion-fa",
+		"--height", strconv.Itoa(gen.Size.Height),
+		"--width", strconv.Itoa(gen.Size.Width),
+		"--steps", strconv.Itoa(gen.Steps),
+		"-o", batchOutputPath(dir, 0),
+		"-v",
+	)
+	if gen.NegativePrompt != "" {
+		args = append(args, "-n", gen.NegativePrompt)
+	}
+	if gen.BatchCount > 1 {
+		args = append(args, "-b", strconv.Itoa(gen.BatchCount))
+	}
+	if gen.FastDecode && taesdPath != "" {
+		args = append(args, "--taesd", taesdPath)
+	}
+
+	if len(gen.InitImage) > 0 {
+		initPath := filepath.Join(dir, "init.png")
+		if err := os.WriteFile(initPath, gen.InitImage, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write init image: %w", err)
+		}
+		defer os.Remove(initPath)
+		args = append(args, "-i", initPath, "--strength", strconv.FormatFloat(gen.Strength, 'f', -1, 64))
+		meta.Mode = "img2img"
+		meta.Strength = gen.Strength
+	} else if len(gen.Images) > 0 {
+		last := gen.Images[len(gen.Images)-1]
+		maskData, hasMask, err := alphaMask(last)
+		if err != nil {
+			return nil, err
+		}
+		if hasMask {
+			inputPath, maskPath := filepath.Join(dir, "input.png"), filepath.Join(dir, "mask.png")
+			if err := os.WriteFile(inputPath, last, 0644); err != nil {
+				return nil, fmt.Errorf("failed to write input image: %w", err)
+			}
+			defer os.Remove(inputPath)
+			if err := os.WriteFile(maskPath, maskData, 0644); err != nil {
+				return nil, fmt.Errorf("failed to write inpainting mask: %w", err)
+			}
+			defer os.Remove(maskPath)
+			fmt.Println("Transparent regions found, inpainting with alpha mask")
+			args = append(args, "-i", inputPath, "--mask", maskPath, "--strength", inpaintStrength)
+			meta.Mode = "inpaint"
+		} else {
+			args = append(args, "-M", "edit")
+			args = append(args, editArgs(gen)...)
+			meta.Mode = "edit"
+			meta.ImageGuidance = gen.ImageGuidance
+			meta.Guidance = gen.Guidance
+			for i, data := range gen.Images {
+				name := filepath.Join(dir, fmt.Sprintf("input_%d.png", i))
+				if err := os.WriteFile(name, data, 0644); err != nil {
+					return nil, fmt.Errorf("failed to write input image: %w", err)
+				}
+				defer os.Remove(name)
+				args = append(args, "-r", name)
+			}
+		}
+	}
+
+	if len(gen.StyleImage) > 0 {
+		stylePath := filepath.Join(dir, "style.png")
+		if err := os.WriteFile(stylePath, gen.StyleImage, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write style image: %w", err)
+		}
+		defer os.Remove(stylePath)
+		if meta.Mode == "txt2img" {
+			args = append(args, "-M", "edit")
+			args = append(args, editArgs(gen)...)
+		}
+		args = append(args, "-r", stylePath)
+		meta.StyleReference = true
+	}
+
+	// Stale outputs of an earlier run must not be mistaken for this one's.
+	for i := 0; i < gen.BatchCount; i++ {
+		os.Remove(batchOutputPath(dir, i))
+	}
+
+	// sd's output is echoed, streamed to /admin/logs/stream and also kept to
+	// extract timings from.
+	var output bytes.Buffer
+	cmd, err := sdCommand(ctx, profile, dir, args)
+	if err != nil {
+		return nil, err
+	}
+	recordArgv(ctx, cmd.Args)
+	stdout, stderr := sdOutput(ctx)
+	cmd.Stdout = io.MultiWriter(stdout, &output)
+	cmd.Stderr = io.MultiWriter(stderr, &output)
+
+	start := time.Now()
+	if err := runSD(cmd, profile); err != nil {
+		return nil, fmt.Errorf("command failed: %w", err)
+	}
+	meta.Timings.Generation = time.Since(start).Seconds()
+	parseSDTimings(output.String(), &meta.Timings)
+
+	results := make([]generatedImage, 0, gen.BatchCount)
+	for i := 0; i < gen.BatchCount; i++ {
+		data, err := os.ReadFile(batchOutputPath(dir, i))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", batchOutputPath(dir, i), err)
+		}
+		os.Remove(batchOutputPath(dir, i))
+		meta.Seed = gen.Seed + int64(i)
+		results = append(results, generatedImage{Data: data, Meta: meta})
+	}
+	return results, nil
+}
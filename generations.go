@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// generationOverrides are optional changes applied to the stored parameters of a
+// generation when it is run again. A seed of -1 picks a new random seed.
+type generationOverrides struct {
+	Seed           *int64   `json:"seed,omitempty"`
+	Steps          *int     `json:"steps,omitempty"`
+	CfgScale       *float64 `json:"cfg_scale,omitempty"`
+	Sampler        *string  `json:"sampler,omitempty"`
+	Size           *string  `json:"size,omitempty"`
+	NegativePrompt *string  `json:"negative_prompt,omitempty"`
+	N              int      `json:"n,omitempty"`
+
+	// Strength is only used by variations.
+	Strength *float64 `json:"strength,omitempty"`
+}
+
+// generationResponse is returned by the /v1/generations endpoints.
+type generationResponse struct {
+	Created int64                    `json:"created"`
+	Data    []generationResponseItem `json:"data"`
+}
+
+type generationResponseItem struct {
+	URL    string        `json:"url"`
+	Params imageMetadata `json:"params"`
+}
+
+func newGenerationResponse(result jobResult) generationResponse {
+	resp := generationResponse{Created: time.Now().Unix()}
+	for _, meta := range result.Images {
+		resp.Data = append(resp.Data, generationResponseItem{URL: generatedURL(meta.Name), Params: meta})
+	}
+	return resp
+}
+
+// handleGenerations routes /v1/generations/{id}/{action}, where id is the name
+// of a generated image with or without its .png extension, including the
+// tenant with -tenant-isolation, e.g. bob/output_1.
+func handleGenerations(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/generations/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	name, action := path[:i], path[i+1:]
+	if !strings.HasSuffix(name, ".png") {
+		name += ".png"
+	}
+	if !validImageName(name) || !ownsImage(r.Context(), name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch action {
+	case "rerun":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleRerun(w, r, name)
+	case "variations":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleVariations(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// loadGenerationMetadata loads the stored parameters of a generation, mapping a
+// missing record to a 404.
+func loadGenerationMetadata(ctx context.Context, name string) (imageMetadata, error) {
+	meta, err := loadMetadata(ctx, name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return meta, &requestError{http.StatusNotFound, "Unknown generation"}
+		}
+		log.Printf("Failed to load metadata for %s: %v", name, err)
+		return meta, err
+	}
+	return meta, nil
+}
+
+// decodeOverrides reads optional overrides from the request body; an empty
+// body means no overrides.
+func decodeOverrides(r *http.Request) (generationOverrides, error) {
+	var overrides generationOverrides
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return overrides, &requestError{http.StatusBadRequest, "Failed to read request body"}
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return overrides, nil
+	}
+	if err := validateRequest(body, &overrides); err != nil {
+		return overrides, err
+	}
+	if err := json.Unmarshal(body, &overrides); err != nil {
+		return overrides, &requestError{http.StatusBadRequest, "Invalid request"}
+	}
+	return overrides, nil
+}
+
+// apply returns the generation described by meta with the overrides applied.
+func (o generationOverrides) apply(meta imageMetadata) (generation, error) {
+	gen := generation{
+		Profile:        meta.Profile,
+		Prompt:         meta.Prompt,
+		NegativePrompt: meta.NegativePrompt,
+		Size:           resolution{Width: meta.Width, Height: meta.Height},
+		Seed:           meta.Seed,
+		BatchCount:     max(1, o.N),
+		Sampler:        meta.Sampler,
+		Steps:          meta.Steps,
+		CfgScale:       meta.CfgScale,
+		ImageGuidance:  meta.ImageGuidance,
+		Guidance:       meta.Guidance,
+	}
+	if gen.BatchCount > maxBatch {
+		return gen, &requestError{http.StatusBadRequest, fmt.Sprintf("n must not exceed %d", maxBatch)}
+	}
+	if o.Seed != nil {
+		gen.Seed = *o.Seed
+	}
+	if o.Steps != nil {
+		if *o.Steps <= 0 {
+			return gen, &requestError{http.StatusBadRequest, "steps must be positive"}
+		}
+		gen.Steps = *o.Steps
+	}
+	if o.CfgScale != nil {
+		if *o.CfgScale <= 0 {
+			return gen, &requestError{http.StatusBadRequest, "cfg_scale must be positive"}
+		}
+		gen.CfgScale = *o.CfgScale
+	}
+	if o.Sampler != nil {
+		gen.Sampler = *o.Sampler
+	}
+	if o.NegativePrompt != nil {
+		gen.NegativePrompt = *o.NegativePrompt
+	}
+	if o.Size != nil {
+		size, err := parseResolution(*o.Size)
+		if err != nil {
+			return gen, &requestError{http.StatusBadRequest, err.Error()}
+		}
+		if gen.Size, err = resolveProfile(meta.Profile).fitSize(size, sizePolicy == "snap"); err != nil {
+			return gen, &requestError{http.StatusBadRequest, err.Error()}
+		}
+	}
+	return gen, nil
+}
+
+// handleRerun runs a previous generation again from its stored parameters,
+// e.g. with a new seed, more steps or a bigger size.
+func handleRerun(w http.ResponseWriter, r *http.Request, name string) {
+	meta, err := loadGenerationMetadata(r.Context(), name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if meta.Mode != "txt2img" || meta.StyleReference {
+		http.Error(w, "Only text-to-image generations can be rerun, as input images are not stored", http.StatusUnprocessableEntity)
+		return
+	}
+
+	overrides, err := decodeOverrides(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	gen, err := overrides.apply(meta)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	fmt.Printf("Rerunning %s\n", name)
+	result, err := runJob(r.Context(), job{gen: gen, model: meta.Model, restoreFaces: meta.RestoreFaces})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, newGenerationResponse(result))
+}
+
+// handleVariations generates new images from a previous output by using it as
+// the img2img init image with fresh random seeds.
+func handleVariations(w http.ResponseWriter, r *http.Request, name string) {
+	meta, err := loadGenerationMetadata(r.Context(), name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	overrides, err := decodeOverrides(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	gen, err := overrides.apply(meta)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if overrides.Seed == nil {
+		gen.Seed = randomSeed()
+	}
+	gen.Images = nil
+	gen.Strength = variationStrength
+	if overrides.Strength != nil {
+		gen.Strength = *overrides.Strength
+	}
+	if gen.Strength <= 0 || gen.Strength > 1 {
+		http.Error(w, "strength must be in (0, 1]", http.StatusBadRequest)
+		return
+	}
+
+	imgData, err := store.Get(r.Context(), name)
+	if err != nil {
+		log.Printf("Failed to read %s: %v", name, err)
+		http.Error(w, "Unknown generation", http.StatusNotFound)
+		return
+	}
+	// Post-processing may have changed the size, so bring the image back to
+	// the size being generated.
+	gen.InitImage, _, err = fitInitImage(imgData, []resolution{gen.Size}, "stretch")
+	if err != nil {
+		log.Printf("Failed to prepare %s as init image: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("Generating %d variation(s) of %s\n", gen.BatchCount, name)
+	result, err := runJob(r.Context(), job{gen: gen, model: meta.Model, restoreFaces: meta.RestoreFaces})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, newGenerationResponse(result))
+}
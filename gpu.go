@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gpuSample is one reading of a GPU's state. Values a tool doesn't report
+// are negative.
+type gpuSample struct {
+	Index          string
+	Name           string
+	Utilization    float64 // percent
+	MemoryUsedMiB  float64
+	MemoryTotalMiB float64
+	TemperatureC   float64
+	PowerW         float64
+}
+
+var (
+	gpuMu      sync.Mutex
+	gpuSamples []gpuSample
+	gpuSampled time.Time
+)
+
+// latestGPUSamples returns the most recent readings and when they were taken.
+func latestGPUSamples() ([]gpuSample, time.Time) {
+	gpuMu.Lock()
+	defer gpuMu.Unlock()
+	return gpuSamples, gpuSampled
+}
+
+// detectGPUTool returns the sampling tool to use for -gpu-smi auto.
+func detectGPUTool() string {
+	for _, tool := range []string{"nvidia-smi", "rocm-smi"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			return tool
+		}
+	}
+	return ""
+}
+
+// sampleGPUs polls the GPU tool every interval until ctx is done.
+func sampleGPUs(ctx context.Context, tool string, interval time.Duration) {
+	for {
+		samples, err := readGPUs(ctx, tool)
+		if err != nil {
+			log.Printf("Failed to sample GPUs with %s: %v", tool, err)
+		} else {
+			gpuMu.Lock()
+			gpuSamples, gpuSampled = samples, time.Now()
+			gpuMu.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func readGPUs(ctx context.Context, tool string) ([]gpuSample, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	base := strings.TrimSuffix(filepath.Base(tool), ".exe")
+	var args []string
+	switch base {
+	case "nvidia-smi":
+		args = []string{"--query-gpu=index,name,utilization.gpu,memory.used,memory.total,temperature.gpu,power.draw", "--format=csv,noheader,nounits"}
+	case "rocm-smi":
+		args = []string{"--showuse", "--showmeminfo", "vram", "--showtemp", "--showpower", "--showproductname", "--json"}
+	default:
+		return nil, fmt.Errorf("unsupported tool, expected nvidia-smi or rocm-smi")
+	}
+	out, err := exec.CommandContext(ctx, tool, args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	if base == "nvidia-smi" {
+		return parseNvidiaSMI(out)
+	}
+	return parseROCmSMI(out)
+}
+
+// gpuValue parses a reading, mapping "[N/A]" and the like to -1.
+func gpuValue(s string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return -1
+	}
+	return v
+}
+
+func parseNvidiaSMI(out []byte) ([]gpuSample, error) {
+	r := csv.NewReader(bytes.NewReader(out))
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid nvidia-smi output: %w", err)
+	}
+	var samples []gpuSample
+	for _, rec := range records {
+		if len(rec) < 7 {
+			continue
+		}
+		samples = append(samples, gpuSample{
+			Index:          strings.TrimSpace(rec[0]),
+			Name:           strings.TrimSpace(rec[1]),
+			Utilization:    gpuValue(rec[2]),
+			MemoryUsedMiB:  gpuValue(rec[3]),
+			MemoryTotalMiB: gpuValue(rec[4]),
+			TemperatureC:   gpuValue(rec[5]),
+			PowerW:         gpuValue(rec[6]),
+		})
+	}
+	return samples, nil
+}
+
+// parseROCmSMI reads rocm-smi's JSON output, whose field names vary between
+// versions, so values are matched by the start of their names.
+func parseROCmSMI(out []byte) ([]gpuSample, error) {
+	var cards map[string]map[string]string
+	if err := json.Unmarshal(out, &cards); err != nil {
+		return nil, fmt.Errorf("invalid rocm-smi output: %w", err)
+	}
+	var names []string
+	for name := range cards {
+		if strings.HasPrefix(name, "card") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var samples []gpuSample
+	for _, name := range names {
+		s := gpuSample{Index: strings.TrimPrefix(name, "card"), Utilization: -1, MemoryUsedMiB: -1, MemoryTotalMiB: -1, TemperatureC: -1, PowerW: -1}
+		for key, value := range cards[name] {
+			switch {
+			case strings.HasPrefix(key, "Card series"), strings.HasPrefix(key, "Card Series"):
+				s.Name = value
+			case strings.HasPrefix(key, "GPU use"):
+				s.Utilization = gpuValue(value)
+			case strings.HasPrefix(key, "VRAM Total Used Memory"):
+				s.MemoryUsedMiB = gpuValue(value) / (1 << 20)
+			case strings.HasPrefix(key, "VRAM Total Memory"):
+				s.MemoryTotalMiB = gpuValue(value) / (1 << 20)
+			case strings.HasPrefix(key, "Temperature") && strings.Contains(key, "edge"):
+				s.TemperatureC = gpuValue(value)
+			case strings.Contains(key, "Power") && strings.HasSuffix(key, "(W)"):
+				s.PowerW = gpuValue(value)
+			}
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
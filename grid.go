@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+)
+
+// composeGrid lays images out in a grid with cols columns and writes a caption
+// under each one. Cells take the size of the largest image; smaller images are
+// centered in their cell.
+func composeGrid(images [][]byte, captions []string, cols int) ([]byte, error) {
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no images to compose")
+	}
+	if cols < 1 {
+		cols = int(math.Ceil(math.Sqrt(float64(len(images)))))
+	}
+	rows := (len(images) + cols - 1) / cols
+
+	decoded := make([]image.Image, len(images))
+	cellW, cellH := 0, 0
+	for i, data := range images {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image #%d: %w", i, err)
+		}
+		decoded[i] = img
+		cellW = max(cellW, img.Bounds().Dx())
+		cellH = max(cellH, img.Bounds().Dy())
+	}
+
+	scale := max(1, cellW/256)
+	padding := 2 * scale
+	captionH := glyphHeight*scale + 2*padding
+
+	grid := image.NewNRGBA(image.Rect(0, 0, cols*cellW, rows*(cellH+captionH)))
+	draw.Draw(grid, grid.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	for i, img := range decoded {
+		x := (i % cols) * cellW
+		y := (i / cols) * (cellH + captionH)
+		b := img.Bounds()
+		offset := image.Pt(x+(cellW-b.Dx())/2, y+(cellH-b.Dy())/2)
+		draw.Draw(grid, image.Rectangle{Min: offset, Max: offset.Add(b.Size())}, img, b.Min, draw.Src)
+
+		if i < len(captions) {
+			caption := truncateText(captions[i], scale, cellW-2*padding)
+			tx := x + (cellW-textWidth(caption, scale))/2
+			drawText(grid, tx, y+cellH+padding, caption, scale, color.Black)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, grid); err != nil {
+		return nil, fmt.Errorf("failed to encode grid: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// composeLabeledGrid lays images out in row-major order under a header row of
+// column labels and next to a column of row labels, as used by X/Y plots.
+func composeLabeledGrid(images [][]byte, colLabels, rowLabels []string) ([]byte, error) {
+	cols := len(colLabels)
+	if len(images) != cols*len(rowLabels) {
+		return nil, fmt.Errorf("expected %d images, got %d", cols*len(rowLabels), len(images))
+	}
+
+	decoded := make([]image.Image, len(images))
+	cellW, cellH := 0, 0
+	for i, data := range images {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image #%d: %w", i, err)
+		}
+		decoded[i] = img
+		cellW = max(cellW, img.Bounds().Dx())
+		cellH = max(cellH, img.Bounds().Dy())
+	}
+
+	scale := max(1, cellW/256)
+	padding := 2 * scale
+	headerH := glyphHeight*scale + 2*padding
+	labelW := 0
+	for _, label := range rowLabels {
+		labelW = max(labelW, textWidth(label, scale))
+	}
+	labelW = min(labelW, cellW) + 2*padding
+
+	grid := image.NewNRGBA(image.Rect(0, 0, labelW+cols*cellW, headerH+len(rowLabels)*cellH))
+	draw.Draw(grid, grid.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	for i, label := range colLabels {
+		label = truncateText(label, scale, cellW-2*padding)
+		drawText(grid, labelW+i*cellW+(cellW-textWidth(label, scale))/2, padding, label, scale, color.Black)
+	}
+	for i, label := range rowLabels {
+		label = truncateText(label, scale, labelW-2*padding)
+		drawText(grid, padding, headerH+i*cellH+(cellH-glyphHeight*scale)/2, label, scale, color.Black)
+	}
+	for i, img := range decoded {
+		b := img.Bounds()
+		x := labelW + (i%cols)*cellW + (cellW-b.Dx())/2
+		y := headerH + (i/cols)*cellH + (cellH-b.Dy())/2
+		draw.Draw(grid, image.Rect(x, y, x+b.Dx(), y+b.Dy()), img, b.Min, draw.Src)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, grid); err != nil {
+		return nil, fmt.Errorf("failed to encode grid: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyRecord is a generation as exported from the history: its full
+// parameters and timings plus where the image is served.
+type historyRecord struct {
+	imageMetadata
+	URL string `json:"url"`
+}
+
+// timeRange selects generations created in [From, To); zero bounds are open.
+type timeRange struct {
+	From, To time.Time
+}
+
+func (t timeRange) contains(at time.Time) bool {
+	return (t.From.IsZero() || !at.Before(t.From)) && (t.To.IsZero() || at.Before(t.To))
+}
+
+// parseTimeParam parses an RFC 3339 time, a date or Unix seconds.
+func parseTimeParam(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339, YYYY-MM-DD or Unix seconds", s)
+}
+
+// parseTimeRange reads the from and to query parameters.
+func parseTimeRange(r *http.Request) (timeRange, error) {
+	var tr timeRange
+	var err error
+	if tr.From, err = parseTimeParam(r.URL.Query().Get("from")); err != nil {
+		return tr, err
+	}
+	if tr.To, err = parseTimeParam(r.URL.Query().Get("to")); err != nil {
+		return tr, err
+	}
+	return tr, nil
+}
+
+// maxPostProcessing is how much later than the time in its name an image may
+// have been created, as the images of a job are post-processed in between.
+const maxPostProcessing = time.Hour
+
+// nameTime returns the time in the name of a generation, e.g.
+// bob/output_1700000000000000000_2.json, which is when its job finished
+// generating and at most maxPostProcessing before it was created.
+func nameTime(name string) (time.Time, bool) {
+	_, file, _ := strings.Cut(path.Base(name), "output_")
+	digits := strings.FieldsFunc(file, func(c rune) bool { return c == '_' || c == '.' })
+	if len(digits) == 0 {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(digits[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos).UTC(), true
+}
+
+// mayContain reports whether a generation named at time at can have been
+// created in the range.
+func (t timeRange) mayContain(at time.Time) bool {
+	return (t.From.IsZero() || !at.Before(t.From.Add(-maxPostProcessing))) && (t.To.IsZero() || at.Before(t.To))
+}
+
+// walkHistory calls fn for the metadata of every stored generation of the
+// caller's tenant created in the time range, oldest first, until fn returns
+// false. Generations whose name shows them to be out of range aren't loaded.
+func walkHistory(ctx context.Context, tr timeRange, fn func(imageMetadata) bool) error {
+	names, err := store.List(ctx, tenantName(ctx, "output_"))
+	if err != nil {
+		return err
+	}
+	return walkNames(ctx, names, tr, fn)
+}
+
+// walkRecentHistory is walkHistory over all generations, newest first, for
+// callers that only want the last few.
+func walkRecentHistory(ctx context.Context, fn func(imageMetadata) bool) error {
+	names, err := store.List(ctx, tenantName(ctx, "output_"))
+	if err != nil {
+		return err
+	}
+	slices.Reverse(names)
+	return walkNames(ctx, names, timeRange{}, fn)
+}
+
+func walkNames(ctx context.Context, names []string, tr timeRange, fn func(imageMetadata) bool) error {
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if at, ok := nameTime(name); ok && !tr.mayContain(at) {
+			continue
+		}
+		meta, err := loadMetadata(ctx, strings.TrimSuffix(name, ".json")+".png")
+		if err != nil {
+			log.Printf("Skipping %s in history: %v", name, err)
+			continue
+		}
+		if meta.Name == "" || !tr.contains(meta.CreatedAt) {
+			continue
+		}
+		if !fn(meta) {
+			break
+		}
+	}
+	return ctx.Err()
+}
+
+// handleHistoryExport streams the generation history as JSON lines at
+// GET /v1/history/export, optionally limited by the from and to parameters.
+func handleHistoryExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tr, err := parseTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="history.jsonl"`)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	count := 0
+	err = walkHistory(r.Context(), tr, func(meta imageMetadata) bool {
+		if err := enc.Encode(historyRecord{imageMetadata: meta, URL: generatedURL(meta.Name)}); err != nil {
+			return false
+		}
+		count++
+		if flusher != nil && count%100 == 0 {
+			flusher.Flush()
+		}
+		return true
+	})
+	if err != nil && r.Context().Err() == nil {
+		// Headers are gone already; the truncated export is all we can do.
+		log.Printf("History export failed after %d records: %v", count, err)
+	}
+}
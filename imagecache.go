@@ -0,0 +1,97 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// cachedImage is a downloaded remote image along with the validator used to
+// revalidate it once it is stale.
+type cachedImage struct {
+	url       string
+	data      []byte
+	etag      string
+	fetchedAt time.Time
+}
+
+// imageCache is an LRU cache of downloaded images bounded by their total size.
+// Entries younger than ttl are served without contacting the origin; older
+// ones are revalidated with their ETag if they have one.
+type imageCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	ttl      time.Duration
+	size     int64
+	order    *list.List // of *cachedImage, most recently used first
+	entries  map[string]*list.Element
+}
+
+var remoteImages *imageCache
+
+func newImageCache(maxBytes int64, ttl time.Duration) *imageCache {
+	return &imageCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached image for url, if any, and whether it is still fresh.
+func (c *imageCache) get(url string) (*cachedImage, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[url]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	img := el.Value.(*cachedImage)
+	return img, time.Since(img.fetchedAt) < c.ttl
+}
+
+// refresh marks the image cached for url as fresh after a successful
+// revalidation.
+func (c *imageCache) refresh(url string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[url]; ok {
+		img := *el.Value.(*cachedImage)
+		img.fetchedAt = time.Now()
+		el.Value = &img
+	}
+}
+
+// put caches data downloaded from url, evicting the least recently used
+// images to stay within the size bound. Images larger than the whole cache
+// are not cached.
+func (c *imageCache) put(url string, data []byte, etag string) {
+	if c == nil || int64(len(data)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[url]; ok {
+		c.remove(el)
+	}
+	img := &cachedImage{url: url, data: data, etag: etag, fetchedAt: time.Now()}
+	c.entries[url] = c.order.PushFront(img)
+	c.size += int64(len(data))
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *imageCache) remove(el *list.Element) {
+	img := el.Value.(*cachedImage)
+	c.order.Remove(el)
+	delete(c.entries, img.url)
+	c.size -= int64(len(img.data))
+}
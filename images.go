@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// imagesRequest is the body of the OpenAI images API's POST
+// /v1/images/generations.
+type imagesRequest struct {
+	Model          string `json:"model"`
+	Prompt         string `json:"prompt"`
+	N              int    `json:"n"`
+	Size           string `json:"size"`            // WIDTHxHEIGHT or auto
+	Quality        string `json:"quality"`         // standard or hd, or another tier
+	Style          string `json:"style"`           // vivid or natural, or another style
+	ResponseFormat string `json:"response_format"` // url (default) or b64_json
+	StyleImage     string `json:"style_image"`     // see ChatRequest.StyleImage
+}
+
+type imagesResponse struct {
+	Created int64                 `json:"created"`
+	Data    []imagesResponseDatum `json:"data"`
+}
+
+type imagesResponseDatum struct {
+	URL           string `json:"url,omitempty"`
+	B64JSON       string `json:"b64_json,omitempty"`
+	RevisedPrompt string `json:"revised_prompt,omitempty"`
+}
+
+// handleImageGenerations serves the OpenAI images API, mapping quality and
+// style to the configured tiers and styles of the model profile.
+func handleImageGenerations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	var req imagesRequest
+	if err := validateRequest(body, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	prompt := strings.TrimSpace(req.Prompt)
+	if prompt == "" {
+		http.Error(w, "prompt is required", http.StatusBadRequest)
+		return
+	}
+	if req.ResponseFormat != "" && req.ResponseFormat != "url" && req.ResponseFormat != "b64_json" {
+		http.Error(w, "response_format must be url or b64_json", http.StatusBadRequest)
+		return
+	}
+	fmt.Println("Images API prompt:", prompt)
+
+	chatReq := ChatRequest{Model: req.Model, N: req.N, Size: req.Size, Quality: req.Quality, Style: req.Style, StyleImage: req.StyleImage}
+	if err := loadStyleImage(r.Context(), &chatReq, externalBaseURL(r)); err != nil {
+		writeError(w, err)
+		return
+	}
+	j, _, err := chatJob(r.Context(), chatReq, prompt, nil)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setQueueHeaders(w, j)
+	result, err := runJob(r.Context(), j)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := imagesResponse{Created: time.Now().Unix()}
+	for _, meta := range result.Images {
+		datum := imagesResponseDatum{RevisedPrompt: meta.Prompt}
+		if req.ResponseFormat == "b64_json" {
+			data, err := store.Get(r.Context(), meta.Name)
+			if err != nil {
+				log.Printf("Failed to load %s: %v", meta.Name, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			datum.B64JSON = base64.StdEncoding.EncodeToString(data)
+		} else {
+			datum.URL = externalBaseURL(r) + generatedURL(meta.Name)
+		}
+		resp.Data = append(resp.Data, datum)
+	}
+	writeJSON(w, resp)
+}
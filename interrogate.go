@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const maxInterrogateUpload = 32 << 20
+
+// interrogateRequest is the JSON form of an interrogation request; the image
+// is a data URL or a URL to fetch.
+type interrogateRequest struct {
+	Image string `json:"image"`
+}
+
+type interrogateResponse struct {
+	Prompt string `json:"prompt"`
+}
+
+// handleInterrogate describes an image as a prompt at POST
+// /v1/images/interrogate. The image is uploaded as multipart form field
+// "image", as a raw image body or in JSON.
+func handleInterrogate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if captionBin == "" && captionURL == "" {
+		http.Error(w, "No captioning backend configured", http.StatusNotImplemented)
+		return
+	}
+
+	imgData, err := readInterrogateImage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), captionTimeout)
+	defer cancel()
+	var caption string
+	if captionURL != "" {
+		caption, err = captionViaHTTP(ctx, imgData)
+	} else {
+		caption, err = captionViaBinary(ctx, imgData)
+	}
+	if err != nil {
+		log.Printf("Captioning failed: %v", err)
+		http.Error(w, "Captioning failed", http.StatusBadGateway)
+		return
+	}
+	fmt.Println("Caption:", caption)
+	writeJSON(w, interrogateResponse{Prompt: caption})
+}
+
+func readInterrogateImage(r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(nil, r.Body, maxInterrogateUpload)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "multipart/form-data":
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			return nil, fmt.Errorf("missing image form field: %w", err)
+		}
+		defer file.Close()
+		return io.ReadAll(file)
+	case strings.HasPrefix(mediaType, "image/"):
+		return io.ReadAll(r.Body)
+	default:
+		var req interrogateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, fmt.Errorf("invalid request: %w", err)
+		}
+		if req.Image == "" {
+			return nil, fmt.Errorf("image is required")
+		}
+		if strings.HasPrefix(req.Image, "data:image/") {
+			_, raw, ok := strings.Cut(req.Image, "base64,")
+			if !ok {
+				return nil, fmt.Errorf("image data URL must be base64-encoded")
+			}
+			return base64.StdEncoding.DecodeString(raw)
+		}
+		data, err := fetchImage(r.Context(), req.Image, externalBaseURL(r))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			return nil, fmt.Errorf("invalid image URL")
+		}
+		return data, nil
+	}
+}
+
+// captionViaHTTP posts the image to -caption-url, which answers with
+// {"caption": ...} or plain text.
+func captionViaHTTP(ctx context.Context, imgData []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, captionURL, bytes.NewReader(imgData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create captioning request: %w", err)
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(imgData))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("captioning request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("captioning backend returned status: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Caption string `json:"caption"`
+	}
+	if json.Unmarshal(body, &result) == nil && result.Caption != "" {
+		return strings.TrimSpace(result.Caption), nil
+	}
+	caption := strings.TrimSpace(string(body))
+	if caption == "" || strings.HasPrefix(caption, "{") {
+		return "", fmt.Errorf("captioning backend returned no caption")
+	}
+	return caption, nil
+}
+
+// captionViaBinary runs -caption-bin on the image and takes its standard
+// output as the caption.
+func captionViaBinary(ctx context.Context, imgData []byte) (string, error) {
+	tmpDir, err := os.MkdirTemp(tempDir, "interrogate-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	inputPath := filepath.Join(tmpDir, "input.png")
+	if err := os.WriteFile(inputPath, imgData, 0644); err != nil {
+		return "", fmt.Errorf("failed to write input: %w", err)
+	}
+
+	args := expandArgs(captionArgs, map[string]string{
+		"input": inputPath,
+		"dir":   tmpDir,
+	})
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, captionBin, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("command failed: %w", err)
+	}
+	caption := strings.TrimSpace(stdout.String())
+	if caption == "" {
+		return "", fmt.Errorf("tool printed no caption")
+	}
+	return caption, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipFilter holds the networks a group of endpoints may or may not be reached
+// from. A denied client is always rejected; with an allow list, so is every
+// client outside of it.
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newIPFilter(allow, deny string) (ipFilter, error) {
+	var f ipFilter
+	var err error
+	if f.allow, err = parsePrefixes(allow, "network"); err != nil {
+		return f, err
+	}
+	f.deny, err = parsePrefixes(deny, "network")
+	return f, err
+}
+
+func (f ipFilter) permits(ip string) bool {
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	if prefixesContain(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || prefixesContain(f.allow, addr)
+}
+
+var apiFilter, adminFilter ipFilter
+
+// isAdminPath reports whether path belongs to the admin endpoints: /admin/,
+// /metrics and the worker endpoints below /internal/.
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/admin/") || path == "/metrics" || strings.HasPrefix(path, "/internal/")
+}
+
+// filterIPs rejects requests from clients that -api-allow/-api-deny or, for
+// admin endpoints, -admin-allow/-admin-deny keep out. /health stays open for
+// load balancers.
+func filterIPs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter := apiFilter
+		if isAdminPath(r.URL.Path) {
+			filter = adminFilter
+		}
+		if r.URL.Path != "/health" {
+			if ip := clientIP(r); !filter.permits(ip) {
+				log.Printf("Rejected %s %s from %s: address not allowed", r.Method, r.URL.Path, ip)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
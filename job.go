@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// requestError is an error that should be reported to the client with a
+// specific HTTP status and message.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// writeError reports err to the client, hiding the details of anything that
+// isn't a requestError.
+func writeError(w http.ResponseWriter, err error) {
+	if reqErr, ok := err.(*requestError); ok {
+		http.Error(w, reqErr.message, reqErr.status)
+		return
+	}
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// writeJSON writes v as an indented JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	respBytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Printf("Failed to marshal response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(respBytes)
+}
+
+// finishImage applies the requested and configured post-processing to a
+// generated image, ending with the safety check.
+func finishImage(ctx context.Context, restore bool, imgData []byte, name string) ([]byte, error) {
+	if restore {
+		imgData = restoreFaces(ctx, imgData)
+	}
+	imgData, err := runPostProcess(ctx, config.PostProcess, imgData, name)
+	if err != nil {
+		log.Printf("Post-processing failed: %v", err)
+		return nil, &requestError{http.StatusInternalServerError, "Post-processing failed"}
+	}
+
+	if safetyCheckerURL != "" {
+		flagged, err := checkImageSafety(ctx, imgData)
+		if err != nil {
+			log.Printf("Safety check failed: %v", err)
+			return nil, &requestError{http.StatusServiceUnavailable, "Safety check unavailable"}
+		}
+		if flagged {
+			if safetyAction != safetyActionBlur {
+				log.Println("Generated image rejected by safety checker")
+				return nil, &requestError{http.StatusBadRequest, "Generated image was rejected by the safety checker"}
+			}
+			imgData, err = blurImage(imgData)
+			if err != nil {
+				log.Printf("Failed to blur flagged image: %v", err)
+				return nil, err
+			}
+		}
+	}
+	return imgData, nil
+}
+
+// job is a generation together with the request-level options applied to its
+// results.
+type job struct {
+	id             string // for status queries, random if empty
+	gen            generation
+	promptTemplate string
+	model          string
+	restoreFaces   bool
+	grid           bool
+	labels         []string     // captions of the grid cells, the seeds if empty
+	runs           []generation // run instead of gen when set, e.g. for seed sweeps
+	xy             *xyGrid      // compose the results of runs into this X/Y plot
+	collections    []string     // the images are added to
+	request        interface{}  // as parsed, for -record-dir
+}
+
+// draft returns a quick preview variant of the job: fewer steps, the fast
+// decoder where sd runs with -taesd, no face restoration and no collections.
+func (j job) draft() job {
+	d := j
+	d.id = j.id + "-draft"
+	d.restoreFaces = false
+	d.collections = nil
+	toDraft := func(gen generation) generation {
+		gen.Steps = draftSteps
+		gen.FastDecode = true
+		return gen
+	}
+	d.gen = toDraft(j.gen)
+	d.runs = nil
+	for _, run := range j.runs {
+		d.runs = append(d.runs, toDraft(run))
+	}
+	return d
+}
+
+// size returns the number of generations the job runs.
+func (j job) size() int {
+	return max(1, len(j.runs))
+}
+
+// pool returns the worker pool the job waits in, that of its first run.
+func (j job) pool() string {
+	gen := j.gen
+	if len(j.runs) > 0 {
+		gen = j.runs[0]
+	}
+	return resolveProfile(gen.Profile).poolName()
+}
+
+// jobResult lists the saved images of a job and, if one was requested and
+// there is more than one image, the contact sheet composed from them.
+type jobResult struct {
+	Images   []imageMetadata
+	GridName string
+}
+
+// runJob generates, finishes and saves the images of a job along with their
+// metadata.
+func runJob(ctx context.Context, j job) (result jobResult, err error) {
+	if j.gen.Seed < 0 {
+		j.gen.Seed = randomSeed()
+	}
+	runs := j.runs
+	if len(runs) == 0 {
+		runs = []generation{j.gen}
+	}
+	for _, run := range runs {
+		if err := authorizeModel(ctx, resolveProfile(run.Profile).Name); err != nil {
+			return result, err
+		}
+	}
+	if j.id == "" {
+		j.id = newJobID()
+	}
+	ctx = withJobID(ctx, j.id)
+	entry := line.join(j.id, identityFrom(ctx).User, j.pool(), len(runs))
+	defer line.leave(entry)
+
+	if recordDir != "" && recordingFrom(ctx) == nil {
+		rec := newJobRecording(ctx, j, runs)
+		ctx = withRecording(ctx, rec)
+		defer func() { rec.save(result, err) }()
+	}
+
+	defer func() {
+		if err == nil {
+			collectImages(ctx, result)
+		}
+	}()
+
+	var generated []generatedImage
+	for _, run := range runs {
+		images, err := runGeneration(ctx, run)
+		if err != nil {
+			log.Printf("Generation failed: %v", err)
+			recordFailure(ctx, resolveProfile(run.Profile).Name, run.BatchCount)
+			return result, &requestError{http.StatusInternalServerError, "Failed to run model"}
+		}
+		line.finished(entry, images[0].Meta.Timings.Generation)
+		generated = append(generated, images...)
+	}
+
+	baseName := tenantName(ctx, fmt.Sprintf("output_%d", time.Now().UnixNano()))
+	var finished [][]byte
+	var captions []string
+	for i, img := range generated {
+		name := baseName + ".png"
+		if len(generated) > 1 {
+			name = fmt.Sprintf("%s_%d.png", baseName, i)
+		}
+		postStart := time.Now()
+		imgData, err := finishImage(ctx, j.restoreFaces, img.Data, name)
+		if err != nil {
+			return result, err
+		}
+		if err := store.Put(ctx, name, imgData, "image/png"); err != nil {
+			log.Printf("Failed to save %s: %v", name, err)
+			return result, &requestError{http.StatusInternalServerError, "Failed to save generated image"}
+		}
+
+		meta := img.Meta
+		meta.Name = name
+		meta.CreatedAt = time.Now().UTC()
+		meta.Model = j.model
+		meta.User = identityFrom(ctx).User
+		meta.Tenant = tenantOf(ctx)
+		meta.RestoreFaces = j.restoreFaces
+		meta.Collections = j.collections
+		if j.promptTemplate != meta.Prompt {
+			meta.PromptTemplate = j.promptTemplate
+		}
+		meta.Timings.PostProcess = time.Since(postStart).Seconds()
+		if err := saveMetadata(ctx, meta); err != nil {
+			log.Printf("Failed to save metadata for %s: %v", name, err)
+		}
+
+		result.Images = append(result.Images, meta)
+		finished = append(finished, imgData)
+		caption := fmt.Sprintf("seed %d", meta.Seed)
+		if i < len(j.labels) {
+			caption = j.labels[i]
+		}
+		captions = append(captions, caption)
+	}
+
+	if len(j.collections) > 0 {
+		if err := indexCollections(ctx, result.Images); err != nil {
+			log.Printf("Failed to add %s to collections: %v", baseName, err)
+		}
+	}
+
+	if j.xy != nil || (j.grid && len(finished) > 1) {
+		var gridData []byte
+		var err error
+		if j.xy != nil {
+			colLabels, rowLabels := j.xy.labels()
+			gridData, err = composeLabeledGrid(finished, colLabels, rowLabels)
+		} else {
+			gridData, err = composeGrid(finished, captions, 0)
+		}
+		if err != nil {
+			log.Printf("Failed to compose grid: %v", err)
+			return result, &requestError{http.StatusInternalServerError, "Failed to compose grid"}
+		}
+		gridName := baseName + "_grid.png"
+		if err := store.Put(ctx, gridName, gridData, "image/png"); err != nil {
+			log.Printf("Failed to save %s: %v", gridName, err)
+			return result, &requestError{http.StatusInternalServerError, "Failed to save grid image"}
+		}
+		result.GridName = gridName
+	}
+	return result, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logBacklog is the number of recent lines a new log stream starts with.
+const logBacklog = 200
+
+// logEntry is a line of output as sent by /admin/logs/stream.
+type logEntry struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`        // adapter, or sd for the output of sd runs
+	Job    string    `json:"job,omitempty"` // the job an sd run belongs to
+	Line   string    `json:"line"`
+}
+
+// logHub keeps the most recent lines of output and hands new ones to the
+// streams watching. Streams that fall behind miss lines rather than hold up
+// the adapter.
+type logHub struct {
+	mu       sync.Mutex
+	recent   []logEntry // oldest first
+	watchers map[chan logEntry]bool
+}
+
+var logs = &logHub{watchers: map[chan logEntry]bool{}}
+
+func (h *logHub) publish(e logEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recent = append(h.recent, e)
+	if len(h.recent) > logBacklog {
+		h.recent = h.recent[len(h.recent)-logBacklog:]
+	}
+	for ch := range h.watchers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// watch returns the recent lines and a channel receiving the new ones until
+// stop is called.
+func (h *logHub) watch() (recent []logEntry, ch chan logEntry, stop func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch = make(chan logEntry, 256)
+	h.watchers[ch] = true
+	recent = append([]logEntry(nil), h.recent...)
+	return recent, ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.watchers, ch)
+	}
+}
+
+// logWriter publishes the lines written to it. sd redraws its progress bar
+// with carriage returns, so those end lines too.
+type logWriter struct {
+	source, job string
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := strings.IndexAny(string(w.partial), "\r\n")
+		if i < 0 {
+			break
+		}
+		if line := strings.TrimSpace(string(w.partial[:i])); line != "" {
+			logs.publish(logEntry{Time: time.Now().UTC(), Source: w.source, Job: w.job, Line: line})
+		}
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// consoleOut is the adapter's real standard output once captureOutput has
+// redirected os.Stdout.
+var consoleOut io.Writer = os.Stdout
+
+// captureOutput tees the adapter's log and its standard output, which most of
+// its messages are printed to, into the log hub.
+func captureOutput() {
+	log.SetOutput(io.MultiWriter(os.Stderr, &logWriter{source: "adapter"}))
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Printf("Failed to capture standard output, /admin/logs/stream only streams the log: %v", err)
+		return
+	}
+	consoleOut = os.Stdout
+	os.Stdout = w
+	go func() {
+		// Copy on regardless of write errors, or printing would block.
+		tap := &logWriter{source: "adapter"}
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			consoleOut.Write(buf[:n])
+			tap.Write(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// sdOutput returns writers echoing sd's standard output and error to the
+// adapter's and publishing them as lines of the job of ctx.
+func sdOutput(ctx context.Context) (stdout, stderr io.Writer) {
+	job := jobIDFrom(ctx)
+	return io.MultiWriter(consoleOut, &logWriter{source: "sd", job: job}),
+		io.MultiWriter(os.Stderr, &logWriter{source: "sd", job: job})
+}
+
+type jobIDKey struct{}
+
+// withJobID records the job a generation runs for, to tag sd's output with.
+func withJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDKey{}, id)
+}
+
+func jobIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(jobIDKey{}).(string)
+	return id
+}
+
+// logPingInterval is how often an idle log stream sends a comment to keep
+// proxies from closing it.
+const logPingInterval = 15 * time.Second
+
+// handleLogStream streams the adapter's output as server-sent events at
+// GET /admin/logs/stream, starting with the most recent lines. Every event is
+// a logEntry; the source and job query parameters filter them, e.g.
+// ?source=sd&job=ID to follow a single generation.
+func handleLogStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported by the connection", http.StatusInternalServerError)
+		return
+	}
+	source, job := r.URL.Query().Get("source"), r.URL.Query().Get("job")
+	matches := func(e logEntry) bool {
+		return (source == "" || e.Source == source) && (job == "" || e.Job == job)
+	}
+
+	recent, ch, stop := logs.watch()
+	defer stop()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	send := func(e logEntry) {
+		data, _ := json.Marshal(e)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	for _, e := range recent {
+		if matches(e) {
+			send(e)
+		}
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(logPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case e := <-ch:
+			if matches(e) {
+				send(e)
+				flusher.Flush()
+			}
+		case <-ping.C:
+			io.WriteString(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -1,21 +1,18 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"regexp"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -65,18 +62,172 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 type ChatRequest struct {
 	Model    string    `json:"model"`
 	Messages []Message `json:"messages"`
+
+	// Edit-mode knobs; when unset the -edit-* flag defaults apply.
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	Seed           *int64 `json:"seed,omitempty"` // random if unset or negative
+
+	ImageGuidance *float64 `json:"image_guidance,omitempty"`
+	Guidance      *float64 `json:"guidance,omitempty"`
+
+	RestoreFaces bool `json:"restore_faces,omitempty"`
+
+	// N is the number of images to generate with consecutive seeds; Grid
+	// additionally composes them into a single captioned contact sheet.
+	N    int  `json:"n,omitempty"`
+	Grid bool `json:"grid,omitempty"`
+
+	// Seeds runs a seed sweep: the same prompt once per seed, as one job.
+	Seeds seedList `json:"seeds,omitempty"`
+	// XYGrid runs the cartesian product of two parameter axes and returns
+	// a labeled grid of the results.
+	XYGrid *xyGrid `json:"xy_grid,omitempty"`
+
+	// Quality picks a tier (draft, standard, hd or configured ones) trading
+	// quality for latency; Style a look (vivid, natural or configured ones).
+	Quality string `json:"quality,omitempty"`
+	Style   string `json:"style,omitempty"`
+
+	// Size is the output size like "1024x768" for text-to-image; with
+	// images, the output takes the size of the most recent one.
+	Size string `json:"size,omitempty"`
+
+	// Stream sends the response as server-sent events. With Draft, a quick
+	// low-step preview is streamed before the full-quality render.
+	Stream bool `json:"stream,omitempty"`
+	Draft  bool `json:"draft,omitempty"`
+
+	// ReuseParameters takes the prompt, seed, negative prompt, steps, CFG
+	// scale and sampler embedded in the most recent image as defaults, to
+	// continue working on an image made with sd or A1111.
+	ReuseParameters bool `json:"reuse_parameters,omitempty"`
+
+	// Collection adds the generated images to a collection.
+	Collection string `json:"collection,omitempty"`
+
+	// StyleImage is a picture whose style the image is drawn in, given like
+	// an image_url. It needs a profile with style_reference.
+	StyleImage string `json:"style_image,omitempty"`
+
+	embedded   *embeddedParameters
+	styleImage []byte // StyleImage as loaded
 }
 
 var (
-	sdBinPath      string
-	diffusionModel string
-	vaePath        string
-	clipLPath      string
-	t5xxlPath      string
-	port           string
-	mu             sync.Mutex
-	outputDir      string
-	imageURLPrefix string
+	sdBinPath       string
+	diffusionModel  string
+	vaePath         string
+	clipLPath       string
+	t5xxlPath       string
+	offloadToCPU    bool
+	clipOnCPU       bool
+	vaeOnCPU        bool
+	vaeTiling       bool
+	weightType      string
+	styleReference  bool
+	port            string
+	outputDir       string
+	imageURLPrefix  string
+	initFit         string
+	resolutionList  string
+	resolutions     []resolution
+	inpaintStrength string
+	maxRefImages    int
+	editImgCfgScale string
+	editGuidance    string
+
+	faceRestoreBin     string
+	faceRestoreArgs    string
+	faceRestoreTimeout time.Duration
+
+	convertBin     string
+	convertArgs    string
+	convertTimeout time.Duration
+
+	configPath     string
+	checkConfig    bool
+	strictRequests bool
+	recordDir      string
+
+	defaultSteps    int
+	defaultCfgScale float64
+	defaultSampler  string
+	defaultSizeStr  string
+	sizePolicy      string
+	defaultSize     resolution
+
+	captionBin     string
+	captionArgs    string
+	captionURL     string
+	captionTimeout time.Duration
+
+	safetyCheckerURL string
+	safetyThreshold  float64
+	safetyAction     string
+
+	maxBatch          int
+	variationStrength float64
+	maxGridCells      int
+
+	modelName             string
+	backendList           string
+	backendHealthInterval time.Duration
+
+	role             string
+	coordinatorURL   string
+	workerToken      string
+	workerJobTimeout time.Duration
+	workerName       string
+	workerPools      string
+
+	gpuTool           string
+	gpuSampleInterval time.Duration
+
+	redisAddr     string
+	redisPassword string
+	redisPrefix   string
+
+	trustedProxyList  string
+	apiAllowList      string
+	apiDenyList       string
+	adminAllowList    string
+	adminDenyList     string
+	imageCacheMB      int
+	imageCacheTTL     time.Duration
+	fetchRetries      int
+	draftSteps        int
+	heartbeatInterval time.Duration
+	taesdPath         string
+	fetchTimeout      time.Duration
+	fetchBackoff      time.Duration
+	fetchInsecure     bool
+	basePath          string
+
+	tlsCert     string
+	tlsKey      string
+	tlsClientCA string
+
+	sdCPUTime         time.Duration
+	sdAddressSpaceMB  int
+	sdOpenFiles       int
+	sdEnvList         string
+	sdSandbox         bool
+	sdSandboxRead     string
+	sdSandboxWrite    string
+	sdUser            string
+	sdGroup           string
+	sdCgroupDir       string
+	sdMemoryMB        int
+	tempDir           string
+	sdServerURL       string
+	tenantIsolation   bool
+	generationBackend string
+	mockDelay         time.Duration
+
+	promptWeighting       string
+	promptEscapeUnmatched bool
+	promptChunkTokens     int
+	wildcardsDir          string
 )
 
 func init() {
@@ -85,15 +236,111 @@ func init() {
 	flag.StringVar(&vaePath, "vae", "", "Path to VAE file")
 	flag.StringVar(&clipLPath, "clip_l", "", "Path to CLIP_L file")
 	flag.StringVar(&t5xxlPath, "t5xxl", "", "Path to T5XXL file")
+	flag.BoolVar(&offloadToCPU, "offload-to-cpu", false, "Keep model weights in RAM and load them to VRAM on demand (sd --offload-to-cpu)")
+	flag.BoolVar(&clipOnCPU, "clip-on-cpu", false, "Run the text encoders on the CPU (sd --clip-on-cpu)")
+	flag.BoolVar(&vaeOnCPU, "vae-on-cpu", false, "Run the VAE on the CPU (sd --vae-on-cpu)")
+	flag.BoolVar(&vaeTiling, "vae-tiling", false, "Decode in tiles to reduce VRAM use (sd --vae-tiling)")
+	flag.BoolVar(&styleReference, "style-reference", false, "The model takes reference images (sd -r), e.g. FLUX.1 Kontext; enables style_image in requests")
+	flag.StringVar(&weightType, "type", "", "Weight type the model is quantized to on load, e.g. q8_0, q4_K or f16 (sd --type; file types if empty)")
+	flag.DurationVar(&sdCPUTime, "sd-cpu-time", 0, "CPU time limit of an sd run (RLIMIT_CPU); 0 disables")
+	flag.IntVar(&sdAddressSpaceMB, "sd-address-space-mb", 0, "Address space limit of an sd run in MiB (RLIMIT_AS, too tight for CUDA/ROCm); 0 disables")
+	flag.IntVar(&sdOpenFiles, "sd-open-files", 0, "Open file limit of an sd run (RLIMIT_NOFILE); 0 disables")
+	flag.StringVar(&sdEnvList, "sd-env", "PATH,HOME,LANG,TMPDIR,LD_LIBRARY_PATH,CUDA_VISIBLE_DEVICES,HIP_VISIBLE_DEVICES,ROCR_VISIBLE_DEVICES,GGML_VK_VISIBLE_DEVICES,OMP_NUM_THREADS", "Comma-separated environment variables passed to sd; * passes the whole environment")
+	flag.BoolVar(&sdSandbox, "sd-sandbox", false, "Confine sd with Landlock to the model files, -sd-sandbox-read and -sd-sandbox-write and deny administrative syscalls with seccomp (Linux)")
+	flag.StringVar(&sdSandboxRead, "sd-sandbox-read", "/usr,/lib,/lib64,/etc,/opt,/proc,/sys", "Comma-separated paths sd may read and execute below in the sandbox")
+	flag.StringVar(&sdSandboxWrite, "sd-sandbox-write", "/dev", "Comma-separated paths sd may write below in the sandbox, besides the directory of the run (see -temp-dir)")
+	flag.StringVar(&sdUser, "sd-user", "", "User name or UID sd runs as, with that user's groups; the working directory must be writable by it unless -temp-dir is set (requires root)")
+	flag.StringVar(&sdGroup, "sd-group", "", "Group name or GID sd runs as (the primary group of -sd-user if empty)")
+	flag.StringVar(&sdCgroupDir, "sd-cgroup", "", "cgroup v2 directory delegated to the adapter; every sd run is placed in a child cgroup of it")
+	flag.IntVar(&sdMemoryMB, "sd-memory-mb", 0, "Memory ceiling of an sd run in MiB, enforced by the cgroup (requires -sd-cgroup); 0 disables")
+	flag.StringVar(&tempDir, "temp-dir", "", "Directory the images of sd and of the post-processing, captioning and conversion tools are kept in during a run, ideally a tmpfs such as /dev/shm (the system temp directory if empty)")
+	flag.StringVar(&sdServerURL, "sd-server-url", "", "URL of a stable-diffusion.cpp server (sdapi) generations are forwarded to instead of running -sd-bin; model flags are then optional")
+	flag.StringVar(&generationBackend, "backend", backendSD, "What generates the images: sd, or mock for placeholder images showing the prompt, for developing clients without a GPU (no model flags needed)")
+	flag.DurationVar(&mockDelay, "mock-delay", 2*time.Second, "How long a generation takes with -backend mock")
+	flag.BoolVar(&tenantIsolation, "tenant-isolation", false, "Store every user's images in a directory of their own that only they can list, fetch and delete; /generated/ then requires authentication")
 	flag.StringVar(&port, "port", "8080", "Port to run the web server on")
 	flag.StringVar(&outputDir, "output-dir", "", "Directory to save generated images")
-	flag.StringVar(&imageURLPrefix, "image-url-prefix", "", "Image URL prefix")
+	flag.StringVar(&imageURLPrefix, "image-url-prefix", "", "Image URL prefix (defaults to the URL the request was sent to)")
+	flag.StringVar(&initFit, "init-fit", "crop", "How init images are fitted to a valid resolution: crop, pad or stretch")
+	flag.StringVar(&inpaintStrength, "inpaint-strength", "1.0", "Denoising strength used when inpainting transparent regions of an init image")
+	flag.IntVar(&maxRefImages, "max-ref-images", 4, "Maximum number of reference images passed to sd in edit mode")
+	flag.StringVar(&editImgCfgScale, "edit-img-cfg-scale", "", "Default image guidance scale in edit mode (sd default if empty)")
+	flag.StringVar(&editGuidance, "edit-guidance", "", "Default distilled guidance in edit mode, e.g. for Kontext (sd default if empty)")
+	flag.StringVar(&faceRestoreBin, "face-restore-bin", "", "Path to a face-restoration tool (GFPGAN/CodeFormer) run when restore_faces is requested")
+	flag.StringVar(&faceRestoreArgs, "face-restore-args", "-i {input} -o {output}", "Arguments for the face-restoration tool; {input}, {output} and {dir} are substituted")
+	flag.DurationVar(&faceRestoreTimeout, "face-restore-timeout", 2*time.Minute, "Timeout for the face-restoration tool")
+	flag.StringVar(&convertBin, "convert-bin", "", "Path to an image converter (ImageMagick, heif-convert, ffmpeg) that turns HEIC and AVIF input images into PNG")
+	flag.StringVar(&convertArgs, "convert-args", "{input} {output}", "Arguments for the image converter; {input}, {output} and {dir} are substituted")
+	flag.DurationVar(&convertTimeout, "convert-timeout", time.Minute, "Timeout for converting an image")
+	flag.StringVar(&resolutionList, "resolutions", "1024x1024,1152x896,896x1152,1216x832,832x1216,1344x768,768x1344", "Comma-separated list of valid WIDTHxHEIGHT resolutions for init images")
+	flag.IntVar(&imageCacheMB, "image-cache-mb", 256, "Size of the cache of downloaded remote images in MiB; 0 disables it")
+	flag.DurationVar(&imageCacheTTL, "image-cache-ttl", 10*time.Minute, "How long a downloaded image is used before it is revalidated")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", 10*time.Second, "How often streaming responses send a keep-alive comment with the queue position while waiting; 0 disables")
+	flag.IntVar(&draftSteps, "draft-steps", 8, "Sampling steps of the quick preview streamed for draft requests")
+	flag.StringVar(&taesdPath, "taesd", "", "Path to a TAESD decoder used for draft previews (full VAE if empty)")
+	flag.IntVar(&fetchRetries, "fetch-retries", 2, "How often a failed remote image download is retried")
+	flag.DurationVar(&fetchTimeout, "fetch-timeout", 30*time.Second, "Timeout of a single remote image download attempt")
+	flag.DurationVar(&fetchBackoff, "fetch-backoff", 500*time.Millisecond, "Delay before the first retry of a remote image download, doubled for every further retry")
+	flag.BoolVar(&fetchInsecure, "fetch-insecure", false, "Don't verify the TLS certificates of remote image URLs")
+	flag.StringVar(&basePath, "base-path", "", "Path prefix the whole API is mounted under, e.g. /image-api")
+	flag.StringVar(&trustedProxyList, "trusted-proxies", "", "Comma-separated IPs/CIDRs of reverse proxies whose X-Forwarded-For/Proto/Host headers are honored")
+	flag.StringVar(&apiAllowList, "api-allow", "", "Comma-separated IPs/CIDRs the API may be used from (anywhere if empty)")
+	flag.StringVar(&apiDenyList, "api-deny", "", "Comma-separated IPs/CIDRs the API may not be used from, even if allowed")
+	flag.StringVar(&adminAllowList, "admin-allow", "", "Comma-separated IPs/CIDRs /admin/, /metrics and /internal/ may be used from (anywhere if empty)")
+	flag.StringVar(&adminDenyList, "admin-deny", "", "Comma-separated IPs/CIDRs /admin/, /metrics and /internal/ may not be used from, even if allowed")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file; serves HTTPS when set together with -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA bundle that client certificates must be signed by (mutual TLS, requires -tls-cert)")
+	flag.StringVar(&captionBin, "caption-bin", "", "Path to a captioning tool (BLIP/Florence/llava CLI) used by /v1/images/interrogate; prints the caption to stdout")
+	flag.StringVar(&captionArgs, "caption-args", "{input}", "Arguments for the captioning tool; {input} and {dir} are substituted")
+	flag.StringVar(&captionURL, "caption-url", "", "URL of a captioning model that accepts an image via POST, used instead of -caption-bin")
+	flag.DurationVar(&captionTimeout, "caption-timeout", 2*time.Minute, "Timeout for captioning an image")
+	flag.IntVar(&defaultSteps, "default-steps", 30, "Sampling steps used when a request doesn't set them")
+	flag.Float64Var(&defaultCfgScale, "default-cfg-scale", 1.0, "CFG scale used when a request doesn't set it")
+	flag.StringVar(&defaultSampler, "default-sampler", "euler", "Sampling method used when a request doesn't set it")
+	flag.StringVar(&sizePolicy, "size-policy", "snap", "What to do with a requested size the model doesn't support: snap (to the nearest supported size) or reject")
+	flag.StringVar(&defaultSizeStr, "default-size", "1024x1024", "Output WIDTHxHEIGHT of text-to-image requests without a resolution keyword")
+	flag.StringVar(&configPath, "config", "", "Path to an optional JSON config file")
+	flag.BoolVar(&strictRequests, "strict-requests", false, "Reject requests with fields the adapter doesn't know instead of logging and ignoring them")
+	flag.StringVar(&recordDir, "record-dir", "", "Directory every job's request, resolved parameters and sd command lines are recorded to, for the replay command")
+	flag.BoolVar(&checkConfig, "check-config", false, "Check the config, model files, sd binary, storage and auth, print a report and exit (1 if a check failed)")
+	flag.StringVar(&modelName, "model-name", "", "Model name reported by /v1/models (defaults to the diffusion model file name)")
+	flag.StringVar(&backendList, "backends", "", "Comma-separated URLs of adapter instances to dispatch jobs to (proxy mode)")
+	flag.StringVar(&role, "role", roleStandalone, "Run as a coordinator (queue and storage, no sd) or a worker (pulls jobs from -coordinator-url); standalone if empty")
+	flag.StringVar(&coordinatorURL, "coordinator-url", "", "URL of the coordinator a worker pulls jobs from")
+	flag.StringVar(&workerToken, "worker-token", "", "Shared secret between coordinator and workers, required in both modes")
+	flag.StringVar(&workerPools, "worker-pools", "", "Comma-separated worker pools a worker takes jobs of, each with the concurrency of its config; any pool, one job at a time, if empty")
+	flag.StringVar(&workerName, "worker-name", "", "Name of this instance in metrics (defaults to the host name)")
+	flag.StringVar(&gpuTool, "gpu-smi", "auto", "Tool sampled for GPU metrics: nvidia-smi, rocm-smi, a path to either, auto or none")
+	flag.DurationVar(&gpuSampleInterval, "gpu-sample-interval", 15*time.Second, "How often GPU metrics are sampled")
+	flag.DurationVar(&workerJobTimeout, "worker-job-timeout", 30*time.Minute, "How long the coordinator waits for a worker to finish a job")
+	flag.StringVar(&redisAddr, "redis-addr", "", "host:port of a Redis server holding the coordinator job queue (in-memory if empty)")
+	flag.StringVar(&redisPassword, "redis-password", "", "Redis password")
+	flag.StringVar(&redisPrefix, "redis-prefix", "sd-adapter", "Prefix of the Redis keys used by the job queue")
+	flag.DurationVar(&backendHealthInterval, "backend-health-interval", 10*time.Second, "How often backends are health-checked in proxy mode")
+	flag.StringVar(&safetyCheckerURL, "safety-checker-url", "", "URL of an NSFW classifier that accepts a PNG via POST (disabled if empty)")
+	flag.Float64Var(&safetyThreshold, "safety-threshold", 0.5, "Classifier score at or above which an image is considered NSFW")
+	flag.StringVar(&safetyAction, "safety-action", safetyActionReject, "What to do with flagged images: reject or blur")
+	flag.IntVar(&maxBatch, "max-batch", 8, "Maximum number of images a single request may generate")
+	flag.StringVar(&promptWeighting, "prompt-weighting", promptWeightingNormalize, "Handling of (word:1.3)/[word] attention syntax: normalize, strip or off")
+	flag.BoolVar(&promptEscapeUnmatched, "prompt-escape-unmatched", false, "Keep brackets without a partner, like in emoticons, as literal text instead of rejecting the prompt")
+	flag.IntVar(&promptChunkTokens, "prompt-chunk-tokens", 0, "Insert BREAKs so that no prompt chunk exceeds this many (estimated) tokens, e.g. 75 for CLIP-only models; 0 disables")
+	flag.StringVar(&wildcardsDir, "wildcards-dir", "", "Directory of NAME.txt files used by __NAME__ prompt wildcards")
+	flag.IntVar(&maxGridCells, "max-grid-cells", 25, "Maximum number of cells in an X/Y parameter grid")
+	flag.Float64Var(&variationStrength, "variation-strength", 0.6, "Default img2img strength for variations of a previous output")
 }
 
-func extractPromptAndImage(messages []Message) (string, []byte, error) {
+// extractPromptAndImages returns the last user prompt and up to maxRefImages of the
+// most recent images found in the conversation, oldest first. Relative image
+// paths are resolved against baseURL unless -image-url-prefix is set.
+func extractPromptAndImages(ctx context.Context, messages []Message, baseURL string) (string, [][]byte, error) {
 	var lastText string
-	var lastImageData []byte
-	var lastImageURL string
+	// Each entry is either decoded image data or a URL still to be fetched.
+	type imageRef struct {
+		data []byte
+		url  string
+	}
+	var refs []imageRef
 	imagePattern := regexp.MustCompile(`(?:https?:\/\/\S+|\b\/[^ \n\t\r]+)\.png\b`)
 
 	for _, msg := range messages {
@@ -104,10 +351,9 @@ func extractPromptAndImage(messages []Message) (string, []byte, error) {
 					lastText = part.Text
 				}
 
-				// Search for .png URL in text
-				matches := imagePattern.FindAllString(part.Text, -1)
-				if len(matches) > 0 {
-					lastImageURL = matches[len(matches)-1]
+				// Search for .png URLs in text
+				for _, match := range imagePattern.FindAllString(part.Text, -1) {
+					refs = append(refs, imageRef{url: match})
 				}
 
 			case "image_url":
@@ -125,54 +371,44 @@ func extractPromptAndImage(messages []Message) (string, []byte, error) {
 							log.Printf("Invalid base64 image skipped: %v", err)
 							continue
 						}
-						lastImageData = data
+						refs = append(refs, imageRef{data: data})
+					} else if isUploadID(urlStr) {
+						data, err := loadUpload(ctx, urlStr)
+						if err != nil {
+							return strings.TrimSpace(lastText), nil, err
+						}
+						refs = append(refs, imageRef{data: data})
 					} else if strings.HasSuffix(urlStr, ".png") {
-						lastImageURL = urlStr
+						refs = append(refs, imageRef{url: urlStr})
 					}
 				}
 			}
 		}
 	}
 
-	// If no image data was found, but a URL/relative path was:
-	if len(lastImageData) == 0 && lastImageURL != "" {
-		finalURL := lastImageURL
-		if strings.HasPrefix(finalURL, "/") {
-			finalURL = imageURLPrefix + finalURL
-		}
-		// Validate URL
-		if u, err := url.Parse(finalURL); err == nil && u.Scheme != "" {
-			// Custom client that skips cert verification
-			tr := &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}
-			client := &http.Client{Transport: tr}
-
-			resp, err := client.Get(finalURL)
-			if err != nil {
-				return strings.TrimSpace(lastText), nil, fmt.Errorf("failed to fetch image from URL: %w", err)
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusOK {
-				return strings.TrimSpace(lastText), nil, fmt.Errorf("image URL returned status: %s", resp.Status)
-			}
+	if len(refs) > maxRefImages {
+		refs = refs[len(refs)-maxRefImages:]
+	}
 
-			imgData, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return strings.TrimSpace(lastText), nil, fmt.Errorf("failed to read image data from response: %w", err)
-			}
-			lastImageData = imgData
+	var images [][]byte
+	for _, ref := range refs {
+		if len(ref.data) > 0 {
+			images = append(images, ref.data)
+			continue
+		}
+		data, err := fetchImage(ctx, ref.url, baseURL)
+		if err != nil {
+			return strings.TrimSpace(lastText), nil, err
+		}
+		if len(data) > 0 {
+			images = append(images, data)
 		}
 	}
 
-	return strings.TrimSpace(lastText), lastImageData, nil
+	return strings.TrimSpace(lastText), images, nil
 }
 
 func handleChatCompletion(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	defer mu.Unlock()
-
 	ctx := r.Context()
 
 	bodyBytes, err := io.ReadAll(r.Body)
@@ -186,13 +422,17 @@ func handleChatCompletion(w http.ResponseWriter, r *http.Request) {
 	fmt.Println(string(bodyBytes))
 
 	var req ChatRequest
+	if err := validateRequest(bodyBytes, &req); err != nil {
+		writeError(w, err)
+		return
+	}
 	if err := json.Unmarshal(bodyBytes, &req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		log.Printf("Request decode error: %v\n", err)
 		return
 	}
 
-	prompt, imageData, err := extractPromptAndImage(req.Messages)
+	prompt, images, err := extractPromptAndImages(ctx, req.Messages, externalBaseURL(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		log.Printf("Prompt/Image extraction error: %v\n", err)
@@ -200,72 +440,78 @@ func handleChatCompletion(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fmt.Println("Prompt:", prompt)
-	if len(imageData) > 0 {
-		fmt.Printf("Image Data: %d bytes\n", len(imageData))
+	if len(images) > 0 {
+		for i, data := range images {
+			fmt.Printf("Image Data #%d: %d bytes\n", i, len(data))
+		}
 	} else {
 		fmt.Println("Image Data: <none>")
 	}
 
+	if req.ReuseParameters {
+		prompt = reuseParameters(&req, prompt, images)
+	}
+	if err := loadStyleImage(ctx, &req, externalBaseURL(r)); err != nil {
+		writeError(w, err)
+		return
+	}
 	if prompt == "" {
 		http.Error(w, "No user prompt provided", http.StatusBadRequest)
 		log.Println("No user prompt provided")
 		return
 	}
 
-	args := []string{
-		"--diffusion-model", diffusionModel,
-		"--vae", vaePath,
-		"--clip_l", clipLPath,
-		"--t5xxl", t5xxlPath,
-		"-p", prompt,
-		"--cfg-scale", "1.0",
-		"--sampling-method", "euler",
-		"--seed", "-1",
-		"--diffusion-fa",
-		"--height", "1024",
-		"--width", "1024",
-		"--steps", "30",
-		"-v",
-	}
-
-	if len(imageData) > 0 {
-		if err := os.WriteFile("input.png", imageData, 0644); err != nil {
-			http.Error(w, "Failed to write input image", http.StatusInternalServerError)
-			return
-		}
-		defer os.Remove("input.png")
-		args = append(args, "-M", "edit", "-r", "input.png")
+	j, chunks, err := chatJob(ctx, req, prompt, images)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
+	setQueueHeaders(w, j)
 
-	cmd := exec.CommandContext(ctx, sdBinPath, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		log.Printf("Command failed: %v", err)
-		http.Error(w, "Failed to run model", http.StatusInternalServerError)
-		return
+	var stream *chatStream
+	if req.Stream {
+		if stream, err = newChatStream(w, req.Model); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stream.watch(j.id)
+		if heartbeatInterval > 0 {
+			hbCtx, stopHeartbeat := context.WithCancel(ctx)
+			defer stopHeartbeat()
+			go stream.heartbeat(hbCtx, heartbeatInterval)
+		}
 	}
 
-	outputPath := filepath.Join(outputDir, fmt.Sprintf("output_%d.png", time.Now().UnixNano()))
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		http.Error(w, "Failed to create output directory", http.StatusInternalServerError)
-		return
+	if req.Draft && stream != nil {
+		d := j.draft()
+		stream.watch(d.id)
+		draft, err := runJob(ctx, d)
+		if err != nil {
+			stream.fail(err)
+			return
+		}
+		draftMarkdown, _ := jobMarkdown(draft, "draft")
+		stream.content(draftMarkdown + "\n\n")
+		stream.watch(j.id)
 	}
 
-	imgData, err := os.ReadFile("output.png")
+	result, err := runJob(ctx, j)
 	if err != nil {
-		http.Error(w, "Failed to read output.png", http.StatusInternalServerError)
+		if stream != nil {
+			stream.fail(err)
+			return
+		}
+		writeError(w, err)
 		return
 	}
-	if err := os.WriteFile(outputPath, imgData, 0644); err != nil {
-		http.Error(w, "Failed to save generated image", http.StatusInternalServerError)
+
+	imgMarkdown, seeds := jobMarkdown(result, "output")
+	if stream != nil {
+		stream.content(imgMarkdown)
+		stream.finish()
 		return
 	}
 
-	imageURL := filepath.Base(outputPath) // e.g., output_123456.png
-	imgMarkdown := fmt.Sprintf("![output](/generated/%s)", imageURL)
-
 	response := map[string]interface{}{
 		"id":      "chatcmpl-mockid",
 		"object":  "chat.completion",
@@ -283,6 +529,13 @@ func handleChatCompletion(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
+	if len(chunks) > 1 {
+		response["prompt_chunks"] = chunks
+	}
+	if len(seeds) > 1 {
+		response["seeds"] = seeds
+	}
+
 	respBytes, err := json.MarshalIndent(response, "", "  ")
 	if err != nil {
 		log.Printf("Failed to marshal response: %v", err)
@@ -297,20 +550,556 @@ func handleChatCompletion(w http.ResponseWriter, r *http.Request) {
 	w.Write(respBytes)
 }
 
+// chatJob builds the job for a chat request with the given prompt and
+// images: dynamic prompts and attention weights are expanded, images fitted,
+// the model routed and batches, seed lists and grids set up. It also returns
+// the prompt chunks.
+func chatJob(ctx context.Context, req ChatRequest, prompt string, images [][]byte) (job, []string, error) {
+	var err error
+	seed := randomSeed()
+	if req.Seed != nil && *req.Seed >= 0 {
+		seed = *req.Seed
+	}
+
+	// Dynamic prompts are expanded from the generation seed, so that the
+	// stored seed also reproduces the chosen alternatives.
+	template := prompt
+	rng := rand.New(rand.NewSource(seed))
+	if prompt, err = expandDynamicPrompt(prompt, rng); err != nil {
+		return job{}, nil, &requestError{http.StatusBadRequest, fmt.Sprintf("Invalid dynamic prompt: %v", err)}
+	}
+	if req.NegativePrompt, err = expandDynamicPrompt(req.NegativePrompt, rng); err != nil {
+		return job{}, nil, &requestError{http.StatusBadRequest, fmt.Sprintf("Invalid dynamic negative prompt: %v", err)}
+	}
+	if prompt != template {
+		fmt.Println("Expanded prompt:", prompt)
+	}
+
+	if promptWeighting != promptWeightingOff {
+		strip := promptWeighting == promptWeightingStrip
+		raw := prompt
+		if prompt, err = normalizePromptWeights(prompt, strip, promptEscapeUnmatched); err != nil {
+			return job{}, nil, &requestError{http.StatusBadRequest, fmt.Sprintf("Invalid prompt weighting: %v", err)}
+		}
+		if req.NegativePrompt, err = normalizePromptWeights(req.NegativePrompt, strip, promptEscapeUnmatched); err != nil {
+			return job{}, nil, &requestError{http.StatusBadRequest, fmt.Sprintf("Invalid negative prompt weighting: %v", err)}
+		}
+		if prompt != raw {
+			fmt.Println("Normalized prompt:", prompt)
+		}
+	}
+
+	prompt, chunks := chunkPrompt(prompt, promptChunkTokens)
+	if len(chunks) > 1 {
+		fmt.Printf("Prompt split into %d chunks\n", len(chunks))
+	}
+
+	if (req.ImageGuidance != nil && *req.ImageGuidance <= 0) || (req.Guidance != nil && *req.Guidance <= 0) {
+		return job{}, nil, &requestError{http.StatusBadRequest, "image_guidance and guidance must be positive"}
+	}
+
+	n := max(1, req.N)
+	if n > maxBatch {
+		return job{}, nil, &requestError{http.StatusBadRequest, fmt.Sprintf("n must not exceed %d", maxBatch)}
+	}
+	if req.XYGrid != nil {
+		if req.N > 1 || len(req.Seeds) > 0 {
+			return job{}, nil, &requestError{http.StatusBadRequest, "xy_grid cannot be combined with n or seeds"}
+		}
+		if err := req.XYGrid.validate(); err != nil {
+			return job{}, nil, &requestError{http.StatusBadRequest, err.Error()}
+		}
+	}
+	if len(req.Seeds) > 0 {
+		if req.N > 1 {
+			return job{}, nil, &requestError{http.StatusBadRequest, "n and seeds cannot be combined"}
+		}
+		if len(req.Seeds) > maxBatch {
+			return job{}, nil, &requestError{http.StatusBadRequest, fmt.Sprintf("seeds must not list more than %d seeds", maxBatch)}
+		}
+		for _, s := range req.Seeds {
+			if s < 0 {
+				return job{}, nil, &requestError{http.StatusBadRequest, "seeds must not be negative"}
+			}
+		}
+	}
+
+	if req.Collection != "" && !validCollectionName(req.Collection) {
+		return job{}, nil, &requestError{http.StatusBadRequest, "collection names are up to 64 letters, digits, spaces, dots, dashes and underscores"}
+	}
+	if req.Draft && req.XYGrid != nil {
+		return job{}, nil, &requestError{http.StatusBadRequest, "draft cannot be combined with xy_grid"}
+	}
+
+	// The output takes the size of the most recent image, which is also the
+	// one used for inpainting. Without images, a resolution keyword in the
+	// prompt like "banner" or "avatar" picks the size.
+	size := defaultSize
+	explicitSize := req.Size != "" && req.Size != "auto" && len(images) == 0
+	if explicitSize {
+		if size, err = parseResolution(req.Size); err != nil {
+			return job{}, nil, &requestError{http.StatusBadRequest, err.Error()}
+		}
+	} else if res, word, ok := keywordResolution(prompt); ok && len(images) == 0 {
+		size = res
+		fmt.Printf("Resolution keyword %q: %s\n", word, size)
+	}
+	gen := generation{
+		Profile:        allowedModel(ctx, req.Model, routeModel(ctx, req.Model, prompt)),
+		Prompt:         prompt,
+		NegativePrompt: req.NegativePrompt,
+		Images:         images,
+		Size:           size,
+		Seed:           seed,
+		BatchCount:     n,
+		ImageGuidance:  req.ImageGuidance,
+		Guidance:       req.Guidance,
+	}
+	if req.embedded != nil {
+		gen = req.embedded.apply(gen)
+	}
+	profile := resolveProfile(gen.Profile)
+	if err := authorizeModel(ctx, profile.Name); err != nil {
+		return job{}, nil, err
+	}
+	if req.Quality != "" {
+		tier, err := qualityTier(profile, req.Quality)
+		if err != nil {
+			return job{}, nil, &requestError{http.StatusBadRequest, err.Error()}
+		}
+		gen = tier.apply(gen)
+		// The tier may switch to another model, which the size and style
+		// are checked against from here on.
+		if tier.Model != "" {
+			profile = resolveProfile(tier.Model)
+			if err := authorizeModel(ctx, profile.Name); err != nil {
+				return job{}, nil, err
+			}
+		}
+	}
+	if len(images) == 0 {
+		// Only a size the client asked for is rejected with -size-policy
+		// reject; the default, keyword and tier-scaled sizes are always made
+		// to fit.
+		if explicitSize {
+			if _, err := profile.fitSize(size, sizePolicy == "snap"); err != nil {
+				return job{}, nil, &requestError{http.StatusBadRequest, err.Error()}
+			}
+		}
+		fitted, _ := profile.fitSize(gen.Size, true)
+		if fitted != gen.Size {
+			fmt.Printf("Size %s snapped to %s for model %s\n", gen.Size, fitted, profile.Name)
+		}
+		gen.Size = fitted
+	} else {
+		allowed := profile.initResolutions()
+		for i := range images {
+			if images[i], err = convertImage(ctx, images[i]); err != nil {
+				log.Printf("Init image error: %v\n", err)
+				return job{}, nil, &requestError{http.StatusBadRequest, err.Error()}
+			}
+			images[i], gen.Size, err = fitInitImage(images[i], allowed, initFit)
+			if err != nil {
+				log.Printf("Init image error: %v\n", err)
+				return job{}, nil, &requestError{http.StatusBadRequest, err.Error()}
+			}
+			fmt.Printf("Init image #%d fitted to %s (%s)\n", i, gen.Size, initFit)
+		}
+		gen.Images = images
+	}
+	if req.Style != "" {
+		style, err := imageStyle(profile, req.Style)
+		if err != nil {
+			return job{}, nil, &requestError{http.StatusBadRequest, err.Error()}
+		}
+		gen = style.apply(gen)
+	}
+	if len(req.styleImage) > 0 {
+		if !profile.StyleReference {
+			return job{}, nil, &requestError{http.StatusBadRequest, fmt.Sprintf("Model %s does not support style images", profile.Name)}
+		}
+		if gen.StyleImage, err = fitStyleImage(ctx, req.styleImage); err != nil {
+			return job{}, nil, &requestError{http.StatusBadRequest, err.Error()}
+		}
+	}
+	j := job{
+		gen:            gen,
+		promptTemplate: template,
+		model:          req.Model,
+		restoreFaces:   req.RestoreFaces,
+		grid:           req.Grid,
+	}
+	if req.Collection != "" {
+		j.collections = []string{req.Collection}
+	}
+	if recordDir != "" {
+		j.request = req
+	}
+	switch {
+	case req.XYGrid != nil:
+		if j.runs, err = req.XYGrid.runs(gen); err != nil {
+			return job{}, nil, &requestError{http.StatusBadRequest, err.Error()}
+		}
+		j.xy = req.XYGrid
+	case len(req.Seeds) > 0:
+		j.runs = seedRuns(gen, req.Seeds)
+	}
+
+	j.id = newJobID()
+	return j, chunks, nil
+}
+
+// jobMarkdown renders the images of a job as markdown, the grid first, and
+// returns the seeds of the images. Single images are labeled with label,
+// several by their seed.
+func jobMarkdown(result jobResult, label string) (string, []int64) {
+	var markdown []string
+	if result.GridName != "" {
+		markdown = append(markdown, fmt.Sprintf("![grid](%s)", generatedURL(result.GridName)))
+	}
+	var seeds []int64
+	for _, meta := range result.Images { // e.g., output_123456.png
+		alt := label
+		if len(result.Images) > 1 {
+			alt = fmt.Sprintf("seed %d", meta.Seed)
+		}
+		markdown = append(markdown, fmt.Sprintf("![%s](%s)", alt, generatedURL(meta.Name)))
+		seeds = append(seeds, meta.Seed)
+	}
+	return strings.Join(markdown, "\n\n"), seeds
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == sandboxHelperArg {
+		runSandboxHelper(os.Args[2:])
+	}
+	// "replay [flags] FILE" runs a job recorded with -record-dir again.
+	replay := len(os.Args) > 1 && os.Args[1] == "replay"
+	if replay {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	flag.Parse()
+	if replay && flag.NArg() != 1 {
+		log.Fatal("Usage: replay [flags] FILE")
+	}
+
+	var err error
+	backends, err = parseBackends(backendList)
+	if err != nil {
+		log.Fatalf("Invalid -backends: %v", err)
+	}
+
+	switch role {
+	case roleStandalone, roleCoordinator:
+	case roleWorker:
+		if coordinatorURL == "" {
+			log.Fatal("-coordinator-url must be set in worker mode.")
+		}
+	default:
+		log.Fatalf("Invalid -role %q, expected coordinator or worker.", role)
+	}
+	// The worker endpoints hand out prompts and input images and accept
+	// results stored as the users' images.
+	if role != roleStandalone && workerToken == "" {
+		log.Fatalf("-worker-token must be set in %s mode.", role)
+	}
+
+	if weightType != "" && !validWeightType(weightType) {
+		log.Fatalf("Invalid -type %q, expected one of %s.", weightType, strings.Join(weightTypes, ", "))
+	}
+	if defaultSize, err = parseResolution(defaultSizeStr); err != nil {
+		log.Fatalf("Invalid -default-size: %v", err)
+	}
+	if sizePolicy != "snap" && sizePolicy != "reject" {
+		log.Fatalf("Invalid -size-policy %q, expected snap or reject.", sizePolicy)
+	}
+	if defaultSteps < 1 || defaultCfgScale <= 0 || defaultSampler == "" {
+		log.Fatal("-default-steps and -default-cfg-scale must be positive and -default-sampler set.")
+	}
+
+	switch initFit {
+	case "crop", "pad", "stretch":
+	default:
+		log.Fatalf("Invalid -init-fit mode %q, expected crop, pad or stretch.", initFit)
+	}
+
+	if maxRefImages < 1 {
+		log.Fatal("-max-ref-images must be at least 1.")
+	}
+
+	resolutions, err = parseResolutionList(resolutionList)
+	if err != nil {
+		log.Fatalf("Invalid -resolutions: %v", err)
+	}
+
+	switch safetyAction {
+	case safetyActionReject, safetyActionBlur:
+	default:
+		log.Fatalf("Invalid -safety-action %q, expected reject or blur.", safetyAction)
+	}
+
+	switch promptWeighting {
+	case promptWeightingNormalize, promptWeightingStrip, promptWeightingOff:
+	default:
+		log.Fatalf("Invalid -prompt-weighting %q, expected normalize, strip or off.", promptWeighting)
+	}
+
+	if imageCacheMB > 0 {
+		remoteImages = newImageCache(int64(imageCacheMB)<<20, imageCacheTTL)
+	}
+
+	if basePath = strings.TrimSuffix(basePath, "/"); basePath != "" && !strings.HasPrefix(basePath, "/") {
+		log.Fatal("-base-path must start with a slash.")
+	}
+	if trustedProxies, err = parseTrustedProxies(trustedProxyList); err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	if apiFilter, err = newIPFilter(apiAllowList, apiDenyList); err != nil {
+		log.Fatalf("Invalid -api-allow or -api-deny: %v", err)
+	}
+	if adminFilter, err = newIPFilter(adminAllowList, adminDenyList); err != nil {
+		log.Fatalf("Invalid -admin-allow or -admin-deny: %v", err)
+	}
+
+	if sdCPUTime < 0 || sdAddressSpaceMB < 0 || sdOpenFiles < 0 || sdMemoryMB < 0 {
+		log.Fatal("-sd-cpu-time, -sd-address-space-mb, -sd-open-files and -sd-memory-mb must not be negative.")
+	}
+	if sdMemoryMB > 0 && sdCgroupDir == "" {
+		log.Fatal("-sd-memory-mb requires -sd-cgroup.")
+	}
+	if tempDir != "" {
+		if info, err := os.Stat(tempDir); err != nil || !info.IsDir() {
+			log.Fatalf("-temp-dir %s is not a directory.", tempDir)
+		}
+	}
+	if recordDir != "" {
+		if err := os.MkdirAll(recordDir, 0700); err != nil {
+			log.Fatalf("Invalid -record-dir: %v", err)
+		}
+	}
+	if err := checkSandbox(); err != nil {
+		log.Fatal(err)
+	}
+
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be given together.")
+	}
+	if tlsClientCA != "" && tlsCert == "" {
+		log.Fatal("-tls-client-ca requires -tls-cert and -tls-key.")
+	}
+
+	config, err = loadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	// Only processes that run sd themselves need a model, given by flags or
+	// as profiles in the config.
+	if generationBackend != backendSD && generationBackend != backendMock {
+		log.Fatalf("Invalid -backend %q: must be sd or mock", generationBackend)
+	}
+	mockBackend := generationBackend == backendMock
+	needsModel := len(backends) == 0 && role != roleCoordinator && sdServerURL == "" && !mockBackend
+	flagsGiven := sdServerURL == "" && !mockBackend && (diffusionModel != "" || vaePath != "" || clipLPath != "" || t5xxlPath != "")
+	if (needsModel && len(config.Models) == 0) || flagsGiven {
+		if diffusionModel == "" || vaePath == "" || clipLPath == "" || t5xxlPath == "" {
+			log.Fatal("All model component paths must be provided via flags.")
+		}
+	}
+	setupPools(config.Pools)
+	for _, name := range splitPaths(workerPools) {
+		if _, ok := pools[name]; !ok {
+			log.Fatalf("Invalid -worker-pools: unknown pool %q", name)
+		}
+	}
+	if err := loadResolutionKeywords(config.ResolutionKeywords); err != nil {
+		log.Fatalf("Invalid config: resolution_keywords: %v", err)
+	}
+	if err := config.Routing.validate(); err != nil {
+		log.Fatalf("Invalid config: routing: %v", err)
+	}
+	for name, tier := range config.Quality {
+		if err := tier.validate(); err != nil {
+			log.Fatalf("Invalid config: quality %q: %v", name, err)
+		}
+	}
+	for name, style := range config.Styles {
+		if err := style.validate(); err != nil {
+			log.Fatalf("Invalid config: styles %q: %v", name, err)
+		}
+	}
+	for _, p := range config.Models {
+		for name, tier := range p.Quality {
+			if err := tier.validate(); err != nil {
+				log.Fatalf("Invalid config: model %q: quality %q: %v", p.Name, name, err)
+			}
+		}
+		for name, style := range p.Styles {
+			if err := style.validate(); err != nil {
+				log.Fatalf("Invalid config: model %q: styles %q: %v", p.Name, name, err)
+			}
+		}
+	}
+
+	// Proxies and coordinators leave the profiles to their backends.
+	if len(backends) == 0 && role != roleCoordinator {
+		for i, k := range config.Auth.APIKeys {
+			for _, name := range k.Models {
+				if _, ok := findProfile(name); !ok {
+					log.Fatalf("Invalid config: auth: api_keys[%d]: unknown model %q", i, name)
+				}
+			}
+		}
+	}
+
+	if tenantIsolation && !config.Auth.enabled() {
+		log.Fatal("-tenant-isolation requires authentication to be configured.")
+	}
+
+	store, err = newStorage(config.Storage)
+	if err != nil {
+		log.Fatalf("Invalid storage config: %v", err)
+	}
+	if config.Auth.OIDC != nil {
+		oidc = newOIDCVerifier(*config.Auth.OIDC)
+	}
+	if checkConfig {
+		os.Exit(runConfigCheck(context.Background()))
+	}
+	if replay {
+		os.Exit(runReplay(context.Background(), flag.Arg(0)))
+	}
 
-	if diffusionModel == "" || vaePath == "" || clipLPath == "" || t5xxlPath == "" {
-		log.Fatal("All model component paths must be provided via flags.")
+	if needsModel {
+		tool := gpuTool
+		if tool == "auto" {
+			tool = detectGPUTool()
+		}
+		if tool != "" && tool != "none" {
+			go sampleGPUs(context.Background(), tool, gpuSampleInterval)
+		}
 	}
+	http.HandleFunc("/metrics", handleMetrics)
 
-	http.HandleFunc("/v1/chat/completions", handleChatCompletion)
+	if role == roleWorker {
+		// Workers serve nothing but their metrics.
+		go func() {
+			log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), filterIPs(http.DefaultServeMux)))
+		}()
+		fmt.Printf("Worker pulling jobs from %s\n", coordinatorURL)
+		runWorker(context.Background())
+		return
+	}
+
+	if role == roleCoordinator {
+		if redisAddr != "" {
+			queue = newRedisQueue(redisAddr, redisPassword, redisPrefix)
+		}
+		http.HandleFunc("/internal/jobs/next", handleWorkerNext)
+		http.HandleFunc("/internal/jobs/", handleWorkerResult)
+	}
+
+	if len(backends) > 0 {
+		// Proxy mode: jobs are dispatched to the backends, nothing runs here.
+		go checkBackendHealth(context.Background(), backendHealthInterval)
+		http.HandleFunc("/v1/chat/completions", requireAuth(handleProxyJob))
+		http.HandleFunc("/v1/models", requireAuth(handleProxyModels))
+		http.HandleFunc("/v1/generations/", requireAuth(handleProxyOwned))
+		http.HandleFunc("/v1/images/interrogate", requireAuth(handleProxyJob))
+		http.HandleFunc("/v1/images/generations", requireAuth(handleProxyJob))
+		http.HandleFunc("/v1/compare", requireAuth(handleProxyJob))
+		http.HandleFunc("/v1/messages", requireAuth(handleProxyJob))
+		http.HandleFunc("/v1beta/models/", requireAuth(handleProxyJob))
+		http.HandleFunc("/v1/jobs/", requireAuth(handleProxyJobStatus))
+		http.HandleFunc("/v1/history/export", requireAuth(handleProxyUnsupported))
+		http.HandleFunc("/v1/stats", requireAuth(handleProxyUnsupported))
+		http.HandleFunc("/v1/uploads", requireAuth(handleProxyUnsupported))
+		http.HandleFunc("/v1/collections", requireAuth(handleProxyUnsupported))
+		http.HandleFunc("/v1/collections/", requireAuth(handleProxyUnsupported))
+		http.HandleFunc("/v1/batches", requireAuth(handleProxyUnsupported))
+		http.HandleFunc("/v1/batches/", requireAuth(handleProxyUnsupported))
+		http.HandleFunc("/generated/", handleProxyOwned)
+	} else {
+		http.HandleFunc("/v1/chat/completions", requireAuth(handleChatCompletion))
+		http.HandleFunc("/v1/models", requireAuth(handleModels))
+		http.HandleFunc("/v1/generations/", requireAuth(handleGenerations))
+		http.HandleFunc("/v1/images/interrogate", requireAuth(handleInterrogate))
+		http.HandleFunc("/v1/images/generations", requireAuth(handleImageGenerations))
+		http.HandleFunc("/v1/compare", requireAuth(handleCompare))
+		http.HandleFunc("/v1/messages", requireAuth(handleAnthropicMessages))
+		http.HandleFunc("/v1beta/models/", requireAuth(handleGemini))
+		http.HandleFunc("/v1/uploads", requireAuth(handleUpload))
+		http.HandleFunc("/v1/jobs/", requireAuth(handleJobStatus))
+		http.HandleFunc("/v1/history/export", requireAuth(handleHistoryExport))
+		http.HandleFunc("/v1/stats", requireAuth(handleStats))
+		http.HandleFunc("/v1/collections", requireAuth(handleCollections))
+		http.HandleFunc("/v1/collections/", requireAuth(handleCollections))
+		http.HandleFunc("/v1/batches", requireAuth(handleBatches))
+		http.HandleFunc("/v1/batches/", requireAuth(handleBatches))
+		go runBatches()
+		http.HandleFunc("/admin/benchmark", requireAdmin(handleBenchmark))
+		http.HandleFunc("/admin/schedules", requireAdmin(handleSchedules))
+		http.HandleFunc("/admin/schedules/", requireAdmin(handleSchedules))
+		for _, job := range config.Schedules {
+			owner := identity{User: job.User, Method: "schedule"}
+			if owner.User == "" {
+				owner.User = "schedule:" + job.Name
+			}
+			if err := schedules.add(job, owner, true); err != nil {
+				log.Fatalf("Invalid config: schedules %q: %v", job.Name, err)
+			}
+		}
+		go schedules.run(context.Background())
+		if tenantIsolation {
+			http.HandleFunc("/generated/", requireAuth(handleGenerated))
+		} else {
+			http.HandleFunc("/generated/", handleGenerated)
+		}
+		http.HandleFunc("/generated/feed.xml", requireAuth(handleFeed))
+		if config.Telegram.Token != "" {
+			if len(config.Telegram.AllowedChats) == 0 {
+				log.Printf("WARNING: telegram.allowed_chats is empty, the bot generates images for anyone on Telegram who finds it")
+			}
+			go newTelegramBot(config.Telegram).run(context.Background())
+		}
+		if config.Slack.SigningSecret != "" {
+			http.HandleFunc("/slack/commands", handleSlackCommand)
+		}
+		if config.Discord.PublicKey != "" {
+			discordLimiter = &channelLimiter{limit: config.Discord.RateLimit, events: make(map[string][]time.Time)}
+			http.HandleFunc("/discord/interactions", handleDiscordInteraction)
+			if config.Discord.BotToken != "" {
+				go func() {
+					if err := registerDiscordCommands(context.Background()); err != nil {
+						log.Printf("Failed to register Discord commands: %v", err)
+					}
+				}()
+			}
+		}
+	}
+	captureOutput()
+	http.HandleFunc("/admin/logs/stream", requireAdmin(handleLogStream))
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = io.WriteString(w, "OK")
 	})
 
+	handler := filterIPs(gzipHandler(http.DefaultServeMux))
+	if basePath != "" {
+		root := http.NewServeMux()
+		root.Handle(basePath+"/", http.StripPrefix(basePath, handler))
+		handler = root
+	}
+
 	addr := fmt.Sprintf(":%s", port)
-	fmt.Printf("Server running on http://localhost%s\n", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	if tlsCert == "" {
+		fmt.Printf("Server running on http://localhost%s%s\n", addr, basePath)
+		log.Fatal(http.ListenAndServe(addr, handler))
+	}
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		log.Fatalf("Invalid TLS setup: %v", err)
+	}
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+	fmt.Printf("Server running on https://localhost%s%s\n", addr, basePath)
+	log.Fatal(server.ListenAndServeTLS(tlsCert, tlsKey))
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// alphaMaskThreshold is the alpha value below which a pixel counts as erased.
+const alphaMaskThreshold = 128
+
+// alphaMask derives an inpainting mask from the transparent regions of an image:
+// erased (transparent) pixels become white, everything else black. The second
+// return value is false when the image has no transparent pixels at all.
+func alphaMask(data []byte) ([]byte, bool, error) {
+	src, _, err := decodeInputImage(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decode init image: %w", err)
+	}
+
+	b := src.Bounds()
+	mask := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	found := false
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			a := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA).A
+			if a < alphaMaskThreshold {
+				mask.SetGray(x-b.Min.X, y-b.Min.Y, color.Gray{Y: 255})
+				found = true
+			}
+		}
+	}
+	if !found {
+		return nil, false, nil
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, mask); err != nil {
+		return nil, false, fmt.Errorf("failed to encode mask: %w", err)
+	}
+	return buf.Bytes(), true, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// imageMetadata is the full recipe of a generated image. It is stored as a JSON
+// sidecar next to the image so any image link can be turned back into the
+// parameters that produced it.
+type imageMetadata struct {
+	Name           string    `json:"name"`
+	CreatedAt      time.Time `json:"created_at"`
+	Model          string    `json:"model"`
+	User           string    `json:"user,omitempty"`   // authenticated caller
+	Tenant         string    `json:"tenant,omitempty"` // with -tenant-isolation
+	Profile        string    `json:"profile,omitempty"`
+	DiffusionModel string    `json:"diffusion_model"`
+	Mode           string    `json:"mode"` // txt2img, img2img, edit or inpaint
+	Prompt         string    `json:"prompt"`
+	PromptTemplate string    `json:"prompt_template,omitempty"` // before dynamic prompt expansion
+	PromptChunks   []string  `json:"prompt_chunks,omitempty"`   // as split at BREAK
+	NegativePrompt string    `json:"negative_prompt,omitempty"`
+	Seed           int64     `json:"seed"`
+	Width          int       `json:"width"`
+	Height         int       `json:"height"`
+	Sampler        string    `json:"sampler"`
+	Steps          int       `json:"steps"`
+	CfgScale       float64   `json:"cfg_scale"`
+	Strength       float64   `json:"strength,omitempty"`
+	ImageGuidance  *float64  `json:"image_guidance,omitempty"`
+	Guidance       *float64  `json:"guidance,omitempty"`
+	StyleReference bool      `json:"style_reference,omitempty"` // drawn in the style of a style image
+	RestoreFaces   bool      `json:"restore_faces,omitempty"`
+	Collections    []string  `json:"collections,omitempty"`
+	Timings        timings   `json:"timings"`
+}
+
+// timings are in seconds. Generation covers the whole sd run and, like the
+// load, sampling and decode phases parsed from sd's output, is shared by all
+// images of a batch.
+type timings struct {
+	Generation  float64 `json:"generation"`
+	Load        float64 `json:"load,omitempty"`
+	Sampling    float64 `json:"sampling,omitempty"`
+	Decode      float64 `json:"decode,omitempty"`
+	PostProcess float64 `json:"post_process"`
+}
+
+// validImageName reports whether name is a plain file name of a PNG in the
+// output directory, i.e. it can't escape it.
+func validImageName(name string) bool {
+	if tenant, file, ok := strings.Cut(name, "/"); ok {
+		if !validTenant(tenant) {
+			return false
+		}
+		name = file
+	}
+	return name != "" &&
+		name == filepath.Base(name) &&
+		!strings.HasPrefix(name, ".") &&
+		strings.HasSuffix(name, ".png")
+}
+
+// metadataName returns the storage name of the sidecar of the given image.
+func metadataName(name string) string {
+	return strings.TrimSuffix(name, ".png") + ".json"
+}
+
+func saveMetadata(ctx context.Context, meta imageMetadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, metadataName(meta.Name), data, "application/json")
+}
+
+func loadMetadata(ctx context.Context, name string) (imageMetadata, error) {
+	var meta imageMetadata
+	data, err := store.Get(ctx, metadataName(name))
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("invalid metadata for %s: %w", name, err)
+	}
+	return meta, nil
+}
+
+// deleteGenerated removes an image and its parameters from storage.
+func deleteGenerated(w http.ResponseWriter, r *http.Request, name string) {
+	if err := store.Delete(r.Context(), name); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Failed to delete %s: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := store.Delete(r.Context(), metadataName(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to delete metadata of %s: %v", name, err)
+	}
+	if err := unindexImage(r.Context(), name); err != nil {
+		log.Printf("Failed to remove %s from its collections: %v", name, err)
+	}
+	log.Printf("Deleted %s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// generatedURL returns the path a generated image is served at.
+func generatedURL(name string) string {
+	return basePath + "/generated/" + name
+}
+
+// handleGenerated serves generated images from storage at
+// /generated/{name}, their parameters at /generated/{name}/params and a small
+// preview at /generated/{name}/thumb. With -tenant-isolation, names include
+// the tenant, only the tenant's own images are found and they may be deleted.
+func handleGenerated(w http.ResponseWriter, r *http.Request) {
+	allowed := r.Method == http.MethodGet || r.Method == http.MethodHead || (tenantIsolation && r.Method == http.MethodDelete)
+	if !allowed {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, suffix := splitImagePath(strings.TrimPrefix(r.URL.Path, "/generated/"))
+	if !validImageName(name) || !ownsImage(r.Context(), name) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if suffix != "" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		deleteGenerated(w, r, name)
+		return
+	}
+
+	switch suffix {
+	case "":
+		data, err := store.Get(r.Context(), name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				http.NotFound(w, r)
+				return
+			}
+			log.Printf("Failed to load %s: %v", name, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+	case "thumb":
+		data, err := store.Get(r.Context(), name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				http.NotFound(w, r)
+				return
+			}
+			log.Printf("Failed to load %s: %v", name, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		thumb, err := thumbnail(data, thumbnailSize)
+		if err != nil {
+			log.Printf("Failed to make thumbnail of %s: %v", name, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Write(thumb)
+	case "params":
+		meta, err := loadMetadata(r.Context(), name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				http.Error(w, "No parameters recorded for this image", http.StatusNotFound)
+				return
+			}
+			log.Printf("Failed to load metadata for %s: %v", name, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(meta)
+	default:
+		http.NotFound(w, r)
+	}
+}
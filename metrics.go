@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// metricsInstance is the worker label of all metrics, so that the series of
+// several workers can be told apart after aggregation.
+func metricsInstance() string {
+	if workerName != "" {
+		return workerName
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// handleMetrics exposes metrics in the Prometheus text format at /metrics.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeGPUMetrics(w)
+}
+
+func writeGPUMetrics(w io.Writer) {
+	samples, sampled := latestGPUSamples()
+	if sampled.IsZero() {
+		return
+	}
+	gauges := []struct {
+		name, help string
+		value      func(gpuSample) float64
+	}{
+		{"sd_adapter_gpu_utilization_percent", "GPU utilization.", func(s gpuSample) float64 { return s.Utilization }},
+		{"sd_adapter_gpu_memory_used_bytes", "GPU memory in use.", func(s gpuSample) float64 { return s.MemoryUsedMiB * (1 << 20) }},
+		{"sd_adapter_gpu_memory_total_bytes", "Total GPU memory.", func(s gpuSample) float64 { return s.MemoryTotalMiB * (1 << 20) }},
+		{"sd_adapter_gpu_temperature_celsius", "GPU temperature.", func(s gpuSample) float64 { return s.TemperatureC }},
+		{"sd_adapter_gpu_power_watts", "GPU power draw.", func(s gpuSample) float64 { return s.PowerW }},
+	}
+	worker := metricsLabel(metricsInstance())
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, s := range samples {
+			if v := g.value(s); v >= 0 {
+				fmt.Fprintf(w, "%s{worker=%s,gpu=%s,name=%s} %g\n", g.name, worker, metricsLabel(s.Index), metricsLabel(s.Name), v)
+			}
+		}
+	}
+	fmt.Fprintf(w, "# HELP sd_adapter_gpu_sample_timestamp_seconds When the GPUs were last sampled.\n# TYPE sd_adapter_gpu_sample_timestamp_seconds gauge\n")
+	fmt.Fprintf(w, "sd_adapter_gpu_sample_timestamp_seconds{worker=%s} %d\n", worker, sampled.Unix())
+}
+
+// metricsLabel quotes a label value for the Prometheus text format.
+func metricsLabel(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+	return `"` + s + `"`
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"time"
+)
+
+const (
+	backendSD   = "sd"
+	backendMock = "mock"
+)
+
+// runMockGeneration stands in for sd with -backend mock: after -mock-delay it
+// returns placeholder images showing the prompt and seed, so clients can be
+// developed against the full API without a GPU or model files.
+func runMockGeneration(ctx context.Context, gen generation, meta imageMetadata) ([]generatedImage, error) {
+	if len(gen.InitImage) > 0 {
+		meta.Mode = "img2img"
+		meta.Strength = gen.Strength
+	} else if len(gen.Images) > 0 {
+		meta.Mode = "edit"
+	}
+	meta.StyleReference = len(gen.StyleImage) > 0
+
+	start := time.Now()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(mockDelay):
+	}
+	meta.Timings.Generation = time.Since(start).Seconds()
+
+	results := make([]generatedImage, 0, gen.BatchCount)
+	for i := 0; i < gen.BatchCount; i++ {
+		meta.Seed = gen.Seed + int64(i)
+		data, err := mockImage(gen.Size.Width, gen.Size.Height, gen.Prompt, meta.Seed)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, generatedImage{Data: data, Meta: meta})
+	}
+	return results, nil
+}
+
+// mockImage renders a vertical gradient, tinted by the seed so that batches
+// are told apart, with the prompt wrapped across it.
+func mockImage(width, height int, prompt string, seed int64) ([]byte, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	hue := uint8(seed * 47)
+	for y := 0; y < height; y++ {
+		shade := uint8(40 + 120*y/max(1, height))
+		c := color.NRGBA{R: shade / 2, G: shade/2 + hue/4, B: shade + hue/8, A: 255}
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	scale := max(1, width/256)
+	margin := 4 * scale
+	lineHeight := (glyphHeight + 3) * scale
+	maxChars := max(1, (width-2*margin)/(glyphAdvance*scale))
+	lines := wrapText(prompt, maxChars)
+	lines = append(lines, "", fmt.Sprintf("seed %d", seed), "mock backend")
+	if maxLines := (height - 2*margin) / lineHeight; len(lines) > maxLines {
+		lines = lines[:max(0, maxLines)]
+	}
+	for i, text := range lines {
+		drawText(img, margin, margin+i*lineHeight, truncateText(text, scale, width-2*margin), scale, color.White)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode mock image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// wrapText breaks text into lines of at most width characters at spaces.
+func wrapText(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		switch {
+		case line == "":
+			line = word
+		case len([]rune(line))+1+len([]rune(word)) <= width:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ModelProfile is a named set of model files sd is run with. The model given
+// by the -diffusion-model, -vae, -clip_l and -t5xxl flags is the default
+// profile; more can be configured under "models" in the config file.
+type ModelProfile struct {
+	Name           string `json:"name"`
+	DiffusionModel string `json:"diffusion_model"`
+	VAE            string `json:"vae,omitempty"`
+	ClipL          string `json:"clip_l,omitempty"`
+	T5XXL          string `json:"t5xxl,omitempty"`
+
+	// Memory management for low-VRAM cards, passed through to sd.
+	OffloadToCPU bool `json:"offload_to_cpu,omitempty"` // keep weights in RAM, load to VRAM on demand
+	ClipOnCPU    bool `json:"clip_on_cpu,omitempty"`
+	VAEOnCPU     bool `json:"vae_on_cpu,omitempty"`
+	VAETiling    bool `json:"vae_tiling,omitempty"`
+
+	// WeightType quantizes the weights on load (sd --type), e.g. q8_0 or
+	// q4_K for a safetensors checkpoint; empty keeps the file's types.
+	WeightType string `json:"type,omitempty"`
+
+	// Image is the container image sd runs in for this profile, see
+	// ContainerConfig.
+	Image string `json:"image,omitempty"`
+
+	// ServerURL is a stable-diffusion.cpp server (or another runner with the
+	// AUTOMATIC1111 sdapi) generations are forwarded to instead of running
+	// sd; the model files are then the server's business.
+	ServerURL string `json:"server_url,omitempty"`
+
+	// StyleReference is set for models that take reference images (sd -r),
+	// like FLUX.1 Kontext, which style images of requests are passed as.
+	StyleReference bool `json:"style_reference,omitempty"`
+
+	// Pool is the worker pool the profile's generations run in, see
+	// WorkerPool; the default pool if empty.
+	Pool string `json:"pool,omitempty"`
+
+	// Quality and Styles override the tiers and styles of the config file
+	// for this profile, e.g. fewer steps for hd with a turbo model.
+	Quality map[string]QualityTier `json:"quality,omitempty"`
+	Styles  map[string]ImageStyle  `json:"styles,omitempty"`
+
+	// The sizes the model can generate: sides between MinSize and MaxSize
+	// pixels, multiples of SizeMultiple. Zero values take the defaults.
+	MinSize      int `json:"min_size,omitempty"`
+	MaxSize      int `json:"max_size,omitempty"`
+	SizeMultiple int `json:"size_multiple,omitempty"`
+}
+
+// Default size limits of profiles, suiting SD and Flux models.
+const (
+	defaultMinSize      = 256
+	defaultMaxSize      = 2048
+	defaultSizeMultiple = 64
+)
+
+// weightTypes are the values sd accepts for --type.
+var weightTypes = []string{"f32", "f16", "bf16", "q4_0", "q4_1", "q5_0", "q5_1", "q8_0", "q2_K", "q3_K", "q4_K", "q5_K", "q6_K", "q8_K"}
+
+// validWeightType reports whether t is a weight type sd accepts, ignoring case.
+func validWeightType(t string) bool {
+	for _, wt := range weightTypes {
+		if strings.EqualFold(t, wt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p ModelProfile) validate() error {
+	if p.Name == "" || (p.DiffusionModel == "" && p.ServerURL == "") {
+		return fmt.Errorf("name and diffusion_model or server_url are required")
+	}
+	if p.WeightType != "" && !validWeightType(p.WeightType) {
+		return fmt.Errorf("invalid type %q, expected one of %s", p.WeightType, strings.Join(weightTypes, ", "))
+	}
+	if p.MinSize < 0 || p.MaxSize < 0 || p.SizeMultiple < 0 {
+		return fmt.Errorf("min_size, max_size and size_multiple must not be negative")
+	}
+	if lo, hi, _ := p.sizeLimits(); lo > hi {
+		return fmt.Errorf("min_size must not exceed max_size")
+	}
+	return nil
+}
+
+// sizeLimits returns the profile's side limits and multiple, with defaults.
+func (p ModelProfile) sizeLimits() (lo, hi, multiple int) {
+	lo, hi, multiple = p.MinSize, p.MaxSize, p.SizeMultiple
+	if lo == 0 {
+		lo = defaultMinSize
+	}
+	if hi == 0 {
+		hi = defaultMaxSize
+	}
+	if multiple == 0 {
+		multiple = defaultSizeMultiple
+	}
+	return lo, hi, multiple
+}
+
+// fitSize checks a requested size against the sizes the profile supports.
+// With snap, an unsupported size is scaled down to fit the maximum and its
+// sides rounded to the nearest multiple within the limits; otherwise it is an
+// error.
+func (p ModelProfile) fitSize(r resolution, snap bool) (resolution, error) {
+	lo, hi, multiple := p.sizeLimits()
+	supported := func(v int) bool { return v >= lo && v <= hi && v%multiple == 0 }
+	if supported(r.Width) && supported(r.Height) {
+		return r, nil
+	}
+	if !snap {
+		return r, fmt.Errorf("size %s is not supported by model %s: width and height must be multiples of %d between %d and %d", r, p.Name, multiple, lo, hi)
+	}
+	if longest := max(r.Width, r.Height); longest > hi {
+		factor := float64(hi) / float64(longest)
+		r = resolution{Width: int(float64(r.Width) * factor), Height: int(float64(r.Height) * factor)}
+	}
+	side := func(v int) int {
+		v = (v + multiple/2) / multiple * multiple
+		// round into the limits, which need not be multiples themselves
+		for v < lo {
+			v += multiple
+		}
+		for v > hi {
+			v -= multiple
+		}
+		return v
+	}
+	return resolution{Width: side(r.Width), Height: side(r.Height)}, nil
+}
+
+// initResolutions returns the -resolutions init images are fitted to, brought
+// within the profile's size limits.
+func (p ModelProfile) initResolutions() []resolution {
+	var allowed []resolution
+	for _, r := range resolutions {
+		if fitted, _ := p.fitSize(r, true); !slices.Contains(allowed, fitted) {
+			allowed = append(allowed, fitted)
+		}
+	}
+	return allowed
+}
+
+// files returns the model files sd reads for the profile.
+func (p ModelProfile) files() []string {
+	var files []string
+	for _, f := range []string{p.DiffusionModel, p.VAE, p.ClipL, p.T5XXL} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// args returns the sd arguments selecting the profile's model files.
+func (p ModelProfile) args() []string {
+	args := []string{"--diffusion-model", p.DiffusionModel}
+	if p.VAE != "" {
+		args = append(args, "--vae", p.VAE)
+	}
+	if p.ClipL != "" {
+		args = append(args, "--clip_l", p.ClipL)
+	}
+	if p.T5XXL != "" {
+		args = append(args, "--t5xxl", p.T5XXL)
+	}
+	if p.OffloadToCPU {
+		args = append(args, "--offload-to-cpu")
+	}
+	if p.ClipOnCPU {
+		args = append(args, "--clip-on-cpu")
+	}
+	if p.VAEOnCPU {
+		args = append(args, "--vae-on-cpu")
+	}
+	if p.VAETiling {
+		args = append(args, "--vae-tiling")
+	}
+	if p.WeightType != "" {
+		args = append(args, "--type", p.WeightType)
+	}
+	return args
+}
+
+// modelProfiles returns all profiles, the default one first.
+func modelProfiles() []ModelProfile {
+	var profiles []ModelProfile
+	if diffusionModel != "" || sdServerURL != "" || generationBackend == backendMock {
+		profiles = append(profiles, ModelProfile{
+			Name:           localModelName(),
+			DiffusionModel: diffusionModel,
+			VAE:            vaePath,
+			ClipL:          clipLPath,
+			T5XXL:          t5xxlPath,
+			OffloadToCPU:   offloadToCPU,
+			ClipOnCPU:      clipOnCPU,
+			VAEOnCPU:       vaeOnCPU,
+			VAETiling:      vaeTiling,
+			WeightType:     weightType,
+			StyleReference: styleReference,
+			ServerURL:      sdServerURL,
+		})
+	}
+	return append(profiles, config.Models...)
+}
+
+// findProfile returns the profile with the given name.
+func findProfile(name string) (ModelProfile, bool) {
+	for _, p := range modelProfiles() {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return ModelProfile{}, false
+}
+
+// resolveProfile returns the profile with the given name, falling back to the
+// default profile for unknown or generic names.
+func resolveProfile(name string) ModelProfile {
+	if p, ok := findProfile(name); ok {
+		return p
+	}
+	if profiles := modelProfiles(); len(profiles) > 0 {
+		return profiles[0]
+	}
+	return ModelProfile{}
+}
+
+// modelInfo is an entry of the OpenAI-compatible /v1/models list.
+type modelInfo struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type modelList struct {
+	Object string      `json:"object"`
+	Data   []modelInfo `json:"data"`
+}
+
+// localModelName is the name this instance reports for its model: -model-name
+// if set, otherwise the diffusion model's file name without extension.
+func localModelName() string {
+	if modelName != "" {
+		return modelName
+	}
+	if diffusionModel == "" {
+		return "stable-diffusion"
+	}
+	base := filepath.Base(diffusionModel)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func handleModels(w http.ResponseWriter, r *http.Request) {
+	list := modelList{Object: "list", Data: []modelInfo{}}
+	for _, p := range modelProfiles() {
+		if !modelAllowed(r.Context(), p.Name) {
+			continue
+		}
+		list.Data = append(list.Data, modelInfo{ID: p.Name, Object: "model", OwnedBy: "stable-diffusion-cpp-adapter"})
+	}
+	writeJSON(w, list)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// embeddedParameters are the generation parameters found in a PNG's
+// "parameters" text chunk, as written by stable-diffusion.cpp and A1111, or
+// as the JSON of an adapter sidecar.
+type embeddedParameters struct {
+	Prompt         string
+	NegativePrompt string
+	Seed           *int64
+	Steps          int
+	CfgScale       float64
+	Sampler        string // sd sampling method, empty if unknown
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// sdSamplers are the sampling methods sd accepts.
+var sdSamplers = map[string]bool{
+	"euler": true, "euler_a": true, "heun": true, "dpm2": true, "dpm++2s_a": true, "dpm++2m": true,
+	"dpm++2mv2": true, "ipndm": true, "ipndm_v": true, "lcm": true, "ddim_trailing": true, "tcd": true,
+}
+
+// pngTextChunks returns the tEXt, zTXt and iTXt chunks of a PNG by keyword.
+// It returns nil for data that is not a PNG.
+func pngTextChunks(data []byte) map[string]string {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil
+	}
+	chunks := make(map[string]string)
+	for p := data[len(pngSignature):]; len(p) >= 12; {
+		n := binary.BigEndian.Uint32(p)
+		if uint64(n) > uint64(len(p)-12) {
+			break
+		}
+		typ, body := string(p[4:8]), p[8:8+n]
+		p = p[12+n:]
+		if typ == "IEND" {
+			break
+		}
+		keyword, rest, ok := bytes.Cut(body, []byte{0})
+		if !ok {
+			continue
+		}
+		switch typ {
+		case "tEXt":
+			chunks[string(keyword)] = string(rest)
+		case "zTXt":
+			if len(rest) > 0 {
+				if text, err := inflate(rest[1:]); err == nil {
+					chunks[string(keyword)] = text
+				}
+			}
+		case "iTXt":
+			// compression flag and method, then language and translated
+			// keyword, both null-terminated
+			if len(rest) < 2 {
+				continue
+			}
+			compressed := rest[0] == 1
+			fields := bytes.SplitN(rest[2:], []byte{0}, 3)
+			if len(fields) != 3 {
+				continue
+			}
+			text := string(fields[2])
+			if compressed {
+				var err error
+				if text, err = inflate(fields[2]); err != nil {
+					continue
+				}
+			}
+			chunks[string(keyword)] = text
+		}
+	}
+	return chunks
+}
+
+func inflate(data []byte) (string, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	text, err := io.ReadAll(io.LimitReader(r, 1<<20))
+	return string(text), err
+}
+
+// pngParameters returns the generation parameters embedded in a PNG, if any.
+func pngParameters(data []byte) (embeddedParameters, bool) {
+	text, ok := pngTextChunks(data)["parameters"]
+	if !ok || strings.TrimSpace(text) == "" {
+		return embeddedParameters{}, false
+	}
+	if strings.HasPrefix(strings.TrimSpace(text), "{") {
+		var meta imageMetadata
+		if err := json.Unmarshal([]byte(text), &meta); err != nil {
+			return embeddedParameters{}, false
+		}
+		seed := meta.Seed
+		return embeddedParameters{
+			Prompt:         meta.Prompt,
+			NegativePrompt: meta.NegativePrompt,
+			Seed:           &seed,
+			Steps:          meta.Steps,
+			CfgScale:       meta.CfgScale,
+			Sampler:        sdSampler(meta.Sampler),
+		}, true
+	}
+	return parseA1111Parameters(text), true
+}
+
+// a1111Setting matches one "Key: value" pair of the settings line, where
+// values may be quoted.
+var a1111Setting = regexp.MustCompile(`\s*([\w \-/+]+):\s*("(?:\\.|[^\\"])*"|[^,]*)(?:,|$)`)
+
+// parseA1111Parameters parses the A1111 text format: the prompt, an optional
+// "Negative prompt:" line and a last line of comma-separated settings, e.g.
+// "Steps: 20, Sampler: Euler a, CFG scale: 7, Seed: 42, Size: 512x512".
+func parseA1111Parameters(text string) embeddedParameters {
+	var p embeddedParameters
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	last := lines[len(lines)-1]
+	if strings.HasPrefix(last, "Steps: ") {
+		lines = lines[:len(lines)-1]
+		for _, m := range a1111Setting.FindAllStringSubmatch(last, -1) {
+			value := strings.Trim(strings.TrimSpace(m[2]), `"`)
+			switch strings.TrimSpace(m[1]) {
+			case "Steps":
+				p.Steps, _ = strconv.Atoi(value)
+			case "CFG scale":
+				p.CfgScale, _ = strconv.ParseFloat(value, 64)
+			case "Seed":
+				if seed, err := strconv.ParseInt(value, 10, 64); err == nil && seed >= 0 {
+					p.Seed = &seed
+				}
+			case "Sampler":
+				p.Sampler = sdSampler(value)
+			}
+		}
+	}
+
+	var prompt, negative []string
+	inNegative := false
+	for _, line := range lines {
+		if rest, ok := strings.CutPrefix(line, "Negative prompt:"); ok {
+			inNegative = true
+			line = rest
+		}
+		if inNegative {
+			negative = append(negative, line)
+		} else {
+			prompt = append(prompt, line)
+		}
+	}
+	p.Prompt = strings.TrimSpace(strings.Join(prompt, "\n"))
+	p.NegativePrompt = strings.TrimSpace(strings.Join(negative, "\n"))
+	return p
+}
+
+// sdSampler maps a sampler name, in sd's or A1111's spelling such as
+// "DPM++ 2M Karras", to sd's sampling method, empty if there is none.
+func sdSampler(name string) string {
+	s := strings.ToLower(strings.TrimSpace(name))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, " karras"), " exponential")
+	if strings.HasSuffix(s, " a") {
+		s = strings.TrimSuffix(s, " a") + "_a"
+	}
+	s = strings.ReplaceAll(s, " ", "")
+	if s == "ddim" {
+		s = "ddim_trailing"
+	}
+	if !sdSamplers[s] {
+		return ""
+	}
+	return s
+}
+
+// reuseParameters takes the parameters embedded in the most recent image as
+// defaults for an edit request: the prompt if none was given, and the seed
+// and negative prompt unless the request sets them. It returns the prompt to
+// use.
+func reuseParameters(req *ChatRequest, prompt string, images [][]byte) string {
+	if len(images) == 0 {
+		return prompt
+	}
+	p, ok := pngParameters(images[len(images)-1])
+	if !ok {
+		return prompt
+	}
+	fmt.Printf("Reusing embedded parameters: %d steps, CFG %g, sampler %q\n", p.Steps, p.CfgScale, p.Sampler)
+	req.embedded = &p
+	if prompt == "" {
+		prompt = p.Prompt
+	}
+	if req.Seed == nil && p.Seed != nil {
+		fmt.Println("Reusing embedded seed:", *p.Seed)
+		req.Seed = p.Seed
+	}
+	if req.NegativePrompt == "" {
+		req.NegativePrompt = p.NegativePrompt
+	}
+	return prompt
+}
+
+// apply sets the sampling parameters found in the image on a generation.
+func (p *embeddedParameters) apply(gen generation) generation {
+	if p.Steps > 0 {
+		gen.Steps = p.Steps
+	}
+	if p.CfgScale > 0 {
+		gen.CfgScale = p.CfgScale
+	}
+	if p.Sampler != "" {
+		gen.Sampler = p.Sampler
+	}
+	return gen
+}
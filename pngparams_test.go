@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"testing"
+)
+
+func TestParseA1111Parameters(t *testing.T) {
+	seed := func(v int64) *int64 { return &v }
+	tests := []struct {
+		name, text string
+		want       embeddedParameters
+	}{
+		{
+			name: "full",
+			text: "a cat, (red:1.2)\nNegative prompt: blurry, ugly\nSteps: 20, Sampler: DPM++ 2M Karras, CFG scale: 7.5, Seed: 42, Size: 512x768, Model: sdxl",
+			want: embeddedParameters{Prompt: "a cat, (red:1.2)", NegativePrompt: "blurry, ugly", Seed: seed(42), Steps: 20, CfgScale: 7.5, Sampler: "dpm++2m"},
+		},
+		{
+			name: "prompt only",
+			text: "a cat\n",
+			want: embeddedParameters{Prompt: "a cat"},
+		},
+		{
+			name: "no negative prompt",
+			text: "a cat\nSteps: 4, Sampler: Euler a, CFG scale: 1, Seed: 7",
+			want: embeddedParameters{Prompt: "a cat", Seed: seed(7), Steps: 4, CfgScale: 1, Sampler: "euler_a"},
+		},
+		{
+			name: "multi-line prompts",
+			text: "a cat\non a mat\nNegative prompt: blurry\nugly\nSteps: 30, Seed: 1",
+			want: embeddedParameters{Prompt: "a cat\non a mat", NegativePrompt: "blurry\nugly", Seed: seed(1), Steps: 30},
+		},
+		{
+			name: "quoted values with commas",
+			text: `a cat` + "\n" + `Steps: 25, Lora hashes: "cat: abc, mat: def", Sampler: Euler, CFG scale: 5, Seed: 3`,
+			want: embeddedParameters{Prompt: "a cat", Seed: seed(3), Steps: 25, CfgScale: 5, Sampler: "euler"},
+		},
+		{
+			name: "unknown sampler and random seed",
+			text: "a cat\nSteps: 20, Sampler: UniPC, Seed: -1",
+			want: embeddedParameters{Prompt: "a cat", Steps: 20},
+		},
+		{
+			name: "settings-like text inside the prompt",
+			text: "Steps: of a temple\na cat",
+			want: embeddedParameters{Prompt: "Steps: of a temple\na cat"},
+		},
+	}
+	for _, tt := range tests {
+		got := parseA1111Parameters(tt.text)
+		if !sameParameters(got, tt.want) {
+			t.Errorf("%s: got %s, want %s", tt.name, describe(got), describe(tt.want))
+		}
+	}
+}
+
+func sameParameters(a, b embeddedParameters) bool {
+	if (a.Seed == nil) != (b.Seed == nil) || (a.Seed != nil && *a.Seed != *b.Seed) {
+		return false
+	}
+	a.Seed, b.Seed = nil, nil
+	return a == b
+}
+
+// describe formats parameters with the seed's value instead of its address.
+func describe(p embeddedParameters) string {
+	seed := "none"
+	if p.Seed != nil {
+		seed = strconv.FormatInt(*p.Seed, 10)
+	}
+	p.Seed = nil
+	return fmt.Sprintf("%+v seed=%s", p, seed)
+}
+
+func TestSDSampler(t *testing.T) {
+	tests := map[string]string{
+		"euler":            "euler",
+		"Euler a":          "euler_a",
+		"DPM++ 2M":         "dpm++2m",
+		"DPM++ 2M Karras":  "dpm++2m",
+		"DPM++ 2S a":       "dpm++2s_a",
+		"DDIM":             "ddim_trailing",
+		"LCM":              "lcm",
+		"dpm++2mv2":        "dpm++2mv2",
+		"DPM++ SDE Karras": "",
+		"UniPC":            "",
+		"":                 "",
+	}
+	for name, want := range tests {
+		if got := sdSampler(name); got != want {
+			t.Errorf("sdSampler(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// pngChunk encodes a PNG chunk with its CRC.
+func pngChunk(typ string, body []byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(len(body)))
+	b.WriteString(typ)
+	b.Write(body)
+	binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(typ), body...)))
+	return b.Bytes()
+}
+
+func deflate(text string) []byte {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write([]byte(text))
+	w.Close()
+	return b.Bytes()
+}
+
+func TestPNGTextChunks(t *testing.T) {
+	var png bytes.Buffer
+	png.Write(pngSignature)
+	png.Write(pngChunk("IHDR", make([]byte, 13)))
+	png.Write(pngChunk("tEXt", []byte("parameters\x00a cat\nSteps: 20")))
+	png.Write(pngChunk("zTXt", append([]byte("comment\x00\x00"), deflate("compressed")...)))
+	png.Write(pngChunk("iTXt", []byte("title\x00\x00\x00en\x00Titel\x00plain")))
+	png.Write(pngChunk("iTXt", append([]byte("author\x00\x01\x00\x00\x00"), deflate("zipped")...)))
+	png.Write(pngChunk("tEXt", []byte("no separator")))
+	png.Write(pngChunk("IEND", nil))
+	png.Write(pngChunk("tEXt", []byte("after\x00the end")))
+
+	got := pngTextChunks(png.Bytes())
+	want := map[string]string{
+		"parameters": "a cat\nSteps: 20",
+		"comment":    "compressed",
+		"title":      "plain",
+		"author":     "zipped",
+	}
+	if len(got) != len(want) {
+		t.Errorf("got chunks %q, want %q", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("chunk %s: got %q, want %q", k, got[k], v)
+		}
+	}
+
+	if chunks := pngTextChunks([]byte("GIF89a")); chunks != nil {
+		t.Errorf("non-PNG data has chunks %q", chunks)
+	}
+	truncated := png.Bytes()[:len(pngSignature)+30]
+	if chunks := pngTextChunks(truncated); len(chunks) != 0 {
+		t.Errorf("truncated PNG has chunks %q", chunks)
+	}
+}
+
+func TestPNGParameters(t *testing.T) {
+	png := func(text string) []byte {
+		var b bytes.Buffer
+		b.Write(pngSignature)
+		b.Write(pngChunk("tEXt", []byte("parameters\x00"+text)))
+		b.Write(pngChunk("IEND", nil))
+		return b.Bytes()
+	}
+
+	p, ok := pngParameters(png(`{"prompt":"a cat","negative_prompt":"blurry","seed":9,"steps":12,"cfg_scale":3.5,"sampler":"Euler a"}`))
+	if !ok || p.Prompt != "a cat" || p.NegativePrompt != "blurry" || p.Seed == nil || *p.Seed != 9 || p.Steps != 12 || p.CfgScale != 3.5 || p.Sampler != "euler_a" {
+		t.Errorf("sidecar JSON: got %+v, %v", p, ok)
+	}
+	if p, ok := pngParameters(png("a dog\nSteps: 8")); !ok || p.Prompt != "a dog" || p.Steps != 8 {
+		t.Errorf("A1111 text: got %+v, %v", p, ok)
+	}
+	for _, text := range []string{"  ", "{not json"} {
+		if _, ok := pngParameters(png(text)); ok {
+			t.Errorf("%q: found parameters", text)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// defaultPoolName is the pool of profiles that name none. It runs one
+// generation at a time unless the config defines a pool of that name.
+const defaultPoolName = "default"
+
+// WorkerPool runs the generations of the model profiles assigned to it with
+// its own concurrency, so that a slow profile, like a Flux model taking a
+// minute per image, cannot hold up the fast ones of other pools.
+type WorkerPool struct {
+	Name string `json:"name"`
+
+	// Devices are the GPUs the pool's sd runs are restricted to, each a value
+	// of CUDA_VISIBLE_DEVICES and friends like "0" or "1,2". A run gets one
+	// of them; with more concurrent runs than devices, they are shared.
+	Devices []string `json:"devices,omitempty"`
+
+	// Concurrency is how many generations run at a time: one per device, or
+	// 1 without devices, if zero.
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+func (p WorkerPool) validate() error {
+	if !validName(p.Name) {
+		return fmt.Errorf("name must be up to 64 letters, digits, dashes and underscores")
+	}
+	if p.Concurrency < 0 {
+		return fmt.Errorf("concurrency must not be negative")
+	}
+	for _, d := range p.Devices {
+		if strings.TrimSpace(d) == "" {
+			return fmt.Errorf("devices must not be empty")
+		}
+	}
+	return nil
+}
+
+// concurrency returns the number of generations the pool runs at a time.
+func (p WorkerPool) concurrency() int {
+	if p.Concurrency > 0 {
+		return p.Concurrency
+	}
+	return max(1, len(p.Devices))
+}
+
+// deviceEnvVars restrict sd to the devices of a pool, for CUDA, ROCm and
+// Vulkan builds.
+var deviceEnvVars = []string{"CUDA_VISIBLE_DEVICES", "HIP_VISIBLE_DEVICES", "GGML_VK_VISIBLE_DEVICES"}
+
+// poolSlots hands out the run slots of a pool. A slot is the device set the
+// run gets, empty for pools without devices.
+type poolSlots struct {
+	pool  WorkerPool
+	slots chan string
+}
+
+var pools = map[string]*poolSlots{}
+
+// setupPools creates the slots of the configured pools and the default pool.
+func setupPools(configured []WorkerPool) {
+	pools = map[string]*poolSlots{}
+	configured = append(configured, WorkerPool{Name: defaultPoolName})
+	for _, p := range configured {
+		if _, ok := pools[p.Name]; ok {
+			continue // a configured default pool comes first
+		}
+		n := p.concurrency()
+		s := &poolSlots{pool: p, slots: make(chan string, n)}
+		for i := 0; i < n; i++ {
+			device := ""
+			if len(p.Devices) > 0 {
+				device = p.Devices[i%len(p.Devices)]
+			}
+			s.slots <- device
+		}
+		pools[p.Name] = s
+	}
+}
+
+// validatePools checks that the pools have unique names and that every
+// profile names a pool that exists.
+func validatePools(configured []WorkerPool, profiles []ModelProfile) error {
+	names := map[string]bool{defaultPoolName: true}
+	for i, p := range configured {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("pools[%d]: %w", i, err)
+		}
+		if names[p.Name] && p.Name != defaultPoolName {
+			return fmt.Errorf("pools[%d]: duplicate pool %q", i, p.Name)
+		}
+		names[p.Name] = true
+	}
+	for _, p := range profiles {
+		if p.Pool != "" && !names[p.Pool] {
+			return fmt.Errorf("model %q: unknown pool %q", p.Name, p.Pool)
+		}
+	}
+	return nil
+}
+
+// poolName returns the name of the pool the profile's generations run in.
+func (p ModelProfile) poolName() string {
+	if p.Pool == "" {
+		return defaultPoolName
+	}
+	return p.Pool
+}
+
+// poolOf returns the slots of the pool a generation runs in.
+func poolOf(gen generation) *poolSlots {
+	if s, ok := pools[resolveProfile(gen.Profile).poolName()]; ok {
+		return s
+	}
+	return pools[defaultPoolName]
+}
+
+// poolNames returns the names of all pools, sorted.
+func poolNames() []string {
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// poolConcurrency returns how many generations the named pool runs at a time.
+func poolConcurrency(name string) int {
+	if s, ok := pools[name]; ok {
+		return s.pool.concurrency()
+	}
+	return 1
+}
+
+// acquire waits for a free slot of the pool and returns its device set.
+func (s *poolSlots) acquire(ctx context.Context) (string, error) {
+	select {
+	case device := <-s.slots:
+		return device, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (s *poolSlots) release(device string) {
+	s.slots <- device
+}
+
+type deviceKey struct{}
+
+// withDevice records the device set of the slot a generation runs in.
+func withDevice(ctx context.Context, device string) context.Context {
+	return context.WithValue(ctx, deviceKey{}, device)
+}
+
+func deviceFrom(ctx context.Context) string {
+	device, _ := ctx.Value(deviceKey{}).(string)
+	return device
+}
+
+// deviceEnv returns env with the device variables set to the device set of
+// ctx, if there is one. A nil env stands for the adapter's environment.
+func deviceEnv(ctx context.Context, env []string) []string {
+	device := deviceFrom(ctx)
+	if device == "" {
+		return env
+	}
+	if env == nil {
+		env = os.Environ()
+	}
+	for _, name := range deviceEnvVars {
+		env = append(env, name+"="+device)
+	}
+	return env
+}
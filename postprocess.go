@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+const (
+	failurePolicyContinue = "continue"
+	failurePolicyFail     = "fail"
+)
+
+// PostProcessStep is an external command run on every generated image. Args may
+// reference {input} (the current image), {output} (where a replacement image may
+// be written), {dir} (the step's scratch directory) and {name} (the final file
+// name of the image). Steps that write nothing to {output}, such as a copy to a
+// NAS, leave the image unchanged.
+type PostProcessStep struct {
+	Name      string   `json:"name"`
+	Command   string   `json:"command"`
+	Args      []string `json:"args"`
+	Timeout   string   `json:"timeout"`
+	OnFailure string   `json:"on_failure"` // "continue" (default) or "fail"
+
+	timeout time.Duration
+}
+
+func (s *PostProcessStep) validate() error {
+	if s.Command == "" {
+		return fmt.Errorf("command is required")
+	}
+	if s.Name == "" {
+		s.Name = filepath.Base(s.Command)
+	}
+	s.timeout = 2 * time.Minute
+	if s.Timeout != "" {
+		d, err := time.ParseDuration(s.Timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q", s.Timeout)
+		}
+		s.timeout = d
+	}
+	switch s.OnFailure {
+	case "":
+		s.OnFailure = failurePolicyContinue
+	case failurePolicyContinue, failurePolicyFail:
+	default:
+		return fmt.Errorf("invalid on_failure %q, expected continue or fail", s.OnFailure)
+	}
+	return nil
+}
+
+// runPostProcess passes the image through the configured steps in order. A
+// failing step is skipped unless its policy is "fail", which aborts the pipeline.
+func runPostProcess(ctx context.Context, steps []PostProcessStep, imgData []byte, name string) ([]byte, error) {
+	for _, step := range steps {
+		out, err := step.run(ctx, imgData, name)
+		if err != nil {
+			if step.OnFailure == failurePolicyFail {
+				return nil, fmt.Errorf("post-process step %q failed: %w", step.Name, err)
+			}
+			fmt.Printf("Post-process step %q failed, continuing: %v\n", step.Name, err)
+			continue
+		}
+		if len(out) > 0 {
+			imgData = out
+		}
+	}
+	return imgData, nil
+}
+
+func (s PostProcessStep) run(ctx context.Context, imgData []byte, name string) ([]byte, error) {
+	tmpDir, err := os.MkdirTemp(tempDir, "post-process-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	inputPath := filepath.Join(tmpDir, "input.png")
+	outputPath := filepath.Join(tmpDir, "output.png")
+	if err := os.WriteFile(inputPath, imgData, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write input: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	args := replaceArgs(s.Args, map[string]string{
+		"input":  inputPath,
+		"output": outputPath,
+		"dir":    tmpDir,
+		"name":   name,
+	})
+
+	fmt.Printf("Running post-process step %q\n", s.Name)
+	cmd := exec.CommandContext(ctx, s.Command, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("command failed: %w", err)
+	}
+
+	out, err := os.ReadFile(outputPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read output: %w", err)
+	}
+	return out, nil
+}
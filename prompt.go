@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	promptWeightingNormalize = "normalize"
+	promptWeightingStrip     = "strip"
+	promptWeightingOff       = "off"
+)
+
+// weightSuffix matches the explicit weight at the end of a "(text:1.3)" group.
+var weightSuffix = regexp.MustCompile(`:\s*([+-]?(?:\d+\.?\d*|\.\d+))\s*$`)
+
+// normalizePromptWeights validates the attention syntax of a prompt — "(text)",
+// "(text:1.3)", "[text]" and backslash escapes — and rewrites it in the
+// canonical form sd's prompt parser expects. A bracket without a partner is an
+// error, or with escapeUnmatched kept as literal text by escaping it, as for
+// emoticons like "a smiling cat :)". With strip set, the weighting is removed
+// and only the text is kept, for models that don't support it.
+func normalizePromptWeights(prompt string, strip, escapeUnmatched bool) (string, error) {
+	p := promptParser{runes: []rune(prompt), strip: strip, escapeUnmatched: escapeUnmatched}
+	p.pairBrackets()
+	out, err := p.parse()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+type promptParser struct {
+	runes           []rune
+	pos             int
+	strip           bool
+	escapeUnmatched bool
+	paired          []bool // the bracket at the index has a partner
+}
+
+// pairBrackets matches every closing bracket with the nearest unmatched
+// opening one, if that is of the same kind.
+func (p *promptParser) pairBrackets() {
+	p.paired = make([]bool, len(p.runes))
+	var open []int
+	for i := 0; i < len(p.runes); i++ {
+		switch r := p.runes[i]; r {
+		case '\\':
+			i++
+		case '(', '[':
+			open = append(open, i)
+		case ')', ']':
+			if n := len(open); n > 0 && (p.runes[open[n-1]] == '(') == (r == ')') {
+				p.paired[open[n-1]], p.paired[i] = true, true
+				open = open[:n-1]
+			}
+		}
+	}
+}
+
+// parse consumes runes up to and including the closing bracket of the group,
+// or until the end of the prompt at the top level.
+func (p *promptParser) parse() (string, error) {
+	var b strings.Builder
+	for p.pos < len(p.runes) {
+		r := p.runes[p.pos]
+		switch r {
+		case '\\':
+			b.WriteRune(r)
+			p.pos++
+			if p.pos < len(p.runes) {
+				b.WriteRune(p.runes[p.pos])
+				p.pos++
+			}
+		case '(', '[':
+			if !p.paired[p.pos] {
+				if !p.escapeUnmatched {
+					return "", fmt.Errorf("unclosed %q at position %d", r, p.pos+1)
+				}
+				// Not a group: keep the bracket as text.
+				b.WriteString(`\` + string(r))
+				p.pos++
+				continue
+			}
+			start := p.pos
+			p.pos++
+			inner, err := p.parse()
+			if err != nil {
+				return "", err
+			}
+			group, err := p.group(r, inner, start)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(group)
+		case ')', ']':
+			if !p.paired[p.pos] {
+				if !p.escapeUnmatched {
+					return "", fmt.Errorf("unbalanced %q at position %d", r, p.pos+1)
+				}
+				b.WriteString(`\` + string(r))
+				p.pos++
+				continue
+			}
+			p.pos++
+			return b.String(), nil
+		default:
+			b.WriteRune(r)
+			p.pos++
+		}
+	}
+	return b.String(), nil
+}
+
+func (p *promptParser) group(open rune, inner string, start int) (string, error) {
+	text := inner
+	weight := ""
+	if open == '(' {
+		if m := weightSuffix.FindStringSubmatchIndex(inner); m != nil {
+			w, err := strconv.ParseFloat(inner[m[2]:m[3]], 64)
+			if err != nil || w < 0 {
+				return "", fmt.Errorf("invalid weight %q at position %d", inner[m[2]:m[3]], start+1)
+			}
+			text = inner[:m[0]]
+			weight = ":" + strconv.FormatFloat(w, 'f', -1, 64)
+		}
+	}
+	text = strings.TrimSpace(text)
+	if p.strip || text == "" {
+		return text, nil
+	}
+	if open == '(' {
+		return "(" + text + weight + ")", nil
+	}
+	return "[" + text + "]", nil
+}
+
+// breakKeyword separates prompt chunks that sd encodes independently.
+const breakKeyword = "BREAK"
+
+var (
+	breakPattern = regexp.MustCompile(`\s*\bBREAK\b\s*`)
+	tokenPattern = regexp.MustCompile(`[A-Za-z]+|\d|[^\sA-Za-z\d]`)
+)
+
+// estimateTokens roughly approximates the number of CLIP tokens in text:
+// every digit and punctuation mark is a token, and words take one token per
+// six letters. It errs on the high side for rare words.
+func estimateTokens(text string) int {
+	n := 0
+	for _, tok := range tokenPattern.FindAllString(text, -1) {
+		n += (len(tok) + 5) / 6
+	}
+	return n
+}
+
+// splitPromptChunks splits a prompt at its BREAK keywords.
+func splitPromptChunks(prompt string) []string {
+	var chunks []string
+	for _, chunk := range breakPattern.Split(prompt, -1) {
+		if chunk = strings.TrimSpace(chunk); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+// chunkPrompt normalizes the BREAK keywords of a prompt and, if maxTokens is
+// positive, inserts additional BREAKs so that no chunk exceeds the encoder
+// limit. Splits prefer comma boundaries and fall back to word boundaries.
+func chunkPrompt(prompt string, maxTokens int) (string, []string) {
+	var chunks []string
+	for _, chunk := range splitPromptChunks(prompt) {
+		if maxTokens <= 0 || estimateTokens(chunk) <= maxTokens {
+			chunks = append(chunks, chunk)
+			continue
+		}
+		chunks = append(chunks, packPieces(strings.SplitAfter(chunk, ","), maxTokens)...)
+	}
+	return strings.Join(chunks, " "+breakKeyword+" "), chunks
+}
+
+// packPieces greedily joins consecutive pieces into chunks of at most
+// maxTokens, splitting oversized pieces at word boundaries.
+func packPieces(pieces []string, maxTokens int) []string {
+	var chunks []string
+	var current strings.Builder
+	flush := func() {
+		if text := strings.TrimSpace(current.String()); text != "" {
+			chunks = append(chunks, strings.TrimSuffix(text, ","))
+		}
+		current.Reset()
+	}
+	for _, piece := range pieces {
+		if estimateTokens(piece) > maxTokens {
+			words := strings.Fields(piece)
+			if len(words) > 1 {
+				for i := range words {
+					words[i] += " "
+				}
+				flush()
+				chunks = append(chunks, packPieces(words, maxTokens)...)
+				continue
+			}
+		}
+		if estimateTokens(current.String()+piece) > maxTokens {
+			flush()
+		}
+		current.WriteString(piece)
+	}
+	flush()
+	return chunks
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizePromptWeights(t *testing.T) {
+	tests := []struct {
+		prompt, want, stripped string
+	}{
+		{"a cat", "a cat", "a cat"},
+		{"  a cat  ", "a cat", "a cat"},
+		{"a (red) cat", "a (red) cat", "a red cat"},
+		{"a ( red ) cat", "a (red) cat", "a red cat"},
+		{"a (red:1.3) cat", "a (red:1.3) cat", "a red cat"},
+		{"a (red : 1.30) cat", "a (red:1.3) cat", "a red cat"},
+		{"a (red:.5) cat", "a (red:0.5) cat", "a red cat"},
+		{"a [blurry] cat", "a [blurry] cat", "a blurry cat"},
+		{"a ((red)) cat", "a ((red)) cat", "a red cat"},
+		{"a ([red]:1.2) cat", "a ([red]:1.2) cat", "a red cat"},
+		{"a time of 10:30 (sharp)", "a time of 10:30 (sharp)", "a time of 10:30 sharp"},
+		{`a \(literal\) cat`, `a \(literal\) cat`, `a \(literal\) cat`},
+		{`a [red\]] cat`, `a [red\]] cat`, `a red\] cat`},
+		{`trailing \`, `trailing \`, `trailing \`},
+	}
+	for _, tt := range tests {
+		got, err := normalizePromptWeights(tt.prompt, false, false)
+		if err != nil || got != tt.want {
+			t.Errorf("normalize %q: got %q, %v, want %q", tt.prompt, got, err, tt.want)
+		}
+		got, err = normalizePromptWeights(tt.prompt, true, false)
+		if err != nil || got != tt.stripped {
+			t.Errorf("strip %q: got %q, %v, want %q", tt.prompt, got, err, tt.stripped)
+		}
+	}
+}
+
+func TestNormalizePromptWeightsErrors(t *testing.T) {
+	tests := []struct {
+		prompt, err string
+	}{
+		{"a smiling cat :)", `unbalanced ')' at position 16`},
+		{"(smile", `unclosed '(' at position 1`},
+		{"a [cat", `unclosed '[' at position 3`},
+		{"a cat]", `unbalanced ']' at position 6`},
+		{"a (red] cat", `unclosed '(' at position 3`},
+		{"((red)", `unclosed '(' at position 1`},
+		{"(red))", `unbalanced ')' at position 6`},
+		{"a (red:-1) cat", `invalid weight "-1" at position 3`},
+	}
+	for _, tt := range tests {
+		_, err := normalizePromptWeights(tt.prompt, false, false)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: got error %v, want %s", tt.prompt, err, tt.err)
+		}
+	}
+}
+
+func TestNormalizePromptWeightsEscapeUnmatched(t *testing.T) {
+	tests := []struct {
+		prompt, want string
+	}{
+		{"a smiling cat :)", `a smiling cat :\)`},
+		{"(smile", `\(smile`},
+		{"a (red] cat", `a \(red\] cat`},
+		{"((red)", `\((red)`},
+		{"(red)) :(", `(red)\) :\(`},
+		{"a (red:1.3) cat", "a (red:1.3) cat"},
+	}
+	for _, tt := range tests {
+		got, err := normalizePromptWeights(tt.prompt, false, true)
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.prompt, got, err, tt.want)
+		}
+	}
+
+	// Many unclosed brackets must not make parsing blow up.
+	prompt := strings.Repeat("(", 10000) + "x"
+	got, err := normalizePromptWeights(prompt, false, true)
+	if err != nil || got != strings.Repeat(`\(`, 10000)+"x" {
+		t.Errorf("%d unclosed brackets: got %d bytes, %v", 10000, len(got), err)
+	}
+}
+
+func TestChunkPrompt(t *testing.T) {
+	tests := []struct {
+		prompt    string
+		maxTokens int
+		want      string
+	}{
+		{"a cat", 0, "a cat"},
+		{"a cat BREAK  a dog", 0, "a cat BREAK a dog"},
+		{"BREAK a cat BREAK", 0, "a cat"},
+		{"BREAKFAST with a cat", 0, "BREAKFAST with a cat"},
+		{"a red cat, a blue dog", 4, "a red cat BREAK a blue dog"},
+		{"one two three four five", 2, "one two BREAK three four BREAK five"},
+	}
+	for _, tt := range tests {
+		if got, _ := chunkPrompt(tt.prompt, tt.maxTokens); got != tt.want {
+			t.Errorf("chunkPrompt(%q, %d) = %q, want %q", tt.prompt, tt.maxTokens, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backend is a remote adapter instance that jobs can be dispatched to in proxy
+// mode.
+type backend struct {
+	url      *url.URL
+	proxy    *httputil.ReverseProxy
+	healthy  atomic.Bool
+	inFlight atomic.Int64
+}
+
+var (
+	backends    []*backend
+	nextBackend atomic.Uint64
+)
+
+func parseBackends(list string) ([]*backend, error) {
+	var result []*backend
+	for _, raw := range strings.Split(list, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(strings.TrimSuffix(raw, "/"))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid backend URL %q", raw)
+		}
+		b := &backend{url: u, proxy: httputil.NewSingleHostReverseProxy(u)}
+		b.healthy.Store(true)
+		result = append(result, b)
+	}
+	return result, nil
+}
+
+// checkBackendHealth polls /health of every backend until ctx is done.
+func checkBackendHealth(ctx context.Context, interval time.Duration) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for {
+		for _, b := range backends {
+			resp, err := client.Get(b.url.String() + "/health")
+			healthy := err == nil && resp.StatusCode == http.StatusOK
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if healthy != b.healthy.Swap(healthy) {
+				log.Printf("Backend %s is now healthy=%v", b.url, healthy)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// leastBusyBackend returns the healthy backend with the fewest jobs in flight.
+// The scan starts at a rotating offset so that ties are spread round-robin.
+func leastBusyBackend() *backend {
+	var best *backend
+	start := int(nextBackend.Add(1))
+	for i := range backends {
+		b := backends[(start+i)%len(backends)]
+		if !b.healthy.Load() {
+			continue
+		}
+		if best == nil || b.inFlight.Load() < best.inFlight.Load() {
+			best = b
+		}
+	}
+	return best
+}
+
+func (b *backend) serve(w http.ResponseWriter, r *http.Request) {
+	b.inFlight.Add(1)
+	defer b.inFlight.Add(-1)
+	b.proxy.ServeHTTP(w, r)
+}
+
+// handleProxyJob dispatches a generation request to the least busy backend.
+func handleProxyJob(w http.ResponseWriter, r *http.Request) {
+	b := leastBusyBackend()
+	if b == nil {
+		http.Error(w, "No healthy backend available", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Printf("Dispatching %s to %s (%d in flight)\n", r.URL.Path, b.url, b.inFlight.Load())
+	b.serve(w, r)
+}
+
+// handleProxyOwned forwards requests about an existing image (/generated/... and
+// /v1/generations/...) to the backend that stores it.
+func handleProxyOwned(w http.ResponseWriter, r *http.Request) {
+	var name string
+	if path, ok := strings.CutPrefix(r.URL.Path, "/generated/"); ok {
+		name, _ = splitImagePath(path)
+	} else {
+		path = strings.TrimPrefix(r.URL.Path, "/v1/generations/")
+		if i := strings.LastIndex(path, "/"); i >= 0 {
+			name = path[:i]
+		}
+		if !strings.HasSuffix(name, ".png") {
+			name += ".png"
+		}
+	}
+	if !validImageName(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	b := findImageOwner(r, name)
+	if b == nil {
+		http.NotFound(w, r)
+		return
+	}
+	b.serve(w, r)
+}
+
+// handleProxyJobStatus answers GET /v1/jobs/{id} with the status of the
+// backend running the job.
+func handleProxyJobStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, b := range backends {
+		if !b.healthy.Load() {
+			continue
+		}
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, b.url.String()+r.URL.Path, nil)
+		if err != nil {
+			continue
+		}
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+			io.Copy(w, resp.Body)
+			resp.Body.Close()
+			return
+		}
+		resp.Body.Close()
+	}
+	http.Error(w, "Unknown or finished job", http.StatusNotFound)
+}
+
+// handleProxyUnsupported rejects endpoints that depend on the state of a
+// single backend, like the history, collections and batches, which the proxy cannot
+// route or merge.
+func handleProxyUnsupported(w http.ResponseWriter, r *http.Request) {
+	msg := fmt.Sprintf("%s is not available through the proxy", r.URL.Path)
+	if strings.HasPrefix(r.URL.Path, "/v1/uploads") {
+		msg += "; send images inline as data URLs instead"
+	}
+	http.Error(w, msg, http.StatusNotImplemented)
+}
+
+// findImageOwner asks every healthy backend for the image and returns the first
+// one that has it. The caller's credentials are passed on, as backends with
+// tenant isolation only find the caller's own images.
+func findImageOwner(r *http.Request, name string) *backend {
+	ctx := r.Context()
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, b := range backends {
+		if !b.healthy.Load() {
+			continue
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, b.url.String()+"/generated/"+name, nil)
+		if err != nil {
+			continue
+		}
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return b
+		}
+	}
+	return nil
+}
+
+// handleProxyModels aggregates the model lists of all healthy backends, asked
+// with the caller's credentials, and keeps the models the caller may use.
+func handleProxyModels(w http.ResponseWriter, r *http.Request) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := map[string]bool{}
+	list := modelList{Object: "list", Data: []modelInfo{}}
+	for _, b := range backends {
+		if !b.healthy.Load() {
+			continue
+		}
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, b.url.String()+"/v1/models", nil)
+			if err != nil {
+				return
+			}
+			if auth := r.Header.Get("Authorization"); auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				log.Printf("Failed to list models of %s: %v", b.url, err)
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				log.Printf("Failed to list models of %s: %s", b.url, resp.Status)
+				return
+			}
+			var models modelList
+			if err := json.NewDecoder(resp.Body).Decode(&models); err != nil {
+				log.Printf("Invalid model list from %s: %v", b.url, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, m := range models.Data {
+				if !seen[m.ID] && modelAllowed(r.Context(), m.ID) {
+					seen[m.ID] = true
+					list.Data = append(list.Data, m)
+				}
+			}
+		}(b)
+	}
+	wg.Wait()
+	writeJSON(w, list)
+}
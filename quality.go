@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// QualityTier adjusts a generation for a quality/latency trade-off. Zero
+// values leave the corresponding parameter alone.
+type QualityTier struct {
+	Steps    int     `json:"steps,omitempty"`
+	CfgScale float64 `json:"cfg_scale,omitempty"`
+	Scale    float64 `json:"scale,omitempty"`  // output size factor, text-to-image only
+	Model    string  `json:"model,omitempty"`  // profile to run instead
+	Prompt   string  `json:"prompt,omitempty"` // appended to the prompt
+}
+
+// ImageStyle is a look requested with the images API's style parameter,
+// given by prompt modifiers and sampling settings.
+type ImageStyle struct {
+	Prompt         string  `json:"prompt,omitempty"`          // appended to the prompt
+	NegativePrompt string  `json:"negative_prompt,omitempty"` // appended to the negative prompt
+	Steps          int     `json:"steps,omitempty"`
+	CfgScale       float64 `json:"cfg_scale,omitempty"`
+}
+
+// defaultQualityTiers are used for tiers missing from the "quality" config
+// section.
+var defaultQualityTiers = map[string]QualityTier{
+	"draft":    {Steps: 10, Scale: 0.75},
+	"standard": {},
+	"hd":       {Steps: 50},
+}
+
+// defaultImageStyles are used for styles missing from the "styles" config
+// section, covering the images API's vivid and natural.
+var defaultImageStyles = map[string]ImageStyle{
+	"vivid":   {Prompt: "vivid colors, dramatic lighting, high contrast, hyper-detailed"},
+	"natural": {Prompt: "natural lighting, realistic, muted colors", NegativePrompt: "oversaturated, hyper-real"},
+}
+
+// qualityTier looks up a tier by name, preferring the ones configured for the
+// profile, then the configured ones.
+func qualityTier(profile ModelProfile, name string) (QualityTier, error) {
+	if tier, ok := lookupSetting(name, profile.Quality, config.Quality, defaultQualityTiers); ok {
+		return tier, nil
+	}
+	return QualityTier{}, fmt.Errorf("unknown quality %q, expected one of %s", name, settingNames(profile.Quality, config.Quality, defaultQualityTiers))
+}
+
+// imageStyle looks up a style by name, preferring the ones configured for the
+// profile, then the configured ones.
+func imageStyle(profile ModelProfile, name string) (ImageStyle, error) {
+	if style, ok := lookupSetting(name, profile.Styles, config.Styles, defaultImageStyles); ok {
+		return style, nil
+	}
+	return ImageStyle{}, fmt.Errorf("unknown style %q, expected one of %s", name, settingNames(profile.Styles, config.Styles, defaultImageStyles))
+}
+
+// lookupSetting returns the named entry of the first map that has it.
+func lookupSetting[T any](name string, maps ...map[string]T) (T, bool) {
+	for _, m := range maps {
+		if v, ok := m[name]; ok {
+			return v, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// settingNames lists the names in the maps, sorted and without duplicates.
+func settingNames[T any](maps ...map[string]T) string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range maps {
+		for n := range m {
+			if !seen[n] {
+				seen[n] = true
+				names = append(names, n)
+			}
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (t QualityTier) validate() error {
+	if t.Steps < 0 || t.Scale < 0 || t.CfgScale < 0 {
+		return fmt.Errorf("steps, cfg_scale and scale must not be negative")
+	}
+	if t.Model != "" {
+		if _, ok := findProfile(t.Model); !ok {
+			return fmt.Errorf("unknown model profile %q", t.Model)
+		}
+	}
+	return nil
+}
+
+// apply adjusts gen to the tier. The size is only scaled without init or
+// reference images, whose size the output has to match.
+func (t QualityTier) apply(gen generation) generation {
+	if t.Steps > 0 {
+		gen.Steps = t.Steps
+	}
+	if t.CfgScale > 0 {
+		gen.CfgScale = t.CfgScale
+	}
+	gen.Prompt = appendModifier(gen.Prompt, t.Prompt)
+	if t.Scale > 0 && len(gen.Images) == 0 && len(gen.InitImage) == 0 {
+		gen.Size = scaleResolution(gen.Size, t.Scale)
+	}
+	if t.Model != "" {
+		gen.Profile = t.Model
+	}
+	return gen
+}
+
+func (s ImageStyle) validate() error {
+	if s.Steps < 0 || s.CfgScale < 0 {
+		return fmt.Errorf("steps and cfg_scale must not be negative")
+	}
+	return nil
+}
+
+// apply adjusts gen to the style.
+func (s ImageStyle) apply(gen generation) generation {
+	if s.Steps > 0 {
+		gen.Steps = s.Steps
+	}
+	if s.CfgScale > 0 {
+		gen.CfgScale = s.CfgScale
+	}
+	gen.Prompt = appendModifier(gen.Prompt, s.Prompt)
+	gen.NegativePrompt = appendModifier(gen.NegativePrompt, s.NegativePrompt)
+	return gen
+}
+
+// appendModifier appends a comma-separated prompt modifier.
+func appendModifier(prompt, modifier string) string {
+	switch {
+	case modifier == "":
+		return prompt
+	case prompt == "":
+		return modifier
+	}
+	return prompt + ", " + modifier
+}
+
+// scaleResolution scales r by factor, keeping both sides multiples of 64.
+func scaleResolution(r resolution, factor float64) resolution {
+	side := func(v int) int {
+		return max(64, int(math.Round(float64(v)*factor/64))*64)
+	}
+	return resolution{Width: side(r.Width), Height: side(r.Height)}
+}
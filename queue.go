@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+var errUnknownJob = errors.New("unknown job")
+
+// jobQueue carries generations from coordinators to workers and their results
+// back. Push and Wait are used by the coordinator that accepted the request;
+// Pop and Complete by the coordinator a worker happens to talk to, which with
+// a shared backend need not be the same one.
+type jobQueue interface {
+	// Push enqueues a job; it is dropped once ctx is done.
+	Push(ctx context.Context, job workerJob) error
+	// Pop returns the next job of one of the given worker pools, or of any
+	// pool if none are given, or nil if none arrived within timeout.
+	Pop(ctx context.Context, pools []string, timeout time.Duration) (*workerJob, error)
+	// Complete delivers the result of a job.
+	Complete(ctx context.Context, id string, res workerResult) error
+	// Wait blocks until the result of a job is delivered.
+	Wait(ctx context.Context, id string, timeout time.Duration) (workerResult, error)
+}
+
+var queue jobQueue = newMemoryQueue(1024)
+
+type pendingGeneration struct {
+	job    workerJob
+	ctx    context.Context
+	result chan workerResult
+}
+
+// memoryQueue is the default single-process jobQueue.
+type memoryQueue struct {
+	size    int
+	mu      sync.Mutex
+	queued  []*pendingGeneration // in arrival order
+	pushed  chan struct{}        // closed and replaced when a job is queued
+	waiting map[string]*pendingGeneration
+}
+
+func newMemoryQueue(size int) *memoryQueue {
+	return &memoryQueue{
+		size:    size,
+		pushed:  make(chan struct{}),
+		waiting: map[string]*pendingGeneration{},
+	}
+}
+
+func (q *memoryQueue) Push(ctx context.Context, job workerJob) error {
+	pending := &pendingGeneration{job: job, ctx: ctx, result: make(chan workerResult, 1)}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.queued) >= q.size {
+		return fmt.Errorf("work queue is full")
+	}
+	q.waiting[job.ID] = pending
+	q.queued = append(q.queued, pending)
+	close(q.pushed)
+	q.pushed = make(chan struct{})
+	return nil
+}
+
+func (q *memoryQueue) Pop(ctx context.Context, pools []string, timeout time.Duration) (*workerJob, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		job, pushed := q.take(pools)
+		if job != nil {
+			return job, nil
+		}
+		select {
+		case <-pushed:
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// take removes the first queued job of the pools and returns it, or returns
+// a channel closed when the next job is queued if there is none.
+func (q *memoryQueue) take(pools []string) (*workerJob, chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := 0; i < len(q.queued); i++ {
+		pending := q.queued[i]
+		// The client may have given up while the job was queued.
+		if pending.ctx.Err() != nil {
+			q.queued = append(q.queued[:i], q.queued[i+1:]...)
+			delete(q.waiting, pending.job.ID)
+			i--
+			continue
+		}
+		if len(pools) == 0 || slices.Contains(pools, pending.job.Pool) {
+			q.queued = append(q.queued[:i], q.queued[i+1:]...)
+			return &pending.job, nil
+		}
+	}
+	return nil, q.pushed
+}
+
+func (q *memoryQueue) Complete(ctx context.Context, id string, res workerResult) error {
+	q.mu.Lock()
+	pending, ok := q.waiting[id]
+	q.mu.Unlock()
+	if !ok {
+		return errUnknownJob
+	}
+	select {
+	case pending.result <- res:
+	default: // already completed
+	}
+	return nil
+}
+
+func (q *memoryQueue) Wait(ctx context.Context, id string, timeout time.Duration) (workerResult, error) {
+	defer q.forget(id)
+	q.mu.Lock()
+	pending, ok := q.waiting[id]
+	q.mu.Unlock()
+	if !ok {
+		return workerResult{}, errUnknownJob
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-pending.result:
+		return res, nil
+	case <-timer.C:
+		return workerResult{}, fmt.Errorf("job %s timed out after %s", id, timeout)
+	case <-ctx.Done():
+		return workerResult{}, ctx.Err()
+	}
+}
+
+func (q *memoryQueue) forget(id string) {
+	q.mu.Lock()
+	delete(q.waiting, id)
+	q.mu.Unlock()
+}
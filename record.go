@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// jobRecording is what -record-dir keeps of a job to reproduce it with the
+// replay command: the request as parsed, the generations as resolved and the
+// sd command lines they ran as.
+type jobRecording struct {
+	JobID          string       `json:"job_id"`
+	CreatedAt      time.Time    `json:"created_at"`
+	User           string       `json:"user,omitempty"`
+	Request        interface{}  `json:"request,omitempty"`
+	Model          string       `json:"model,omitempty"`
+	PromptTemplate string       `json:"prompt_template,omitempty"`
+	RestoreFaces   bool         `json:"restore_faces,omitempty"`
+	Grid           bool         `json:"grid,omitempty"`
+	XYGrid         *xyGrid      `json:"xy_grid,omitempty"`
+	Runs           []generation `json:"runs"`
+	Argv           [][]string   `json:"argv"`
+	Outputs        []string     `json:"outputs,omitempty"`
+	Error          string       `json:"error,omitempty"`
+}
+
+type recordingKey struct{}
+
+// newJobRecording starts the recording of a job. The generations are recorded
+// with the defaults filled in, which may be different when replaying.
+func newJobRecording(ctx context.Context, j job, runs []generation) *jobRecording {
+	resolved := make([]generation, len(runs))
+	for i, run := range runs {
+		resolved[i] = run.withDefaults()
+	}
+	return &jobRecording{
+		JobID:          j.id,
+		CreatedAt:      time.Now().UTC(),
+		User:           identityFrom(ctx).User,
+		Request:        j.request,
+		Model:          j.model,
+		PromptTemplate: j.promptTemplate,
+		RestoreFaces:   j.restoreFaces,
+		Grid:           j.grid,
+		XYGrid:         j.xy,
+		Runs:           resolved,
+	}
+}
+
+func withRecording(ctx context.Context, rec *jobRecording) context.Context {
+	return context.WithValue(ctx, recordingKey{}, rec)
+}
+
+func recordingFrom(ctx context.Context) *jobRecording {
+	rec, _ := ctx.Value(recordingKey{}).(*jobRecording)
+	return rec
+}
+
+// recordArgv notes an sd command line of the job being recorded, if any.
+// Generations of a job run one after another, so no locking is needed.
+func recordArgv(ctx context.Context, argv []string) {
+	if rec := recordingFrom(ctx); rec != nil {
+		rec.Argv = append(rec.Argv, argv)
+	}
+}
+
+// save writes the recording to -record-dir as {job id}.json.
+func (rec *jobRecording) save(result jobResult, err error) {
+	for _, meta := range result.Images {
+		rec.Outputs = append(rec.Outputs, meta.Name)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	data, jsonErr := json.MarshalIndent(rec, "", "  ")
+	if jsonErr != nil {
+		log.Printf("Failed to encode recording of job %s: %v", rec.JobID, jsonErr)
+		return
+	}
+	path := filepath.Join(recordDir, rec.JobID+".json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		log.Printf("Failed to write recording %s: %v", path, err)
+	}
+}
+
+// job returns the recorded job, to run it again.
+func (rec *jobRecording) job() (job, error) {
+	if len(rec.Runs) == 0 {
+		return job{}, fmt.Errorf("recording has no generations")
+	}
+	j := job{
+		gen:            rec.Runs[0],
+		promptTemplate: rec.PromptTemplate,
+		model:          rec.Model,
+		restoreFaces:   rec.RestoreFaces,
+		grid:           rec.Grid,
+		xy:             rec.XYGrid,
+	}
+	if len(rec.Runs) > 1 || rec.XYGrid != nil {
+		j.runs = rec.Runs
+	}
+	return j, nil
+}
+
+// runReplay runs a recorded job again, as the replay command, and compares the
+// sd command lines with the recorded ones. It returns the exit code.
+func runReplay(ctx context.Context, path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Failed to read recording: %v", err)
+		return 1
+	}
+	var rec jobRecording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		log.Printf("Invalid recording %s: %v", path, err)
+		return 1
+	}
+	j, err := rec.job()
+	if err != nil {
+		log.Printf("Invalid recording %s: %v", path, err)
+		return 1
+	}
+	fmt.Printf("Replaying job %s, recorded %s\n", rec.JobID, rec.CreatedAt.Format(time.RFC3339))
+	if rec.Error != "" {
+		fmt.Printf("The recorded run failed: %s\n", rec.Error)
+	}
+
+	replay := &jobRecording{}
+	ctx = withIdentity(withRecording(ctx, replay), identity{User: rec.User, Method: "replay"})
+	result, err := runJob(ctx, j)
+	if err != nil {
+		fmt.Printf("Replay failed: %v\n", err)
+		return 1
+	}
+	for _, meta := range result.Images {
+		fmt.Printf("Output: %s (seed %d)\n", meta.Name, meta.Seed)
+	}
+
+	same := len(replay.Argv) == len(rec.Argv)
+	for i := 0; same && i < len(rec.Argv); i++ {
+		same = strings.Join(replay.Argv[i], "\x00") == strings.Join(rec.Argv[i], "\x00")
+	}
+	if same {
+		fmt.Println("sd ran with the recorded arguments")
+		return 0
+	}
+	fmt.Println("sd arguments differ from the recording:")
+	for i := 0; i < max(len(rec.Argv), len(replay.Argv)); i++ {
+		if i < len(rec.Argv) {
+			fmt.Printf("  recorded: %q\n", rec.Argv[i])
+		}
+		if i < len(replay.Argv) {
+			fmt.Printf("  replayed: %q\n", replay.Argv[i])
+		}
+	}
+	return 0
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultTTL is how long an uncollected job result is kept in Redis.
+const resultTTL = time.Hour
+
+// redisClient speaks just enough of the RESP protocol for the job queue. Each
+// command uses its own connection, which keeps blocking pops simple and is
+// cheap at the rate jobs arrive.
+type redisClient struct {
+	addr     string
+	password string
+}
+
+var errRedisNil = errors.New("redis: nil")
+
+func (c *redisClient) dial(ctx context.Context) (net.Conn, *bufio.Reader, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	if c.password != "" {
+		if _, err := redisRoundTrip(conn, r, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("redis auth failed: %w", err)
+		}
+	}
+	return conn, r, nil
+}
+
+// do runs a single command. A blocking command may take up to wait longer than
+// usual before the connection times out.
+func (c *redisClient) do(ctx context.Context, wait time.Duration, args ...string) (interface{}, error) {
+	conn, r, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10*time.Second + wait))
+	// Closing the connection aborts a blocking command when ctx is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	reply, err := redisRoundTrip(conn, r, args...)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return reply, err
+}
+
+func redisRoundTrip(w io.Writer, r *bufio.Reader, args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(r)
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil && err != errRedisNil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// redisQueue is a jobQueue shared by all coordinator replicas pointing at the
+// same Redis. Queued jobs survive restarts of individual replicas.
+type redisQueue struct {
+	client *redisClient
+	prefix string
+	// entries maps the IDs of jobs pushed by this process to their
+	// redisEntry, so that Wait can withdraw a job whose client gave up.
+	entries sync.Map
+}
+
+// queuedJob is a job as stored in Redis; jobs past their deadline are no
+// longer waited for and are skipped.
+type queuedJob struct {
+	workerJob
+	Deadline time.Time `json:"deadline"`
+}
+
+func newRedisQueue(addr, password, prefix string) *redisQueue {
+	return &redisQueue{client: &redisClient{addr: addr, password: password}, prefix: prefix}
+}
+
+// redisEntry is a job pushed to the list key as value.
+type redisEntry struct {
+	key, value string
+}
+
+// queueKey returns the list holding the queued jobs of a worker pool; the
+// default pool keeps the key of the single queue there was before pools.
+func (q *redisQueue) queueKey(pool string) string {
+	if pool == "" || pool == defaultPoolName {
+		return q.prefix + ":queue"
+	}
+	return q.prefix + ":queue:" + pool
+}
+
+func (q *redisQueue) resultKey(id string) string {
+	return q.prefix + ":result:" + id
+}
+
+func (q *redisQueue) Push(ctx context.Context, job workerJob) error {
+	entry, err := json.Marshal(queuedJob{workerJob: job, Deadline: time.Now().Add(workerJobTimeout)})
+	if err != nil {
+		return err
+	}
+	key := q.queueKey(job.Pool)
+	if _, err := q.client.do(ctx, 0, "LPUSH", key, string(entry)); err != nil {
+		return err
+	}
+	q.entries.Store(job.ID, redisEntry{key, string(entry)})
+	return nil
+}
+
+func (q *redisQueue) Pop(ctx context.Context, pools []string, timeout time.Duration) (*workerJob, error) {
+	if len(pools) == 0 {
+		pools = poolNames()
+	}
+	var keys []string
+	for _, pool := range pools {
+		keys = append(keys, q.queueKey(pool))
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining < time.Second {
+			return nil, nil
+		}
+		args := append([]string{"BRPOP"}, keys...)
+		reply, err := q.client.do(ctx, remaining, append(args, strconv.Itoa(int(remaining.Seconds())))...)
+		if err == errRedisNil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return nil, fmt.Errorf("redis: unexpected BRPOP reply")
+		}
+		var job queuedJob
+		if err := json.Unmarshal([]byte(items[1].(string)), &job); err != nil {
+			return nil, fmt.Errorf("invalid queued job: %w", err)
+		}
+		if time.Now().After(job.Deadline) {
+			continue
+		}
+		return &job.workerJob, nil
+	}
+}
+
+func (q *redisQueue) Complete(ctx context.Context, id string, res workerResult) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	if _, err := q.client.do(ctx, 0, "LPUSH", q.resultKey(id), string(data)); err != nil {
+		return err
+	}
+	_, err = q.client.do(ctx, 0, "EXPIRE", q.resultKey(id), strconv.Itoa(int(resultTTL.Seconds())))
+	return err
+}
+
+func (q *redisQueue) Wait(ctx context.Context, id string, timeout time.Duration) (workerResult, error) {
+	var res workerResult
+	entry, _ := q.entries.LoadAndDelete(id)
+	reply, err := q.client.do(ctx, timeout, "BRPOP", q.resultKey(id), strconv.Itoa(max(1, int(timeout.Seconds()))))
+	if err != nil {
+		// Withdraw the job if no worker has taken it yet.
+		if entry, ok := entry.(redisEntry); ok {
+			q.client.do(context.Background(), 0, "LREM", entry.key, "1", entry.value)
+		}
+		if err == errRedisNil {
+			return res, fmt.Errorf("job %s timed out after %s", id, timeout)
+		}
+		return res, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return res, fmt.Errorf("redis: unexpected BRPOP reply")
+	}
+	if err := json.Unmarshal([]byte(items[1].(string)), &res); err != nil {
+		return res, fmt.Errorf("invalid job result: %w", err)
+	}
+	return res, nil
+}
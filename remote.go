@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdapiRequest is the txt2img/img2img request of the AUTOMATIC1111-style API
+// served by stable-diffusion.cpp's sd-server and other remote runners.
+type sdapiRequest struct {
+	Prompt            string   `json:"prompt"`
+	NegativePrompt    string   `json:"negative_prompt,omitempty"`
+	Width             int      `json:"width"`
+	Height            int      `json:"height"`
+	Steps             int      `json:"steps"`
+	CfgScale          float64  `json:"cfg_scale"`
+	Seed              int64    `json:"seed"`
+	SamplerName       string   `json:"sampler_name"`
+	BatchSize         int      `json:"batch_size"`
+	InitImages        []string `json:"init_images,omitempty"`
+	Mask              string   `json:"mask,omitempty"`
+	DenoisingStrength float64  `json:"denoising_strength,omitempty"`
+}
+
+type sdapiResponse struct {
+	Images []string `json:"images"`
+}
+
+// runRemoteGeneration runs a generation on the sd server of a profile instead
+// of the local binary. meta describes the generation as for a local run.
+func runRemoteGeneration(ctx context.Context, serverURL string, gen generation, meta imageMetadata) ([]generatedImage, error) {
+	req := sdapiRequest{
+		Prompt:         gen.Prompt,
+		NegativePrompt: gen.NegativePrompt,
+		Width:          gen.Size.Width,
+		Height:         gen.Size.Height,
+		Steps:          gen.Steps,
+		CfgScale:       gen.CfgScale,
+		Seed:           gen.Seed,
+		SamplerName:    gen.Sampler,
+		BatchSize:      gen.BatchCount,
+	}
+	if len(gen.StyleImage) > 0 {
+		return nil, fmt.Errorf("style images are not supported by the sd server")
+	}
+	endpoint := "/sdapi/v1/txt2img"
+	if len(gen.InitImage) > 0 {
+		endpoint = "/sdapi/v1/img2img"
+		req.InitImages = []string{base64.StdEncoding.EncodeToString(gen.InitImage)}
+		req.DenoisingStrength = gen.Strength
+		meta.Mode = "img2img"
+		meta.Strength = gen.Strength
+	} else if len(gen.Images) > 0 {
+		last := gen.Images[len(gen.Images)-1]
+		maskData, hasMask, err := alphaMask(last)
+		if err != nil {
+			return nil, err
+		}
+		if !hasMask {
+			return nil, fmt.Errorf("reference image edits are not supported by the sd server")
+		}
+		strength, err := strconv.ParseFloat(inpaintStrength, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -inpaint-strength: %w", err)
+		}
+		endpoint = "/sdapi/v1/img2img"
+		req.InitImages = []string{base64.StdEncoding.EncodeToString(last)}
+		req.Mask = base64.StdEncoding.EncodeToString(maskData)
+		req.DenoisingStrength = strength
+		meta.Mode = "inpaint"
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(serverURL, "/")+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("sd server request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("sd server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var res sdapiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("failed to decode sd server response: %w", err)
+	}
+	meta.Timings.Generation = time.Since(start).Seconds()
+	if len(res.Images) == 0 {
+		return nil, fmt.Errorf("sd server returned no images")
+	}
+
+	results := make([]generatedImage, 0, len(res.Images))
+	for i, encoded := range res.Images {
+		// Some runners return data URLs.
+		if _, after, ok := strings.Cut(encoded, ";base64,"); ok {
+			encoded = after
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image %d of the sd server: %w", i, err)
+		}
+		meta.Seed = gen.Seed + int64(i)
+		results = append(results, generatedImage{Data: data, Meta: meta})
+	}
+	return results, nil
+}
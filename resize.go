@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type resolution struct {
+	Width  int
+	Height int
+}
+
+func (r resolution) String() string {
+	return fmt.Sprintf("%dx%d", r.Width, r.Height)
+}
+
+func parseResolution(s string) (resolution, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(s)), "x")
+	if len(parts) != 2 {
+		return resolution{}, fmt.Errorf("invalid resolution %q, expected WIDTHxHEIGHT", s)
+	}
+	w, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || w <= 0 {
+		return resolution{}, fmt.Errorf("invalid width in resolution %q", s)
+	}
+	h, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || h <= 0 {
+		return resolution{}, fmt.Errorf("invalid height in resolution %q", s)
+	}
+	return resolution{Width: w, Height: h}, nil
+}
+
+func parseResolutionList(s string) ([]resolution, error) {
+	var list []resolution
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		res, err := parseResolution(item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, res)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no resolutions given")
+	}
+	return list, nil
+}
+
+// nearestResolution picks the allowed resolution whose aspect ratio is closest to w/h.
+func nearestResolution(w, h int, allowed []resolution) resolution {
+	target := math.Log(float64(w) / float64(h))
+	best := allowed[0]
+	bestDiff := math.Inf(1)
+	for _, res := range allowed {
+		diff := math.Abs(math.Log(float64(res.Width)/float64(res.Height)) - target)
+		if diff < bestDiff {
+			best, bestDiff = res, diff
+		}
+	}
+	return best
+}
+
+// maxInputPixels bounds the images clients send. A small file can declare a
+// huge canvas, which decoding would allocate in full.
+const maxInputPixels = 40_000_000
+
+// decodeInputImage decodes an image sent by a client, rejecting ones larger
+// than maxInputPixels before allocating their pixels.
+func decodeInputImage(data []byte) (image.Image, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxInputPixels {
+		return nil, "", fmt.Errorf("image of %dx%d pixels is too large, at most %d megapixels are supported", cfg.Width, cfg.Height, maxInputPixels/1_000_000)
+	}
+	return image.Decode(bytes.NewReader(data))
+}
+
+// fitInitImage decodes an init image and brings it to the nearest allowed
+// resolution using the given fit mode (crop, pad or stretch). Images that already
+// have an allowed size are passed through untouched.
+func fitInitImage(data []byte, allowed []resolution, mode string) ([]byte, resolution, error) {
+	src, format, err := decodeInputImage(data)
+	if err != nil {
+		return nil, resolution{}, fmt.Errorf("failed to decode init image: %w", err)
+	}
+	b := src.Bounds()
+	if format == "png" {
+		for _, res := range allowed {
+			if res.Width == b.Dx() && res.Height == b.Dy() {
+				return data, res, nil
+			}
+		}
+	}
+
+	target := nearestResolution(b.Dx(), b.Dy(), allowed)
+	var dst *image.NRGBA
+	switch mode {
+	case "stretch":
+		dst = scaleImage(src, b, target.Width, target.Height)
+	case "pad":
+		scale := math.Min(float64(target.Width)/float64(b.Dx()), float64(target.Height)/float64(b.Dy()))
+		w := max(1, int(math.Round(float64(b.Dx())*scale)))
+		h := max(1, int(math.Round(float64(b.Dy())*scale)))
+		scaled := scaleImage(src, b, w, h)
+		dst = image.NewNRGBA(image.Rect(0, 0, target.Width, target.Height))
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+		offset := image.Pt((target.Width-w)/2, (target.Height-h)/2)
+		draw.Draw(dst, scaled.Bounds().Add(offset), scaled, image.Point{}, draw.Src)
+	default: // crop
+		scale := math.Max(float64(target.Width)/float64(b.Dx()), float64(target.Height)/float64(b.Dy()))
+		cw := min(b.Dx(), int(math.Round(float64(target.Width)/scale)))
+		ch := min(b.Dy(), int(math.Round(float64(target.Height)/scale)))
+		x0 := b.Min.X + (b.Dx()-cw)/2
+		y0 := b.Min.Y + (b.Dy()-ch)/2
+		dst = scaleImage(src, image.Rect(x0, y0, x0+cw, y0+ch), target.Width, target.Height)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, resolution{}, fmt.Errorf("failed to encode init image: %w", err)
+	}
+	return buf.Bytes(), target, nil
+}
+
+// thumbnail scales a PNG down so that its longest side is at most size pixels.
+func thumbnail(data []byte, size int) ([]byte, error) {
+	src, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	b := src.Bounds()
+	scale := math.Min(1, float64(size)/float64(max(b.Dx(), b.Dy())))
+	w := max(1, int(math.Round(float64(b.Dx())*scale)))
+	h := max(1, int(math.Round(float64(b.Dy())*scale)))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleImage(src, b, w, h)); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleImage resamples the rect region of src to w×h using an area (box) filter,
+// which keeps large downscales like 4000×3000 → 1024×768 free of aliasing.
+func scaleImage(src image.Image, rect image.Rectangle, w, h int) *image.NRGBA {
+	in := image.NewNRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(in, in.Bounds(), src, rect.Min, draw.Src)
+	out := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	sx := float64(rect.Dx()) / float64(w)
+	sy := float64(rect.Dy()) / float64(h)
+	for y := 0; y < h; y++ {
+		y0 := int(float64(y) * sy)
+		y1 := max(y0+1, int(float64(y+1)*sy))
+		y1 = min(y1, rect.Dy())
+		for x := 0; x < w; x++ {
+			x0 := int(float64(x) * sx)
+			x1 := max(x0+1, int(float64(x+1)*sx))
+			x1 = min(x1, rect.Dx())
+
+			var r, g, bl, a, n uint64
+			for yy := y0; yy < y1; yy++ {
+				off := in.PixOffset(x0, yy)
+				for xx := x0; xx < x1; xx++ {
+					r += uint64(in.Pix[off])
+					g += uint64(in.Pix[off+1])
+					bl += uint64(in.Pix[off+2])
+					a += uint64(in.Pix[off+3])
+					off += 4
+					n++
+				}
+			}
+			o := out.PixOffset(x, y)
+			out.Pix[o] = uint8(r / n)
+			out.Pix[o+1] = uint8(g / n)
+			out.Pix[o+2] = uint8(bl / n)
+			out.Pix[o+3] = uint8(a / n)
+		}
+	}
+	return out
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// expandArgs splits an argument template on whitespace and substitutes
+// {placeholders} in each argument, so substituted paths may contain spaces.
+func expandArgs(template string, values map[string]string) []string {
+	return replaceArgs(strings.Fields(template), values)
+}
+
+// replaceArgs substitutes {placeholders} in each argument in a single pass, so
+// that placeholders in the substituted values are left alone.
+func replaceArgs(args []string, values map[string]string) []string {
+	pairs := make([]string, 0, 2*len(values))
+	for key, value := range values {
+		pairs = append(pairs, "{"+key+"}", value)
+	}
+	replacer := strings.NewReplacer(pairs...)
+	replaced := make([]string, len(args))
+	for i, arg := range args {
+		replaced[i] = replacer.Replace(arg)
+	}
+	return replaced
+}
+
+// restoreFaces runs the configured face-restoration tool on a generated image.
+// Any failure is logged and the unrestored image is returned instead, since a
+// missing restoration step shouldn't cost the user the whole generation.
+func restoreFaces(ctx context.Context, imgData []byte) []byte {
+	if faceRestoreBin == "" {
+		fmt.Println("Face restoration requested but -face-restore-bin is not set, skipping")
+		return imgData
+	}
+	restored, err := runFaceRestore(ctx, imgData)
+	if err != nil {
+		fmt.Printf("Face restoration failed, returning unrestored image: %v\n", err)
+		return imgData
+	}
+	return restored
+}
+
+func runFaceRestore(ctx context.Context, imgData []byte) ([]byte, error) {
+	tmpDir, err := os.MkdirTemp(tempDir, "face-restore-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	inputPath := filepath.Join(tmpDir, "input.png")
+	outputPath := filepath.Join(tmpDir, "output.png")
+	if err := os.WriteFile(inputPath, imgData, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write input: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, faceRestoreTimeout)
+	defer cancel()
+
+	args := expandArgs(faceRestoreArgs, map[string]string{
+		"input":  inputPath,
+		"output": outputPath,
+		"dir":    tmpDir,
+	})
+	cmd := exec.CommandContext(ctx, faceRestoreBin, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("command failed: %w", err)
+	}
+
+	restored, err := os.ReadFile(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read output: %w", err)
+	}
+	if len(restored) == 0 {
+		return nil, fmt.Errorf("tool produced an empty output")
+	}
+	return restored, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RoutingConfig picks a model profile from the prompt when a request names no
+// known profile. Keyword rules are tried in order; if none matches and a
+// classifier is configured, it is asked. The default profile is the fallback.
+type RoutingConfig struct {
+	Rules         []RoutingRule `json:"rules"`
+	ClassifierURL string        `json:"classifier_url"`
+}
+
+// RoutingRule routes prompts containing any of the keywords (whole words,
+// case-insensitive) to a profile.
+type RoutingRule struct {
+	Keywords []string `json:"keywords"`
+	Model    string   `json:"model"`
+
+	pattern *regexp.Regexp
+}
+
+func (c *RoutingConfig) validate() error {
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if len(rule.Keywords) == 0 || rule.Model == "" {
+			return fmt.Errorf("rules[%d]: keywords and model are required", i)
+		}
+		if _, ok := findProfile(rule.Model); !ok {
+			return fmt.Errorf("rules[%d]: unknown model profile %q", i, rule.Model)
+		}
+		quoted := make([]string, len(rule.Keywords))
+		for j, k := range rule.Keywords {
+			quoted[j] = regexp.QuoteMeta(strings.TrimSpace(k))
+		}
+		rule.pattern = regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	}
+	return nil
+}
+
+// routeModel returns the profile to run a prompt with: the requested one if it
+// exists, otherwise the one picked by the routing rules or classifier.
+func routeModel(ctx context.Context, requested, prompt string) string {
+	if p, ok := findProfile(requested); ok {
+		return p.Name
+	}
+	for _, rule := range config.Routing.Rules {
+		if match := rule.pattern.FindString(prompt); match != "" {
+			fmt.Printf("Routing to %s (keyword %q)\n", rule.Model, match)
+			return rule.Model
+		}
+	}
+	if config.Routing.ClassifierURL != "" {
+		name, err := classifyPrompt(ctx, prompt)
+		if err != nil {
+			log.Printf("Prompt classification failed: %v", err)
+		} else if p, ok := findProfile(name); ok {
+			fmt.Printf("Routing to %s (classifier)\n", p.Name)
+			return p.Name
+		} else if name != "" {
+			log.Printf("Classifier picked unknown model profile %q", name)
+		}
+	}
+	return resolveProfile("").Name
+}
+
+// classifyPrompt asks the classifier which of the profiles suits the prompt.
+// It is posted {"prompt": ..., "models": [...]} and answers {"model": ...}.
+func classifyPrompt(ctx context.Context, prompt string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var names []string
+	for _, p := range modelProfiles() {
+		names = append(names, p.Name)
+	}
+	body, _ := json.Marshal(map[string]interface{}{"prompt": prompt, "models": names})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.Routing.ClassifierURL, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create classifier request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("classifier request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("classifier returned status: %s", resp.Status)
+	}
+
+	var verdict struct {
+		Model string `json:"model"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&verdict); err != nil {
+		return "", fmt.Errorf("invalid classifier response: %w", err)
+	}
+	return verdict.Model, nil
+}
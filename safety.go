@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	safetyActionReject = "reject"
+	safetyActionBlur   = "blur"
+)
+
+// safetyVerdict is the response expected from the external classifier. Either
+// field may be omitted; an image is flagged if nsfw is true or score reaches
+// the configured threshold.
+type safetyVerdict struct {
+	NSFW  bool    `json:"nsfw"`
+	Score float64 `json:"score"`
+}
+
+// checkImageSafety posts the PNG to the classifier at safetyCheckerURL and
+// reports whether it was flagged.
+func checkImageSafety(ctx context.Context, imgData []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, safetyCheckerURL, bytes.NewReader(imgData))
+	if err != nil {
+		return false, fmt.Errorf("failed to create classifier request: %w", err)
+	}
+	req.Header.Set("Content-Type", "image/png")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("classifier request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("classifier returned status: %s", resp.Status)
+	}
+
+	var verdict safetyVerdict
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&verdict); err != nil {
+		return false, fmt.Errorf("invalid classifier response: %w", err)
+	}
+	fmt.Printf("Safety check: nsfw=%v score=%.3f\n", verdict.NSFW, verdict.Score)
+	return verdict.NSFW || verdict.Score >= safetyThreshold, nil
+}
+
+// blurImage heavily blurs a PNG with three passes of a box blur, which is a
+// cheap approximation of a Gaussian.
+func blurImage(imgData []byte) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	b := src.Bounds()
+	img := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(img, img.Bounds(), src, b.Min, draw.Src)
+
+	radius := max(1, max(b.Dx(), b.Dy())/40)
+	for i := 0; i < 3; i++ {
+		boxBlur(img, radius, true)
+		boxBlur(img, radius, false)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// boxBlur applies a horizontal or vertical running-sum box blur in place.
+func boxBlur(img *image.NRGBA, radius int, horizontal bool) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	lines, length := h, w
+	if !horizontal {
+		lines, length = w, h
+	}
+	offset := func(line, i int) int {
+		if horizontal {
+			return img.PixOffset(i, line)
+		}
+		return img.PixOffset(line, i)
+	}
+
+	buf := make([]uint8, length*4)
+	for line := 0; line < lines; line++ {
+		for i := 0; i < length; i++ {
+			copy(buf[i*4:i*4+4], img.Pix[offset(line, i):])
+		}
+		var sum [4]int
+		n := 0
+		for i := 0; i <= radius && i < length; i++ {
+			for c := 0; c < 4; c++ {
+				sum[c] += int(buf[i*4+c])
+			}
+			n++
+		}
+		for i := 0; i < length; i++ {
+			o := offset(line, i)
+			for c := 0; c < 4; c++ {
+				img.Pix[o+c] = uint8(sum[c] / n)
+			}
+			if add := i + radius + 1; add < length {
+				for c := 0; c < 4; c++ {
+					sum[c] += int(buf[add*4+c])
+				}
+				n++
+			}
+			if sub := i - radius; sub >= 0 {
+				for c := 0; c < 4; c++ {
+					sum[c] -= int(buf[sub*4+c])
+				}
+				n--
+			}
+		}
+	}
+}
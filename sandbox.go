@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// sandboxHelperArg, given as the first argument, makes the adapter act as the
+// sandbox helper: it applies the sandboxSpec in the next argument to itself and
+// then execs sd with the remaining arguments. Limits set this way are
+// inherited by sd without the adapter having to restrict itself.
+const sandboxHelperArg = "__sd-sandbox"
+
+// sandboxSpec describes the resource limits and confinement the sandbox
+// helper applies before it execs sd.
+type sandboxSpec struct {
+	CPUSeconds   uint64 `json:"cpu_seconds,omitempty"`
+	AddressSpace uint64 `json:"address_space,omitempty"` // bytes
+	OpenFiles    uint64 `json:"open_files,omitempty"`
+
+	// Confine restricts the file system to Read and Write with Landlock and
+	// installs a seccomp filter against administrative syscalls.
+	Confine bool     `json:"confine,omitempty"`
+	Read    []string `json:"read,omitempty"`
+	Write   []string `json:"write,omitempty"`
+}
+
+// sandboxActive reports whether sd is run through the sandbox helper.
+func sandboxActive() bool {
+	return sdSandbox || sdCPUTime > 0 || sdAddressSpaceMB > 0 || sdOpenFiles > 0
+}
+
+// splitPaths splits a comma-separated list of paths, dropping empty items.
+func splitPaths(list string) []string {
+	var paths []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			paths = append(paths, item)
+		}
+	}
+	return paths
+}
+
+// sdEnv returns the environment sd runs with: only the variables named by
+// -sd-env, or nil to inherit the adapter's whole environment for "*".
+func sdEnv() []string {
+	if strings.TrimSpace(sdEnvList) == "*" {
+		return nil
+	}
+	env := []string{}
+	for _, name := range splitPaths(sdEnvList) {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// sdCommand returns the command running sd in dir with the given arguments
+// for a profile, through the sandbox helper if limits or confinement are
+// configured. The profile's model files are readable inside the sandbox, dir,
+// which holds the run's inputs and outputs, is writable.
+func sdCommand(ctx context.Context, profile ModelProfile, dir string, args []string) (*exec.Cmd, error) {
+	if image := containerImage(profile); image != "" {
+		return containerCommand(ctx, image, profile, dir, args)
+	}
+	if !sandboxActive() {
+		cmd := exec.CommandContext(ctx, sdBinPath, args...)
+		cmd.Dir = dir
+		cmd.Env = deviceEnv(ctx, sdEnv())
+		return cmd, nil
+	}
+
+	bin, err := exec.LookPath(sdBinPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find sd binary: %w", err)
+	}
+	if bin, err = filepath.Abs(bin); err != nil {
+		return nil, err
+	}
+	spec := sandboxSpec{
+		CPUSeconds:   uint64((sdCPUTime + 999e6) / 1e9),
+		AddressSpace: uint64(sdAddressSpaceMB) << 20,
+		OpenFiles:    uint64(sdOpenFiles),
+		Confine:      sdSandbox,
+	}
+	if spec.Confine {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		// sd may ship its libraries next to the binary.
+		spec.Read = append(splitPaths(sdSandboxRead), filepath.Dir(bin))
+		spec.Read = append(spec.Read, profile.files()...)
+		if taesdPath != "" {
+			spec.Read = append(spec.Read, taesdPath)
+		}
+		spec.Write = append(splitPaths(sdSandboxWrite), absDir)
+	}
+	specJSON, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the adapter binary for the sandbox helper: %w", err)
+	}
+	cmd := exec.CommandContext(ctx, self, append([]string{sandboxHelperArg, string(specJSON), bin}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = deviceEnv(ctx, sdEnv())
+	return cmd, nil
+}
+
+// runSD runs the sd command of a profile, locally as -sd-user and in a cgroup
+// of its own limited to -sd-memory-mb if those are set.
+func runSD(cmd *exec.Cmd, profile ModelProfile) error {
+	if containerImage(profile) != "" {
+		return cmd.Run()
+	}
+	finish, err := prepareSDProcess(cmd)
+	if err != nil {
+		return err
+	}
+	return finish(cmd.Run())
+}
+
+// runSandboxHelper is the entry point of the sandbox helper process; it only
+// returns by exec'ing sd and exits on failure.
+func runSandboxHelper(args []string) {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "sandbox: missing spec or sd binary")
+		os.Exit(127)
+	}
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(args[0]), &spec); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: invalid spec: %v\n", err)
+		os.Exit(127)
+	}
+	if err := sandboxExec(spec, args[1], args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(127)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock syscalls and constants, see linux/landlock.h. The syscall numbers
+// are the same on all architectures.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	landlockExecute    = 1 << 0
+	landlockWriteFile  = 1 << 1
+	landlockReadFile   = 1 << 2
+	landlockReadDir    = 1 << 3
+	landlockRemoveDir  = 1 << 4
+	landlockRemoveFile = 1 << 5
+	landlockMakeChar   = 1 << 6
+	landlockMakeDir    = 1 << 7
+	landlockMakeReg    = 1 << 8
+	landlockMakeSock   = 1 << 9
+	landlockMakeFifo   = 1 << 10
+	landlockMakeBlock  = 1 << 11
+	landlockMakeSym    = 1 << 12
+	landlockRefer      = 1 << 13 // ABI 2
+	landlockTruncate   = 1 << 14 // ABI 3
+
+	// Rights that apply to files rather than directories.
+	landlockFileAccess = landlockExecute | landlockWriteFile | landlockReadFile | landlockTruncate
+
+	oPath = 0x200000 // O_PATH, missing from package syscall on some architectures
+)
+
+// Seccomp constants, see linux/seccomp.h and linux/filter.h.
+const (
+	seccompModeFilter     = 2
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+	seccompDataNr         = 0
+	seccompDataArch       = 4
+	bpfLdWAbs             = 0x20
+	bpfJeqK               = 0x15
+	bpfJgeK               = 0x35
+	bpfRetK               = 0x06
+	x32SyscallBit         = 0x40000000
+	auditArchX86_64       = 0xc000003e
+	auditArchAArch64      = 0xc00000b7
+	auditArchRiscV64      = 0xc00000f3
+	prSetSeccomp          = 22
+	prSetNoNewPrivs       = 38
+)
+
+// seccompArchs maps the architectures the seccomp filter supports to their
+// audit architecture.
+var seccompArchs = map[string]uint32{
+	"amd64":   auditArchX86_64,
+	"arm64":   auditArchAArch64,
+	"riscv64": auditArchRiscV64,
+}
+
+// seccompDenied are the syscalls sd has no business making; they fail with
+// EPERM.
+var seccompDenied = []uint32{
+	syscall.SYS_PTRACE,
+	syscall.SYS_MOUNT,
+	syscall.SYS_UMOUNT2,
+	syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_CHROOT,
+	syscall.SYS_UNSHARE,
+	syscall.SYS_REBOOT,
+	syscall.SYS_KEXEC_LOAD,
+	syscall.SYS_INIT_MODULE,
+	syscall.SYS_DELETE_MODULE,
+	syscall.SYS_SWAPON,
+	syscall.SYS_SWAPOFF,
+	syscall.SYS_SETTIMEOFDAY,
+	syscall.SYS_ACCT,
+}
+
+// checkSandbox resolves -sd-user and verifies at startup that -sd-cgroup is
+// usable and the kernel and architecture support the configured sandbox, so
+// that generations don't fail one by one.
+func checkSandbox() error {
+	var err error
+	if sdCredential, err = lookupSDCredential(); err != nil {
+		return err
+	}
+	if err := checkSDCgroup(); err != nil {
+		return err
+	}
+	if !sdSandbox {
+		return nil
+	}
+	if landlockABI() < 1 {
+		return errors.New("-sd-sandbox requires Landlock, which the kernel doesn't support or has disabled")
+	}
+	if _, ok := seccompArchs[runtime.GOARCH]; !ok {
+		return fmt.Errorf("-sd-sandbox isn't supported on %s", runtime.GOARCH)
+	}
+	return nil
+}
+
+// sandboxExec applies spec to the current process and replaces it with bin.
+func sandboxExec(spec sandboxSpec, bin string, argv []string) error {
+	// Landlock, no_new_privs and seccomp apply to the calling thread, which
+	// must therefore be the one to exec.
+	runtime.LockOSThread()
+
+	limits := []struct {
+		resource int
+		value    uint64
+		name     string
+	}{
+		{syscall.RLIMIT_CPU, spec.CPUSeconds, "CPU time"},
+		{syscall.RLIMIT_AS, spec.AddressSpace, "address space"},
+		{syscall.RLIMIT_NOFILE, spec.OpenFiles, "open files"},
+	}
+	for _, l := range limits {
+		if l.value == 0 {
+			continue
+		}
+		rlim := syscall.Rlimit{Cur: l.value, Max: l.value}
+		if l.resource == syscall.RLIMIT_CPU {
+			// SIGXCPU at the soft limit, SIGKILL a second later.
+			rlim.Max++
+		}
+		if err := syscall.Setrlimit(l.resource, &rlim); err != nil {
+			return fmt.Errorf("failed to limit %s: %w", l.name, err)
+		}
+	}
+
+	if spec.Confine {
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+			return fmt.Errorf("failed to set no_new_privs: %w", errno)
+		}
+		if err := landlockRestrict(spec.Read, spec.Write); err != nil {
+			return err
+		}
+		if err := seccompRestrict(); err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(bin, argv, os.Environ())
+}
+
+// landlockABI returns the Landlock ABI version of the kernel, 0 if Landlock is
+// unavailable.
+func landlockABI() int {
+	v, _, errno := syscall.RawSyscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0
+	}
+	return int(v)
+}
+
+// landlockRestrict confines the file system access of the current thread to
+// reading and executing below read and full access below write.
+func landlockRestrict(read, write []string) error {
+	abi := landlockABI()
+	if abi < 1 {
+		return errors.New("Landlock is not supported by the kernel")
+	}
+	handled := uint64(landlockExecute | landlockWriteFile | landlockReadFile | landlockReadDir |
+		landlockRemoveDir | landlockRemoveFile | landlockMakeChar | landlockMakeDir |
+		landlockMakeReg | landlockMakeSock | landlockMakeFifo | landlockMakeBlock | landlockMakeSym)
+	if abi >= 2 {
+		handled |= landlockRefer
+	}
+	if abi >= 3 {
+		handled |= landlockTruncate
+	}
+
+	attr := handled // struct landlock_ruleset_attr { __u64 handled_access_fs; }
+	fd, _, errno := syscall.RawSyscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create Landlock ruleset: %w", errno)
+	}
+	ruleset := int(fd)
+	defer syscall.Close(ruleset)
+
+	for _, path := range read {
+		if err := landlockAllow(ruleset, path, handled&(landlockExecute|landlockReadFile|landlockReadDir)); err != nil {
+			return err
+		}
+	}
+	for _, path := range write {
+		if err := landlockAllow(ruleset, path, handled); err != nil {
+			return err
+		}
+	}
+	if _, _, errno := syscall.RawSyscall(sysLandlockRestrictSelf, uintptr(ruleset), 0, 0); errno != 0 {
+		return fmt.Errorf("failed to enforce Landlock ruleset: %w", errno)
+	}
+	return nil
+}
+
+// landlockAllow grants access below path; paths that don't exist are skipped,
+// as the defaults list directories not every distribution has.
+func landlockAllow(ruleset int, path string, access uint64) error {
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) {
+			return nil
+		}
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= landlockFileAccess
+	}
+
+	// struct landlock_path_beneath_attr is packed: __u64 allowed_access;
+	// __s32 parent_fd.
+	var attr [12]byte
+	binary.NativeEndian.PutUint64(attr[0:], access)
+	binary.NativeEndian.PutUint32(attr[8:], uint32(int32(fd)))
+	if _, _, errno := syscall.RawSyscall6(sysLandlockAddRule, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to allow %s: %w", path, errno)
+	}
+	return nil
+}
+
+type sockFilter struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+type sockFprog struct {
+	Len    uint16
+	Filter *sockFilter
+}
+
+// seccompRestrict installs a filter that kills the process on syscalls of a
+// foreign architecture and fails the denied syscalls with EPERM.
+func seccompRestrict() error {
+	arch, ok := seccompArchs[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("seccomp filtering isn't supported on %s", runtime.GOARCH)
+	}
+	filter := []sockFilter{
+		{Code: bpfLdWAbs, K: seccompDataArch},
+		{Code: bpfJeqK, Jt: 1, K: arch},
+		{Code: bpfRetK, K: seccompRetKillProcess},
+		{Code: bpfLdWAbs, K: seccompDataNr},
+	}
+	if runtime.GOARCH == "amd64" {
+		filter = append(filter,
+			sockFilter{Code: bpfJgeK, Jf: 1, K: x32SyscallBit},
+			sockFilter{Code: bpfRetK, K: seccompRetKillProcess},
+		)
+	}
+	for _, nr := range seccompDenied {
+		filter = append(filter,
+			sockFilter{Code: bpfJeqK, Jf: 1, K: nr},
+			sockFilter{Code: bpfRetK, K: seccompRetErrno | uint32(syscall.EPERM)},
+		)
+	}
+	filter = append(filter, sockFilter{Code: bpfRetK, K: seccompRetAllow})
+
+	prog := sockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("failed to install seccomp filter: %w", errno)
+	}
+	return nil
+}
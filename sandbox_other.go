@@ -0,0 +1,25 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// checkSandbox rejects sandbox settings, as rlimits, Landlock, seccomp,
+// switching users and cgroups are only applied on Linux.
+func checkSandbox() error {
+	if sandboxActive() || sdUser != "" || sdGroup != "" || sdCgroupDir != "" || sdMemoryMB > 0 {
+		return errors.New("sd resource limits, -sd-sandbox, -sd-user and -sd-cgroup are only supported on Linux")
+	}
+	return nil
+}
+
+func prepareSDProcess(cmd *exec.Cmd) (func(error) error, error) {
+	return func(err error) error { return err }, nil
+}
+
+func sandboxExec(spec sandboxSpec, bin string, argv []string) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduledJob generates images on a cron schedule, queued like any other
+// request, e.g. a fresh header image every morning. Jobs come from the
+// config file or are added at runtime with the /admin/schedules API; the
+// latter are lost on restart and run as the user who added them.
+type ScheduledJob struct {
+	Name           string `json:"name"`
+	Schedule       string `json:"schedule"`           // cron expression like "0 6 * * *", or @hourly, @daily, @weekly...
+	Timezone       string `json:"timezone,omitempty"` // IANA name like Europe/Berlin, local time if empty
+	Prompt         string `json:"prompt"`             // dynamic prompts pick new alternatives every run
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	Model          string `json:"model,omitempty"`
+	Size           string `json:"size,omitempty"`
+	Quality        string `json:"quality,omitempty"`
+	Style          string `json:"style,omitempty"`
+	N              int    `json:"n,omitempty"`
+
+	// Destination is a name the first image is also stored as, replacing
+	// the one of the previous run, e.g. "header.png" for a stable
+	// /generated/header.png. Collection adds the images to a collection.
+	Destination string `json:"destination,omitempty"`
+	Collection  string `json:"collection,omitempty"`
+
+	// User is the user a job of the config file runs as, whose tenant its
+	// images are stored in; schedule:NAME if empty.
+	User string `json:"user,omitempty"`
+}
+
+// parse checks the job and returns its schedule and time zone.
+func (s ScheduledJob) parse() (*cronSchedule, *time.Location, error) {
+	if !validName(s.Name) {
+		return nil, nil, fmt.Errorf("name must be up to 64 letters, digits, dashes and underscores")
+	}
+	if strings.TrimSpace(s.Prompt) == "" {
+		return nil, nil, fmt.Errorf("prompt is required")
+	}
+	cron, err := parseCron(s.Schedule)
+	if err != nil {
+		return nil, nil, fmt.Errorf("schedule: %w", err)
+	}
+	loc := time.Local
+	if s.Timezone != "" {
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return nil, nil, fmt.Errorf("timezone: %w", err)
+		}
+	}
+	if s.Model != "" {
+		if _, ok := findProfile(s.Model); !ok {
+			return nil, nil, fmt.Errorf("unknown model %q", s.Model)
+		}
+	}
+	// The destination is stored in the tenant of the job's user.
+	if s.Destination != "" && (strings.Contains(s.Destination, "/") || !validImageName(s.Destination)) {
+		return nil, nil, fmt.Errorf("destination must be a .png file name")
+	}
+	if s.Collection != "" && !validCollectionName(s.Collection) {
+		return nil, nil, fmt.Errorf("invalid collection name")
+	}
+	return cron, loc, nil
+}
+
+func validName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+type scheduleEntry struct {
+	job        ScheduledJob
+	cron       *cronSchedule
+	loc        *time.Location
+	owner      identity // the job runs as
+	fromConfig bool
+
+	next      time.Time
+	lastRun   time.Time
+	lastError string
+	images    []string // of the last successful run
+	running   bool
+}
+
+// scheduleStatus is an entry as reported by the admin API.
+type scheduleStatus struct {
+	ScheduledJob
+	Source    string     `json:"source"` // config or api
+	Owner     string     `json:"owner"`
+	NextRun   *time.Time `json:"next_run,omitempty"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Images    []string   `json:"images,omitempty"`
+	Running   bool       `json:"running"`
+}
+
+// scheduler starts the scheduled jobs when they are due.
+type scheduler struct {
+	mu      sync.Mutex
+	entries map[string]*scheduleEntry
+	wake    chan struct{} // the schedules changed
+}
+
+var schedules = &scheduler{entries: map[string]*scheduleEntry{}, wake: make(chan struct{}, 1)}
+
+// add schedules a job to run as owner.
+func (s *scheduler) add(job ScheduledJob, owner identity, fromConfig bool) error {
+	cron, loc, err := job.parse()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[job.Name]; ok {
+		return fmt.Errorf("a scheduled job %q exists already", job.Name)
+	}
+	e := &scheduleEntry{job: job, cron: cron, loc: loc, owner: owner, fromConfig: fromConfig}
+	e.next = cron.next(time.Now().In(loc))
+	s.entries[job.Name] = e
+	s.notify()
+	return nil
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scheduler) status(e *scheduleEntry) scheduleStatus {
+	st := scheduleStatus{ScheduledJob: e.job, Source: "api", Owner: e.owner.User, LastError: e.lastError, Running: e.running}
+	if e.fromConfig {
+		st.Source = "config"
+	}
+	if !e.next.IsZero() {
+		next := e.next
+		st.NextRun = &next
+	}
+	if !e.lastRun.IsZero() {
+		last := e.lastRun
+		st.LastRun = &last
+	}
+	for _, name := range e.images {
+		st.Images = append(st.Images, generatedURL(name))
+	}
+	return st
+}
+
+// run starts due jobs until ctx is done. Every job runs in its own goroutine
+// and waits in the queue like a request; a job still running when it is due
+// again skips that run.
+func (s *scheduler) run(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		var wakeAt time.Time
+		for _, e := range s.entries {
+			if e.next.IsZero() {
+				continue
+			}
+			if !e.next.After(now) {
+				if e.running {
+					log.Printf("Scheduled job %s is still running, skipping the run due at %s", e.job.Name, e.next.Format(time.RFC3339))
+				} else {
+					s.startLocked(e)
+				}
+				e.next = e.cron.next(now.In(e.loc))
+			}
+			if !e.next.IsZero() && (wakeAt.IsZero() || e.next.Before(wakeAt)) {
+				wakeAt = e.next
+			}
+		}
+		s.mu.Unlock()
+
+		wait := time.Hour
+		if !wakeAt.IsZero() {
+			wait = time.Until(wakeAt)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// startLocked runs the job of e in the background.
+func (s *scheduler) startLocked(e *scheduleEntry) {
+	e.running = true
+	job := e.job
+	owner := e.owner
+	go func() {
+		ctx := withIdentity(context.Background(), owner)
+		fmt.Printf("Running scheduled job %s\n", job.Name)
+		images, err := runScheduledJob(ctx, job)
+		if err != nil {
+			log.Printf("Scheduled job %s failed: %v", job.Name, err)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		e.running = false
+		e.lastRun = time.Now()
+		e.lastError = ""
+		if err != nil {
+			e.lastError = err.Error()
+		} else {
+			e.images = images
+		}
+	}()
+}
+
+func runScheduledJob(ctx context.Context, job ScheduledJob) ([]string, error) {
+	req := ChatRequest{
+		Model:          job.Model,
+		NegativePrompt: job.NegativePrompt,
+		N:              job.N,
+		Size:           job.Size,
+		Quality:        job.Quality,
+		Style:          job.Style,
+		Collection:     job.Collection,
+	}
+	j, _, err := chatJob(ctx, req, job.Prompt, nil)
+	if err != nil {
+		return nil, err
+	}
+	result, err := runJob(ctx, j)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, meta := range result.Images {
+		names = append(names, meta.Name)
+	}
+	if job.Destination != "" && len(names) > 0 {
+		data, err := store.Get(ctx, names[0])
+		if err != nil {
+			return names, fmt.Errorf("failed to load %s: %w", names[0], err)
+		}
+		destination := tenantName(ctx, job.Destination)
+		if err := store.Put(ctx, destination, data, "image/png"); err != nil {
+			return names, fmt.Errorf("failed to store %s: %w", destination, err)
+		}
+		names = append(names, destination)
+	}
+	return names, nil
+}
+
+// handleSchedules routes /admin/schedules and below:
+//
+//	GET    /admin/schedules             list scheduled jobs with their next and last run
+//	POST   /admin/schedules             add a scheduled job
+//	GET    /admin/schedules/{name}      show a scheduled job
+//	DELETE /admin/schedules/{name}      remove a job added with the API
+//	POST   /admin/schedules/{name}/run  run a job now
+func handleSchedules(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/schedules"), "/")
+	if path == "" {
+		switch r.Method {
+		case http.MethodGet:
+			listSchedules(w)
+		case http.MethodPost:
+			addSchedule(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	name, action, _ := strings.Cut(path, "/")
+	schedules.mu.Lock()
+	defer schedules.mu.Unlock()
+	e, ok := schedules.entries[name]
+	if !ok {
+		http.Error(w, "Unknown scheduled job", http.StatusNotFound)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, schedules.status(e))
+	case action == "" && r.Method == http.MethodDelete:
+		if e.fromConfig {
+			http.Error(w, "The job is defined in the config file", http.StatusConflict)
+			return
+		}
+		delete(schedules.entries, name)
+		schedules.notify()
+		w.WriteHeader(http.StatusNoContent)
+	case action == "run" && r.Method == http.MethodPost:
+		if e.running {
+			http.Error(w, "The job is running already", http.StatusConflict)
+			return
+		}
+		schedules.startLocked(e)
+		writeJSON(w, schedules.status(e))
+	case action == "" || action == "run":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func listSchedules(w http.ResponseWriter) {
+	schedules.mu.Lock()
+	list := []scheduleStatus{}
+	for _, e := range schedules.entries {
+		list = append(list, schedules.status(e))
+	}
+	schedules.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, map[string]interface{}{"object": "list", "data": list})
+}
+
+func addSchedule(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	var job ScheduledJob
+	if err := validateRequest(body, &job); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := json.Unmarshal(body, &job); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if job.User != "" {
+		http.Error(w, "user can only be set for jobs of the config file", http.StatusBadRequest)
+		return
+	}
+	// The job runs as its creator, with the same model restrictions.
+	owner := identityFrom(r.Context())
+	if job.Model != "" {
+		if err := authorizeModel(r.Context(), job.Model); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if err := schedules.add(job, owner, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Scheduled job %s (%s) added by %s", job.Name, job.Schedule, owner.User)
+
+	schedules.mu.Lock()
+	st := schedules.status(schedules.entries[job.Name])
+	schedules.mu.Unlock()
+	writeJSON(w, st)
+}
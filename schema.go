@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// stringAlternatives are the types whose custom unmarshaling accepts a JSON
+// string as well, such as message content given as plain text.
+var stringAlternatives = map[reflect.Type]bool{
+	reflect.TypeOf([]ContentPart(nil)): true,
+	reflect.TypeOf(seedList(nil)):      true,
+}
+
+// validateRequest checks a request body against the Go type of v before it is
+// decoded into it, so that a wrong type is reported by its path, e.g.
+// "messages[2].content[0].image_url.url must be a string". Unknown fields are
+// errors with -strict-requests and are logged otherwise, as OpenAI clients
+// send many fields the adapter has no use for.
+func validateRequest(body []byte, v interface{}) error {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return &requestError{http.StatusBadRequest, fmt.Sprintf("Invalid JSON: %v", err)}
+	}
+	c := schemaCheck{}
+	if err := c.check(doc, reflect.TypeOf(v).Elem(), ""); err != nil {
+		return &requestError{http.StatusBadRequest, err.Error()}
+	}
+	if len(c.unknown) > 0 {
+		if strictRequests {
+			return &requestError{http.StatusBadRequest, fmt.Sprintf("%s is not a known field", c.unknown[0])}
+		}
+		log.Printf("Ignoring unknown request fields: %s", strings.Join(c.unknown, ", "))
+	}
+	return nil
+}
+
+type schemaCheck struct {
+	unknown []string
+}
+
+func (c *schemaCheck) check(v interface{}, t reflect.Type, path string) error {
+	if v == nil {
+		return nil // null leaves the value alone
+	}
+	if _, ok := v.(string); ok && stringAlternatives[t] {
+		return nil
+	}
+	name := path
+	if name == "" {
+		name = "request"
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return c.check(v, t.Elem(), path)
+	case reflect.Interface:
+		return nil
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s must be a string", name)
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", name)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s must be an integer", name)
+		}
+		if _, err := strconv.ParseInt(n.String(), 10, t.Bits()); err != nil {
+			return fmt.Errorf("%s must be an integer", name)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s must be a non-negative integer", name)
+		}
+		if _, err := strconv.ParseUint(n.String(), 10, t.Bits()); err != nil {
+			return fmt.Errorf("%s must be a non-negative integer", name)
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := v.(json.Number); !ok {
+			return fmt.Errorf("%s must be a number", name)
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", name)
+		}
+		for i, item := range items {
+			if err := c.check(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", name)
+		}
+		for _, key := range sortedKeys(obj) {
+			if err := c.check(obj[key], t.Elem(), joinPath(path, key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", name)
+		}
+		return c.checkFields(obj, t, path)
+	}
+	return nil
+}
+
+// checkFields checks the fields of an object against a struct, matching names
+// case-insensitively like encoding/json.
+func (c *schemaCheck) checkFields(obj map[string]interface{}, t reflect.Type, path string) error {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+	for _, key := range sortedKeys(obj) {
+		ft, ok := fields[strings.ToLower(key)]
+		if !ok {
+			c.unknown = append(c.unknown, joinPath(path, key))
+			continue
+		}
+		if err := c.check(obj[key], ft, joinPath(path, key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultResolutionKeywords map prompt words to output sizes. The
+// "resolution_keywords" config section replaces the whole table; an empty
+// section disables keywords.
+var defaultResolutionKeywords = map[string]string{
+	"avatar":    "768x768",
+	"square":    "1024x1024",
+	"portrait":  "896x1152",
+	"landscape": "1216x832",
+	"poster":    "832x1216",
+	"wallpaper": "1344x768",
+	"banner":    "1536x512",
+}
+
+var (
+	resolutionKeywords       map[string]resolution
+	resolutionKeywordPattern *regexp.Regexp
+)
+
+// loadResolutionKeywords parses the keyword table, given as word → WIDTHxHEIGHT.
+func loadResolutionKeywords(table map[string]string) error {
+	if table == nil {
+		table = defaultResolutionKeywords
+	}
+	resolutionKeywords = make(map[string]resolution, len(table))
+	var words []string
+	for word, size := range table {
+		word = strings.ToLower(strings.TrimSpace(word))
+		res, err := parseResolution(size)
+		if err != nil {
+			return fmt.Errorf("%q: %w", word, err)
+		}
+		if word == "" {
+			return fmt.Errorf("empty keyword")
+		}
+		resolutionKeywords[word] = res
+		words = append(words, regexp.QuoteMeta(word))
+	}
+	resolutionKeywordPattern = nil
+	if len(words) > 0 {
+		// Longer words first, so that "ultra wide" wins over "wide".
+		sort.Slice(words, func(i, j int) bool { return len(words[i]) > len(words[j]) })
+		resolutionKeywordPattern = regexp.MustCompile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)
+	}
+	return nil
+}
+
+// keywordResolution returns the size for the first resolution keyword in the
+// prompt, if any.
+func keywordResolution(prompt string) (resolution, string, bool) {
+	if resolutionKeywordPattern == nil {
+		return resolution{}, "", false
+	}
+	match := resolutionKeywordPattern.FindString(prompt)
+	if match == "" {
+		return resolution{}, "", false
+	}
+	return resolutionKeywords[strings.ToLower(match)], match, true
+}
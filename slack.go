@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SlackConfig enables the slash-command endpoint /slack/commands. Images are
+// uploaded to the channel with files.upload when a bot token is set and
+// otherwise posted to the command's response_url as a link to /generated/.
+type SlackConfig struct {
+	SigningSecret string `json:"signing_secret"`
+	BotToken      string `json:"bot_token"` // needs files:write
+	Model         string `json:"model"`     // profile to use, routed by prompt if empty
+	APIURL        string `json:"api_url"`   // https://slack.com/api if empty
+}
+
+// slackMaxSkew is how old a signed request may be, against replays.
+const slackMaxSkew = 5 * time.Minute
+
+func slackAPIURL() string {
+	if config.Slack.APIURL != "" {
+		return strings.TrimSuffix(config.Slack.APIURL, "/")
+	}
+	return "https://slack.com/api"
+}
+
+// verifySlackSignature checks the v0 signature Slack puts on every request.
+func verifySlackSignature(r *http.Request, body []byte) bool {
+	ts := r.Header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(sec, 0)); skew > slackMaxSkew || skew < -slackMaxSkew {
+		return false
+	}
+	expected := "v0=" + hex.EncodeToString(hmacSHA256([]byte(config.Slack.SigningSecret), "v0:"+ts+":"+string(body)))
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature")))
+}
+
+// handleSlackCommand acknowledges a slash command right away, as Slack
+// expects an answer within three seconds, and posts the image once the job
+// has run.
+func handleSlackCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if !verifySlackSignature(r, body) {
+		http.Error(w, "Invalid request signature", http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	prompt := strings.TrimSpace(form.Get("text"))
+	if prompt == "" {
+		writeJSON(w, map[string]string{"response_type": "ephemeral", "text": fmt.Sprintf("Usage: %s <prompt>", form.Get("command"))})
+		return
+	}
+
+	cmd := slackCommand{
+		prompt: prompt,
+		// user_name is deprecated and can change; user IDs are only unique
+		// within a workspace.
+		user:        form.Get("team_id") + ":" + form.Get("user_id"),
+		channelID:   form.Get("channel_id"),
+		responseURL: form.Get("response_url"),
+		baseURL:     externalBaseURL(r),
+	}
+	go cmd.run()
+	writeJSON(w, map[string]string{"response_type": "ephemeral", "text": "Generating: " + prompt})
+}
+
+type slackCommand struct {
+	prompt      string
+	user        string // team_id:user_id
+	channelID   string
+	responseURL string
+	baseURL     string // for links to /generated/
+}
+
+func (c slackCommand) run() {
+	ctx := withIdentity(context.Background(), identity{User: "slack:" + c.user, Method: "slack"})
+	fmt.Printf("Slack prompt from %s: %s\n", c.user, c.prompt)
+
+	j, _, err := chatJob(ctx, ChatRequest{Model: config.Slack.Model}, c.prompt, nil)
+	var result jobResult
+	if err == nil {
+		result, err = runJob(ctx, j)
+	}
+	if err != nil {
+		text := "Generation failed."
+		if reqErr, ok := err.(*requestError); ok {
+			text = reqErr.message
+		}
+		c.respond(ctx, map[string]interface{}{"response_type": "ephemeral", "text": text})
+		return
+	}
+
+	for _, meta := range result.Images {
+		title := fmt.Sprintf("%s (seed %d)", c.prompt, meta.Seed)
+		if config.Slack.BotToken != "" {
+			if err := c.upload(ctx, meta, title); err != nil {
+				log.Printf("Failed to upload image to Slack: %v", err)
+				c.respond(ctx, map[string]interface{}{"response_type": "ephemeral", "text": "Failed to upload the image."})
+			}
+			continue
+		}
+		imageURL := c.baseURL + generatedURL(meta.Name)
+		c.respond(ctx, map[string]interface{}{
+			"response_type": "in_channel",
+			"text":          title,
+			"blocks": []map[string]interface{}{
+				{"type": "image", "image_url": imageURL, "alt_text": c.prompt, "title": map[string]string{"type": "plain_text", "text": title}},
+			},
+		})
+	}
+}
+
+// respond posts a message to the command's response_url.
+func (c slackCommand) respond(ctx context.Context, msg map[string]interface{}) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.responseURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Invalid Slack response_url: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to respond to Slack: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// upload shares a generated image in the command's channel with Slack's
+// external upload flow, which replaced files.upload.
+func (c slackCommand) upload(ctx context.Context, meta imageMetadata, title string) error {
+	data, err := store.Get(ctx, meta.Name)
+	if err != nil {
+		return err
+	}
+	var ticket struct {
+		UploadURL string `json:"upload_url"`
+		FileID    string `json:"file_id"`
+	}
+	params := url.Values{"filename": {path.Base(meta.Name)}, "length": {strconv.Itoa(len(data))}}
+	if err := slackCall(ctx, "files.getUploadURLExternal", params, &ticket); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ticket.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "image/png")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload failed: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload returned %s", resp.Status)
+	}
+
+	files, _ := json.Marshal([]map[string]string{{"id": ticket.FileID, "title": title}})
+	params = url.Values{"files": {string(files)}, "channel_id": {c.channelID}, "initial_comment": {title}}
+	return slackCall(ctx, "files.completeUploadExternal", params, nil)
+}
+
+// slackCall invokes a Web API method with form parameters and the bot token.
+func slackCall(ctx context.Context, method string, params url.Values, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, slackAPIURL()+"/"+method, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+config.Slack.BotToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("slack %s failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	var envelope struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return fmt.Errorf("slack %s: invalid response: %w", method, err)
+	}
+	if !envelope.OK {
+		return fmt.Errorf("slack %s: %s", method, envelope.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(body, result)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// failureRecord is a failed sd run; failures are only kept in memory, so
+// failure rates cover the time since the process started.
+type failureRecord struct {
+	At     time.Time
+	Model  string
+	User   string
+	Tenant string
+	Images int // the images the run was to generate
+}
+
+const maxFailureRecords = 10000
+
+var (
+	failuresMu sync.Mutex
+	failures   []failureRecord
+)
+
+func recordFailure(ctx context.Context, model string, images int) {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+	failures = append(failures, failureRecord{
+		At:     time.Now().UTC(),
+		Model:  model,
+		User:   identityFrom(ctx).User,
+		Tenant: tenantOf(ctx),
+		Images: max(1, images),
+	})
+	if len(failures) > maxFailureRecords {
+		failures = failures[len(failures)-maxFailureRecords:]
+	}
+}
+
+// modelStats aggregates the generations of one model. Generations and
+// failures both count images.
+type modelStats struct {
+	Generations int     `json:"generations"`
+	Failures    int     `json:"failures"`
+	FailureRate float64 `json:"failure_rate"`
+	P50Seconds  float64 `json:"p50_seconds"`
+	P95Seconds  float64 `json:"p95_seconds"`
+
+	durations []float64
+}
+
+func (m *modelStats) finish() {
+	if total := m.Generations + m.Failures; total > 0 {
+		m.FailureRate = round3(float64(m.Failures) / float64(total))
+	}
+	sort.Float64s(m.durations)
+	m.P50Seconds = percentile(m.durations, 0.50)
+	m.P95Seconds = percentile(m.durations, 0.95)
+}
+
+type statsReport struct {
+	From        time.Time              `json:"from"`
+	To          time.Time              `json:"to"`
+	Total       *modelStats            `json:"total"`
+	Models      map[string]*modelStats `json:"models"`
+	Resolutions map[string]int         `json:"resolutions"`
+	Users       map[string]int         `json:"users"`
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return round3(sorted[max(0, i)])
+}
+
+func round3(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// statsModelName is the name generations are grouped by: the profile, or the
+// model file for records predating profiles.
+func statsModelName(meta imageMetadata) string {
+	if meta.Profile != "" {
+		return meta.Profile
+	}
+	return meta.DiffusionModel
+}
+
+func statsUserName(user string) string {
+	if user == "" {
+		return "anonymous"
+	}
+	return user
+}
+
+// handleStats reports aggregates over a time window at GET /v1/stats. The
+// window is given by from and to, or by window (a duration up to now,
+// default 24h); format=csv returns CSV instead of JSON.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tr, err := parseTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tr.From.IsZero() && tr.To.IsZero() {
+		window := 24 * time.Hour
+		if s := r.URL.Query().Get("window"); s != "" {
+			if window, err = time.ParseDuration(s); err != nil || window <= 0 {
+				http.Error(w, "invalid window, expected a duration like 24h", http.StatusBadRequest)
+				return
+			}
+		}
+		tr.To = time.Now().UTC()
+		tr.From = tr.To.Add(-window)
+	}
+
+	report := statsReport{
+		From:        tr.From,
+		To:          tr.To,
+		Total:       &modelStats{},
+		Models:      map[string]*modelStats{},
+		Resolutions: map[string]int{},
+		Users:       map[string]int{},
+	}
+	model := func(name string) *modelStats {
+		if report.Models[name] == nil {
+			report.Models[name] = &modelStats{}
+		}
+		return report.Models[name]
+	}
+
+	err = walkHistory(r.Context(), tr, func(meta imageMetadata) bool {
+		for _, m := range []*modelStats{report.Total, model(statsModelName(meta))} {
+			m.Generations++
+			m.durations = append(m.durations, meta.Timings.Generation+meta.Timings.PostProcess)
+		}
+		report.Resolutions[resolution{meta.Width, meta.Height}.String()]++
+		report.Users[statsUserName(meta.User)]++
+		return true
+	})
+	if err != nil {
+		log.Printf("Failed to read history: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	tenant := tenantOf(r.Context())
+	failuresMu.Lock()
+	for _, f := range failures {
+		if f.Tenant == tenant && tr.contains(f.At) {
+			report.Total.Failures += f.Images
+			model(f.Model).Failures += f.Images
+		}
+	}
+	failuresMu.Unlock()
+
+	report.Total.finish()
+	for _, m := range report.Models {
+		m.finish()
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		writeStatsCSV(w, report)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// writeStatsCSV writes the report as section,key,... rows.
+func writeStatsCSV(w http.ResponseWriter, report statsReport) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="stats.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"section", "key", "generations", "failures", "failure_rate", "p50_seconds", "p95_seconds"})
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	row := func(section, key string, m *modelStats) {
+		cw.Write([]string{section, key, strconv.Itoa(m.Generations), strconv.Itoa(m.Failures), f(m.FailureRate), f(m.P50Seconds), f(m.P95Seconds)})
+	}
+	row("total", "", report.Total)
+	for _, name := range sortedKeys(report.Models) {
+		row("model", name, report.Models[name])
+	}
+	for _, res := range sortedKeys(report.Resolutions) {
+		cw.Write([]string{"resolution", res, strconv.Itoa(report.Resolutions[res]), "", "", "", ""})
+	}
+	for _, user := range sortedKeys(report.Users) {
+		cw.Write([]string{"user", user, strconv.Itoa(report.Users[user]), "", "", "", ""})
+	}
+	cw.Flush()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Storage persists generated images and their metadata. Get returns an error
+// matching os.ErrNotExist for unknown names.
+type Storage interface {
+	Put(ctx context.Context, name string, data []byte, contentType string) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	Delete(ctx context.Context, name string) error
+	// List returns the sorted names that start with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// StorageConfig selects and configures the storage backend in the config file.
+// Type is local (default), s3, gcs or azure. GCS is accessed through its
+// S3-compatible XML API with HMAC keys.
+type StorageConfig struct {
+	Type string `json:"type"`
+
+	// s3 and gcs
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+
+	// azure
+	Account    string `json:"account"`
+	AccountKey string `json:"account_key"`
+	Container  string `json:"container"`
+
+	// Prefix is prepended to every object name, e.g. "images/".
+	Prefix string `json:"prefix"`
+}
+
+var store Storage
+
+func newStorage(cfg StorageConfig) (Storage, error) {
+	switch cfg.Type {
+	case "", "local":
+		dir := filepath.Join(outputDir, filepath.FromSlash(cfg.Prefix))
+		if dir == "" {
+			dir = "."
+		}
+		return &localStorage{dir: dir}, nil
+	case "s3":
+		if cfg.Region == "" {
+			cfg.Region = "us-east-1"
+		}
+		return newS3Storage(cfg)
+	case "gcs":
+		if cfg.Endpoint == "" {
+			cfg.Endpoint = "https://storage.googleapis.com"
+		}
+		if cfg.Region == "" {
+			cfg.Region = "auto"
+		}
+		return newS3Storage(cfg)
+	case "azure":
+		return newAzureStorage(cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q, expected local, s3, gcs or azure", cfg.Type)
+	}
+}
+
+// localStorage keeps files in a directory, by default -output-dir.
+type localStorage struct {
+	dir string
+}
+
+func (s *localStorage) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func (s *localStorage) Get(ctx context.Context, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(name)))
+}
+
+func (s *localStorage) Delete(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(s.dir, filepath.FromSlash(name)))
+}
+
+// List lists the files in the directory of the prefix, e.g. bob/ for
+// bob/output_.
+func (s *localStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	dir, filePrefix := "", prefix
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir, filePrefix = prefix[:i+1], prefix[i+1:]
+	}
+	entries, err := os.ReadDir(filepath.Join(s.dir, filepath.FromSlash(dir)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), filePrefix) {
+			names = append(names, dir+e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
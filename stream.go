@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// chatStream writes a chat completion as OpenAI-style server-sent events of
+// chat.completion.chunk objects.
+type chatStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	model   string
+	created int64
+
+	mu    sync.Mutex // serializes writes of the handler and the heartbeat
+	jobID string     // job whose progress the heartbeat reports
+}
+
+// newChatStream starts an event stream on w and sends the assistant role.
+func newChatStream(w http.ResponseWriter, model string) (*chatStream, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("streaming is not supported by the connection")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	s := &chatStream{w: w, flusher: flusher, model: model, created: time.Now().Unix()}
+	s.send(map[string]string{"role": "assistant"}, nil)
+	return s, nil
+}
+
+func (s *chatStream) write(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.w, format, args...)
+	s.flusher.Flush()
+}
+
+func (s *chatStream) event(v interface{}) {
+	data, _ := json.Marshal(v)
+	s.write("data: %s\n\n", data)
+}
+
+func (s *chatStream) send(delta map[string]string, finishReason interface{}) {
+	s.event(map[string]interface{}{
+		"id":      "chatcmpl-mockid",
+		"object":  "chat.completion.chunk",
+		"created": s.created,
+		"model":   s.model,
+		"choices": []map[string]interface{}{
+			{
+				"index":         0,
+				"delta":         delta,
+				"finish_reason": finishReason,
+			},
+		},
+	})
+}
+
+// content streams a piece of the assistant message.
+func (s *chatStream) content(text string) {
+	s.send(map[string]string{"content": text}, nil)
+}
+
+// finish ends the message and the stream.
+func (s *chatStream) finish() {
+	s.send(map[string]string{}, "stop")
+	s.write("data: [DONE]\n\n")
+}
+
+// fail reports an error after the stream has started, when the status code
+// can no longer be changed, and ends the stream.
+func (s *chatStream) fail(err error) {
+	message := "Internal server error"
+	if reqErr, ok := err.(*requestError); ok {
+		message = reqErr.message
+	}
+	s.event(map[string]interface{}{"error": map[string]string{"message": message}})
+	s.write("data: [DONE]\n\n")
+}
+
+// watch makes the heartbeat report the progress of the given job.
+func (s *chatStream) watch(jobID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobID = jobID
+}
+
+// heartbeat sends an SSE comment every interval until ctx is done, keeping
+// idle proxies from closing the connection while the job waits. The comment
+// carries the job's queue status as JSON, e.g.
+//
+//	: queue {"id":"...","status":"queued","position":3,"eta_seconds":42}
+//
+// which clients may show; others ignore comments.
+func (s *chatStream) heartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		id := s.jobID
+		s.mu.Unlock()
+		if status, ok := line.status(id); ok {
+			data, _ := json.Marshal(status)
+			s.write(": queue %s\n\n", data)
+		} else {
+			s.write(": keep-alive\n\n")
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image/png"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// maxStyleImageSide bounds the style reference, which sd encodes at its own
+// size on top of the generation.
+const maxStyleImageSide = 1024
+
+// loadImageRef loads an image given like the url of an image_url part: as a
+// data URL, the id of an upload or a URL to fetch.
+func loadImageRef(ctx context.Context, ref, baseURL string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(ref, "data:image/"):
+		_, raw, ok := strings.Cut(ref, "base64,")
+		if !ok {
+			return nil, fmt.Errorf("image data URLs must be base64")
+		}
+		data, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 image: %w", err)
+		}
+		return data, nil
+	case isUploadID(ref):
+		return loadUpload(ctx, ref)
+	default:
+		return fetchImage(ctx, ref, baseURL)
+	}
+}
+
+// loadStyleImage resolves the style_image of a request.
+func loadStyleImage(ctx context.Context, req *ChatRequest, baseURL string) error {
+	if req.StyleImage == "" {
+		return nil
+	}
+	data, err := loadImageRef(ctx, req.StyleImage, baseURL)
+	if err != nil {
+		return &requestError{http.StatusBadRequest, fmt.Sprintf("style_image: %v", err)}
+	}
+	req.styleImage = data
+	return nil
+}
+
+// fitStyleImage converts a style reference to PNG, scaled down so that its
+// longest side is at most maxStyleImageSide pixels.
+func fitStyleImage(ctx context.Context, data []byte) ([]byte, error) {
+	data, err := convertImage(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	src, _, err := decodeInputImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode style image: %w", err)
+	}
+	b := src.Bounds()
+	scale := math.Min(1, float64(maxStyleImageSide)/float64(max(b.Dx(), b.Dy())))
+	w := max(1, int(math.Round(float64(b.Dx())*scale)))
+	h := max(1, int(math.Round(float64(b.Dy())*scale)))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleImage(src, b, w, h)); err != nil {
+		return nil, fmt.Errorf("failed to encode style image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
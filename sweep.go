@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// seedList is a list of seeds given either as a JSON array of numbers or as an
+// inclusive range string such as "100-109".
+type seedList []int64
+
+func (s *seedList) UnmarshalJSON(data []byte) error {
+	var list []int64
+	if err := json.Unmarshal(data, &list); err == nil {
+		*s = list
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("seeds must be an array of numbers or a range like \"100-109\"")
+	}
+	from, to, ok := strings.Cut(str, "-")
+	start, err1 := strconv.ParseInt(strings.TrimSpace(from), 10, 64)
+	end, err2 := strconv.ParseInt(strings.TrimSpace(to), 10, 64)
+	if !ok || err1 != nil || err2 != nil || start < 0 || end < start {
+		return fmt.Errorf("invalid seed range %q", str)
+	}
+	if end-start >= 1000 {
+		return fmt.Errorf("seed range %q is too large", str)
+	}
+	for seed := start; seed <= end; seed++ {
+		list = append(list, seed)
+	}
+	*s = list
+	return nil
+}
+
+// seedRuns splits a seed sweep into sd runs. Runs of consecutive seeds are
+// merged into a single batched invocation, since sd increments the seed for
+// each image of a batch and only has to load the model once.
+func seedRuns(gen generation, seeds []int64) []generation {
+	var runs []generation
+	for i := 0; i < len(seeds); {
+		j := i + 1
+		for j < len(seeds) && seeds[j] == seeds[j-1]+1 {
+			j++
+		}
+		run := gen
+		run.Seed = seeds[i]
+		run.BatchCount = j - i
+		runs = append(runs, run)
+		i = j
+	}
+	return runs
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TelegramConfig enables the built-in Telegram bot, which generates an image
+// for every text message and edits photos sent with a caption.
+type TelegramConfig struct {
+	Token        string  `json:"token"`
+	AllowedChats []int64 `json:"allowed_chats"` // chat IDs the bot answers, all (anyone on Telegram) if empty
+	Model        string  `json:"model"`         // profile to use, routed by prompt if empty
+	APIURL       string  `json:"api_url"`       // https://api.telegram.org if empty
+}
+
+const telegramPollTimeout = 50 * time.Second
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type telegramMessage struct {
+	MessageID int64 `json:"message_id"`
+	From      *struct {
+		ID int64 `json:"id"`
+	} `json:"from"`
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Text    string `json:"text"`
+	Caption string `json:"caption"`
+	Photo   []struct {
+		FileID   string `json:"file_id"`
+		FileSize int64  `json:"file_size"`
+	} `json:"photo"`
+	Document *struct {
+		FileID   string `json:"file_id"`
+		MimeType string `json:"mime_type"`
+	} `json:"document"`
+}
+
+// telegramBot talks to the Telegram Bot API by long polling.
+type telegramBot struct {
+	cfg     TelegramConfig
+	apiURL  string
+	allowed map[int64]bool
+	client  *http.Client
+}
+
+func newTelegramBot(cfg TelegramConfig) *telegramBot {
+	b := &telegramBot{
+		cfg:     cfg,
+		apiURL:  strings.TrimSuffix(cfg.APIURL, "/"),
+		allowed: make(map[int64]bool),
+		client:  &http.Client{Timeout: telegramPollTimeout + 30*time.Second},
+	}
+	if b.apiURL == "" {
+		b.apiURL = "https://api.telegram.org"
+	}
+	for _, id := range cfg.AllowedChats {
+		b.allowed[id] = true
+	}
+	return b
+}
+
+// call invokes a Bot API method with JSON parameters and decodes its result.
+func (b *telegramBot) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.apiURL+"/bot"+b.cfg.Token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return b.do(req, method, result)
+}
+
+func (b *telegramBot) do(req *http.Request, method string, result interface{}) error {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		// The URL contains the token.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("telegram %s failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+	var envelope struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("telegram %s: invalid response: %w", method, err)
+	}
+	if !envelope.OK {
+		return fmt.Errorf("telegram %s: %s", method, envelope.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, result)
+}
+
+// run polls for updates until ctx is done, handling each message in its own
+// goroutine; the generations themselves queue like API requests.
+func (b *telegramBot) run(ctx context.Context) {
+	var offset int64
+	for ctx.Err() == nil {
+		var updates []telegramUpdate
+		params := map[string]interface{}{
+			"offset":          offset,
+			"timeout":         int(telegramPollTimeout.Seconds()),
+			"allowed_updates": []string{"message"},
+		}
+		if err := b.call(ctx, "getUpdates", params, &updates); err != nil {
+			log.Printf("Telegram polling failed: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message != nil {
+				go b.handleMessage(ctx, u.Message)
+			}
+		}
+	}
+}
+
+func (b *telegramBot) handleMessage(ctx context.Context, msg *telegramMessage) {
+	chatID := msg.Chat.ID
+	if len(b.allowed) > 0 && !b.allowed[chatID] {
+		log.Printf("Telegram message from chat %d ignored", chatID)
+		return
+	}
+	prompt := strings.TrimSpace(msg.Text)
+	if prompt == "" {
+		prompt = strings.TrimSpace(msg.Caption)
+	}
+	if cmd, rest, _ := strings.Cut(prompt, " "); strings.HasPrefix(cmd, "/") {
+		if cmd == "/start" || cmd == "/help" {
+			b.reply(ctx, msg, "Send a prompt to generate an image, or a photo with a caption describing how to edit it.")
+			return
+		}
+		prompt = strings.TrimSpace(rest) // e.g. /imagine a cat
+	}
+
+	// Usernames can be changed and then taken by someone else, IDs are
+	// permanent.
+	user := "telegram:" + strconv.FormatInt(chatID, 10)
+	if msg.From != nil {
+		user = "telegram:" + strconv.FormatInt(msg.From.ID, 10)
+	}
+	ctx = withIdentity(ctx, identity{User: user, Method: "telegram"})
+
+	var images [][]byte
+	fileID := ""
+	if len(msg.Photo) > 0 {
+		fileID = msg.Photo[len(msg.Photo)-1].FileID // largest size last
+	} else if msg.Document != nil && strings.HasPrefix(msg.Document.MimeType, "image/") {
+		fileID = msg.Document.FileID
+	}
+	if fileID != "" {
+		data, err := b.downloadFile(ctx, fileID)
+		if err != nil {
+			log.Printf("Failed to download Telegram image: %v", err)
+			b.reply(ctx, msg, "Failed to download the image.")
+			return
+		}
+		images = append(images, data)
+	}
+	if prompt == "" {
+		b.reply(ctx, msg, "Please describe the image you want.")
+		return
+	}
+	fmt.Printf("Telegram prompt from %s: %s\n", user, prompt)
+
+	b.call(ctx, "sendChatAction", map[string]interface{}{"chat_id": chatID, "action": "upload_photo"}, nil)
+	j, _, err := chatJob(ctx, ChatRequest{Model: b.cfg.Model}, prompt, images)
+	if err == nil {
+		var result jobResult
+		if result, err = runJob(ctx, j); err == nil {
+			for _, meta := range result.Images {
+				if err := b.sendPhoto(ctx, msg, meta); err != nil {
+					log.Printf("Failed to send Telegram photo: %v", err)
+				}
+			}
+			return
+		}
+	}
+	text := "Generation failed."
+	if reqErr, ok := err.(*requestError); ok {
+		text = reqErr.message
+	}
+	b.reply(ctx, msg, text)
+}
+
+func (b *telegramBot) reply(ctx context.Context, msg *telegramMessage, text string) {
+	params := map[string]interface{}{
+		"chat_id":             msg.Chat.ID,
+		"text":                text,
+		"reply_to_message_id": msg.MessageID,
+	}
+	if err := b.call(ctx, "sendMessage", params, nil); err != nil {
+		log.Printf("Failed to send Telegram message: %v", err)
+	}
+}
+
+// downloadFile fetches a file sent to the bot.
+func (b *telegramBot) downloadFile(ctx context.Context, fileID string) ([]byte, error) {
+	var file struct {
+		FilePath string `json:"file_path"`
+	}
+	if err := b.call(ctx, "getFile", map[string]string{"file_id": fileID}, &file); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.apiURL+"/file/bot"+b.cfg.Token+"/"+file.FilePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, errors.New("file download failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("file download returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 20<<20))
+}
+
+// sendPhoto replies with a generated image, captioned with its seed.
+func (b *telegramBot) sendPhoto(ctx context.Context, msg *telegramMessage, meta imageMetadata) error {
+	data, err := store.Get(ctx, meta.Name)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("chat_id", strconv.FormatInt(msg.Chat.ID, 10))
+	mw.WriteField("reply_to_message_id", strconv.FormatInt(msg.MessageID, 10))
+	mw.WriteField("caption", fmt.Sprintf("seed %d", meta.Seed))
+	part, err := mw.CreateFormFile("photo", path.Base(meta.Name))
+	if err != nil {
+		return err
+	}
+	part.Write(data)
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.apiURL+"/bot"+b.cfg.Token+"/sendPhoto", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return b.do(req, "sendPhoto", nil)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// With -tenant-isolation, every authenticated user is a tenant: their images
+// are stored under a directory of their own, named in URLs as
+// /generated/{tenant}/{name}, and only they can list, fetch and delete them.
+
+// tenantOf returns the tenant of the caller of ctx, empty without
+// -tenant-isolation.
+func tenantOf(ctx context.Context) string {
+	if !tenantIsolation {
+		return ""
+	}
+	return sanitizeTenant(identityFrom(ctx).User)
+}
+
+// anonymousTenant is the tenant of callers without a user name. sanitizeTenant
+// never produces it, as a tilde it writes is always followed by two hex digits.
+const anonymousTenant = "~anonymous"
+
+// sanitizeTenant makes a user name safe as a path segment without mapping two
+// users onto the same tenant: bytes other than letters, digits, dashes,
+// underscores, @ and inner dots are written as ~ and their hex code, e.g.
+// telegram:alice becomes telegram~3Aalice.
+func sanitizeTenant(user string) string {
+	if user == "" {
+		return anonymousTenant
+	}
+	// Image names end in .png, a tenant that does too would be ambiguous.
+	plain := len(user)
+	if strings.HasSuffix(user, ".png") {
+		plain -= len(".png")
+	}
+	var b strings.Builder
+	for i := 0; i < len(user); i++ {
+		switch c := user[i]; {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '@':
+			b.WriteByte(c)
+		case c == '.' && i > 0 && i != plain:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "~%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// validTenant reports whether t is a tenant as produced by sanitizeTenant.
+func validTenant(t string) bool {
+	if t == anonymousTenant {
+		return true
+	}
+	var user []byte
+	for i := 0; i < len(t); i++ {
+		if t[i] != '~' {
+			user = append(user, t[i])
+			continue
+		}
+		if i+2 >= len(t) {
+			return false
+		}
+		c, err := strconv.ParseUint(t[i+1:i+3], 16, 8)
+		if err != nil {
+			return false
+		}
+		user = append(user, byte(c))
+		i += 2
+	}
+	return len(user) > 0 && sanitizeTenant(string(user)) == t
+}
+
+// tenantName returns the storage name of a file of the caller's tenant.
+func tenantName(ctx context.Context, file string) string {
+	if t := tenantOf(ctx); t != "" {
+		return t + "/" + file
+	}
+	return file
+}
+
+// imageTenant returns the tenant an image name belongs to, empty for images
+// stored without isolation.
+func imageTenant(name string) string {
+	if t, _, ok := strings.Cut(name, "/"); ok {
+		return t
+	}
+	return ""
+}
+
+// ownsImage reports whether the caller of ctx may access the named image.
+func ownsImage(ctx context.Context, name string) bool {
+	return !tenantIsolation || imageTenant(name) == tenantOf(ctx)
+}
+
+// splitImagePath splits a path below /generated/ into the image name, with
+// its tenant if there is one, and the rest, e.g. "bob/output_1.png/params"
+// into "bob/output_1.png" and "params". Image names end in .png, so a first
+// segment without the extension is a tenant.
+func splitImagePath(path string) (string, string) {
+	first, rest, _ := strings.Cut(path, "/")
+	if strings.HasSuffix(first, ".png") || rest == "" {
+		return first, rest
+	}
+	file, rest, _ := strings.Cut(rest, "/")
+	return first + "/" + file, rest
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// serverTLSConfig returns the listener TLS config, requiring client
+// certificates signed by -tls-client-ca when it is set.
+func serverTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if tlsClientCA == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(tlsClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", tlsClientCA)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
+
+// clientCertIdentity returns the caller identified by a verified client
+// certificate, named after its common name.
+func clientCertIdentity(state *tls.ConnectionState) (identity, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return identity{}, false
+	}
+	cert := state.VerifiedChains[0][0]
+	user := cert.Subject.CommonName
+	if user == "" && len(cert.DNSNames) > 0 {
+		user = cert.DNSNames[0]
+	}
+	if user == "" {
+		return identity{}, false
+	}
+	return identity{User: user, Method: "mtls", Admin: config.Auth.isAdmin(user)}, true
+}
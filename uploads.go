@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Uploaded images are stored next to the generated ones as upload_*.png, so a
+// client editing an image over several turns sends it once and then refers to
+// it by its id or URL.
+
+const (
+	maxUploadBytes = 32 << 20
+	uploadPrefix   = "upload_"
+)
+
+type uploadResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	URL     string `json:"url"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Bytes   int    `json:"bytes"`
+	Created int64  `json:"created"`
+}
+
+// handleUpload stores an image at POST /v1/uploads, sent as multipart form
+// field "file" or as a raw image body, converting it to PNG.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := readUpload(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data, err = convertImage(r.Context(), data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	img, format, err := decodeInputImage(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unsupported image: %v", err), http.StatusBadRequest)
+		return
+	}
+	if format != "png" {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			http.Error(w, "Failed to convert image", http.StatusInternalServerError)
+			return
+		}
+		data = buf.Bytes()
+	}
+
+	now := time.Now()
+	id := fmt.Sprintf("%s%d", uploadPrefix, now.UnixNano())
+	name := tenantName(r.Context(), id+".png")
+	if err := store.Put(r.Context(), name, data, "image/png"); err != nil {
+		log.Printf("Failed to store upload %s: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Stored upload %s (%d bytes)", name, len(data))
+	bounds := img.Bounds()
+	writeJSON(w, uploadResponse{
+		ID:      id,
+		Object:  "upload",
+		URL:     generatedURL(name),
+		Width:   bounds.Dx(),
+		Height:  bounds.Dy(),
+		Bytes:   len(data),
+		Created: now.Unix(),
+	})
+}
+
+func readUpload(r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(nil, r.Body, maxUploadBytes)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "multipart/form-data":
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, fmt.Errorf("missing file form field: %w", err)
+		}
+		defer file.Close()
+		return io.ReadAll(file)
+	case strings.HasPrefix(mediaType, "image/"):
+		return io.ReadAll(r.Body)
+	default:
+		return nil, fmt.Errorf("expected a multipart form or an image body")
+	}
+}
+
+// isUploadID reports whether an image reference is the id of an upload.
+func isUploadID(ref string) bool {
+	return strings.HasPrefix(ref, uploadPrefix) && validImageName(ref+".png")
+}
+
+// loadUpload returns an image the caller uploaded, by its id.
+func loadUpload(ctx context.Context, id string) ([]byte, error) {
+	data, err := store.Get(ctx, tenantName(ctx, id+".png"))
+	if err != nil {
+		return nil, fmt.Errorf("unknown upload %s", id)
+	}
+	return data, nil
+}
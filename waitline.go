@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lineEntry is a job waiting for or running its generations.
+type lineEntry struct {
+	id        string
+	user      string
+	pool      string
+	enqueued  time.Time
+	runs      int // generations the job consists of
+	completed int
+}
+
+// waitLine tracks the jobs of this instance in arrival order, together with a
+// moving average of generation times, to tell clients their position and an
+// ETA. Every worker pool is a line of its own: the jobs of a pool share its
+// slots generation by generation, so its first entries, as many as it has
+// slots, are the ones running.
+type waitLine struct {
+	mu      sync.Mutex
+	entries []*lineEntry
+	avg     map[string]float64 // seconds per generation by pool, unset until the first one finished
+}
+
+var line = &waitLine{avg: map[string]float64{}}
+
+// avgWeight is the weight of the newest generation time in the average.
+const avgWeight = 0.2
+
+func (l *waitLine) join(id, user, pool string, runs int) *lineEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := &lineEntry{id: id, user: user, pool: pool, enqueued: time.Now(), runs: max(1, runs)}
+	l.entries = append(l.entries, e)
+	return e
+}
+
+func (l *waitLine) leave(e *lineEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, other := range l.entries {
+		if other == e {
+			l.entries = append(l.entries[:i], l.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// idle reports whether no job is waiting or running.
+func (l *waitLine) idle() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries) == 0
+}
+
+// finished records that a generation of e took the given number of seconds.
+func (l *waitLine) finished(e *lineEntry, seconds float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.completed++
+	if avg, ok := l.avg[e.pool]; ok {
+		l.avg[e.pool] = avgWeight*seconds + (1-avgWeight)*avg
+	} else {
+		l.avg[e.pool] = seconds
+	}
+}
+
+// queueStatus is the position of a job in the line and its estimated time to
+// completion; ETA is negative while no generation time is known yet.
+type queueStatus struct {
+	ID         string  `json:"id"`
+	Status     string  `json:"status"` // queued or running
+	Position   int     `json:"position"`
+	ETASeconds float64 `json:"eta_seconds"`
+}
+
+// statusLocked computes the status of the entry at index i, or of a job of
+// the given size joining the pool now if i is len(l.entries). Position and
+// ETA only count the jobs of the same pool; a job waits for the generations
+// ahead of it shared among the pool's slots.
+func (l *waitLine) statusLocked(pool string, i, runs int) queueStatus {
+	position, remaining := 0, 0
+	for _, e := range l.entries[:i] {
+		if e.pool == pool {
+			position++
+			remaining += e.runs - e.completed
+		}
+	}
+	status := queueStatus{Status: "queued", Position: position, ETASeconds: -1}
+	slots := poolConcurrency(pool)
+	if position < slots {
+		remaining = 0
+	}
+	if i < len(l.entries) {
+		e := l.entries[i]
+		status.ID = e.id
+		runs = e.runs - e.completed
+		if position < slots {
+			status.Status = "running"
+		}
+	}
+	if avg := l.avg[pool]; avg > 0 {
+		waiting := float64(remaining)/float64(slots) + float64(runs)
+		status.ETASeconds = math.Round(waiting*avg*10) / 10
+	}
+	return status
+}
+
+// status returns the status of the job with the given ID.
+func (l *waitLine) status(id string) (queueStatus, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, e := range l.entries {
+		if e.id == id {
+			return l.statusLocked(e.pool, i, 0), true
+		}
+	}
+	return queueStatus{}, false
+}
+
+// estimate returns the status a job of the given number of generations would
+// have if it joined the pool now.
+func (l *waitLine) estimate(pool string, runs int) queueStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.statusLocked(pool, len(l.entries), max(1, runs))
+}
+
+// setQueueHeaders reports the position and ETA of a job that is about to
+// start to a synchronous client.
+func setQueueHeaders(w http.ResponseWriter, j job) {
+	status := line.estimate(j.pool(), j.size())
+	w.Header().Set("X-Job-ID", j.id)
+	w.Header().Set("X-Queue-Position", strconv.Itoa(status.Position))
+	if status.ETASeconds >= 0 {
+		w.Header().Set("X-ETA-Seconds", strconv.FormatFloat(status.ETASeconds, 'f', -1, 64))
+	}
+}
+
+// handleJobStatus reports the queue position and ETA of a running job at
+// GET /v1/jobs/{id}.
+func handleJobStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/jobs/")
+	status, ok := line.status(id)
+	if !ok {
+		http.Error(w, "Unknown or finished job", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, status)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxWildcardDepth bounds how deeply wildcard files may reference each other.
+const maxWildcardDepth = 10
+
+var wildcardPattern = regexp.MustCompile(`^__([A-Za-z0-9_\-/]+?)__`)
+
+// expandDynamicPrompt expands "{red|green|blue}" alternations and "__name__"
+// wildcards, which pick a random line from name.txt in the wildcards directory.
+// Choices are drawn from rng, so the same seed always yields the same prompt.
+func expandDynamicPrompt(prompt string, rng *rand.Rand) (string, error) {
+	return expandDynamic(prompt, rng, 0)
+}
+
+func expandDynamic(text string, rng *rand.Rand, depth int) (string, error) {
+	if depth > maxWildcardDepth {
+		return "", fmt.Errorf("wildcards nested more than %d levels deep", maxWildcardDepth)
+	}
+
+	var b strings.Builder
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes) && strings.ContainsRune("{}|", runes[i+1]):
+			b.WriteRune(runes[i+1])
+			i++
+		case r == '{':
+			end, options, err := splitAlternation(runes, i)
+			if err != nil {
+				return "", err
+			}
+			choice, err := expandDynamic(options[rng.Intn(len(options))], rng, depth+1)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(choice)
+			i = end
+		case r == '}':
+			return "", fmt.Errorf("unbalanced '}' at position %d", i+1)
+		case r == '_':
+			m := wildcardPattern.FindStringSubmatch(string(runes[i:]))
+			if m == nil {
+				b.WriteRune(r)
+				continue
+			}
+			line, err := pickWildcard(m[1], rng)
+			if err != nil {
+				return "", err
+			}
+			expanded, err := expandDynamic(line, rng, depth+1)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(expanded)
+			i += len([]rune(m[0])) - 1
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String(), nil
+}
+
+// splitAlternation parses the "{a|b|c}" group starting at runes[start] and
+// returns the index of its closing brace and its top-level options.
+func splitAlternation(runes []rune, start int) (int, []string, error) {
+	var options []string
+	depth := 0
+	optionStart := start + 1
+	for i := start; i < len(runes); i++ {
+		switch runes[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				options = append(options, string(runes[optionStart:i]))
+				return i, options, nil
+			}
+		case '|':
+			if depth == 1 {
+				options = append(options, string(runes[optionStart:i]))
+				optionStart = i + 1
+			}
+		}
+	}
+	return 0, nil, fmt.Errorf("unclosed '{' at position %d", start+1)
+}
+
+// pickWildcard returns a random non-empty, non-comment line of name.txt.
+func pickWildcard(name string, rng *rand.Rand) (string, error) {
+	if wildcardsDir == "" {
+		return "", fmt.Errorf("wildcard __%s__ used but no wildcards directory is configured", name)
+	}
+	if strings.Contains(name, "..") {
+		return "", fmt.Errorf("invalid wildcard name %q", name)
+	}
+	f, err := os.Open(filepath.Join(wildcardsDir, filepath.FromSlash(name)+".txt"))
+	if err != nil {
+		return "", fmt.Errorf("unknown wildcard __%s__", name)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read wildcard __%s__: %w", name, err)
+	}
+	if len(lines) == 0 {
+		return "", fmt.Errorf("wildcard __%s__ is empty", name)
+	}
+	return lines[rng.Intn(len(lines))], nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	roleStandalone  = ""
+	roleCoordinator = "coordinator"
+	roleWorker      = "worker"
+
+	// workerPollTimeout is how long a worker's request for the next job is held
+	// open when the queue is empty.
+	workerPollTimeout = 30 * time.Second
+)
+
+// workerJob is a generation handed to a worker, as sent over the wire.
+type workerJob struct {
+	ID         string     `json:"id"`
+	Pool       string     `json:"pool,omitempty"`
+	Generation generation `json:"generation"`
+}
+
+// workerResult is what a worker reports back for a job.
+type workerResult struct {
+	Images []generatedImage `json:"images,omitempty"`
+	Error  string           `json:"error,omitempty"`
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// dispatchGeneration queues a generation for the workers serving the pool of
+// its profile and waits for its result.
+func dispatchGeneration(ctx context.Context, gen generation) ([]generatedImage, error) {
+	job := workerJob{ID: newJobID(), Pool: resolveProfile(gen.Profile).poolName(), Generation: gen}
+	if err := queue.Push(ctx, job); err != nil {
+		return nil, fmt.Errorf("failed to queue job: %w", err)
+	}
+	fmt.Printf("Queued job %s for workers\n", job.ID)
+
+	res, err := queue.Wait(ctx, job.ID, workerJobTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("worker failed: %s", res.Error)
+	}
+	return res.Images, nil
+}
+
+// authorizeWorker checks the shared worker token.
+func authorizeWorker(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(workerToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleWorkerNext hands the next queued job to a polling worker, or responds
+// with 204 No Content if none arrives within workerPollTimeout. Workers list
+// the pools they serve in the pools query parameter; without it they take
+// jobs of any pool.
+func handleWorkerNext(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeWorker(w, r) {
+		return
+	}
+
+	var pools []string
+	if list := r.URL.Query().Get("pools"); list != "" {
+		pools = splitPaths(list)
+	}
+	job, err := queue.Pop(r.Context(), pools, workerPollTimeout)
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Printf("Failed to pop job: %v", err)
+			http.Error(w, "Queue unavailable", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	if job == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	fmt.Printf("Job %s (pool %s) taken by worker %s\n", job.ID, job.Pool, clientIP(r))
+	writeJSON(w, job)
+}
+
+// handleWorkerResult accepts the result of a job at /internal/jobs/{id}/result.
+func handleWorkerResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeWorker(w, r) {
+		return
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/internal/jobs/"), "/result")
+
+	var res workerResult
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		http.Error(w, "Invalid result", http.StatusBadRequest)
+		return
+	}
+
+	if err := queue.Complete(r.Context(), id, res); err != nil {
+		if err == errUnknownJob {
+			http.Error(w, "Unknown job", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to complete job %s: %v", id, err)
+		http.Error(w, "Queue unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runWorker pulls jobs from the coordinator, runs them with the local sd binary
+// and pushes the results back, forever. With -worker-pools, every pool is
+// polled for by as many loops as it runs generations at a time; otherwise a
+// single loop takes jobs of any pool.
+func runWorker(ctx context.Context) {
+	pools := splitPaths(workerPools)
+	if len(pools) == 0 {
+		workerLoop(ctx, "")
+		return
+	}
+	var wg sync.WaitGroup
+	for _, pool := range pools {
+		for i := 0; i < poolConcurrency(pool); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				workerLoop(ctx, pool)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// workerLoop runs jobs of the given pool, or of any pool if empty, until ctx
+// is done.
+func workerLoop(ctx context.Context, pool string) {
+	client := &http.Client{Timeout: workerPollTimeout + 10*time.Second}
+	for ctx.Err() == nil {
+		job, err := pollJob(ctx, client, pool)
+		if err != nil {
+			log.Printf("Failed to poll coordinator: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if job == nil {
+			continue
+		}
+
+		fmt.Printf("Running job %s\n", job.ID)
+		var res workerResult
+		images, err := runGeneration(withJobID(ctx, job.ID), job.Generation)
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Images = images
+		}
+		if err := pushResult(ctx, job.ID, res); err != nil {
+			log.Printf("Failed to push result of job %s: %v", job.ID, err)
+		}
+	}
+}
+
+func coordinatorRequest(ctx context.Context, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(coordinatorURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+workerToken)
+	return req, nil
+}
+
+// pollJob asks the coordinator for the next job of the pool, or of any pool if
+// empty; it returns nil if there was none.
+func pollJob(ctx context.Context, client *http.Client, pool string) (*workerJob, error) {
+	path := "/internal/jobs/next"
+	if pool != "" {
+		path += "?pools=" + url.QueryEscape(pool)
+	}
+	req, err := coordinatorRequest(ctx, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+		var job workerJob
+		if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+			return nil, fmt.Errorf("invalid job: %w", err)
+		}
+		return &job, nil
+	default:
+		return nil, fmt.Errorf("coordinator returned status: %s", resp.Status)
+	}
+}
+
+func pushResult(ctx context.Context, id string, res workerResult) error {
+	body, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	req, err := coordinatorRequest(ctx, "/internal/jobs/"+id+"/result", body)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("coordinator returned status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import "fmt"
+
+// xyGrid describes an X/Y plot: the cartesian product of two parameter axes,
+// rendered as a labeled grid with one column per X value and one row per Y value.
+type xyGrid struct {
+	X xyAxis `json:"x"`
+	Y xyAxis `json:"y"`
+}
+
+// xyAxis is one parameter axis. Param is one of steps, cfg_scale, sampler, seed,
+// strength, image_guidance or guidance; Values are numbers or, for sampler,
+// strings.
+type xyAxis struct {
+	Param  string        `json:"param"`
+	Values []interface{} `json:"values"`
+}
+
+func (a xyAxis) label(i int) string {
+	return fmt.Sprintf("%s=%v", a.Param, a.Values[i])
+}
+
+func (a xyAxis) validate(name string) error {
+	if len(a.Values) == 0 {
+		return fmt.Errorf("xy_grid.%s.values must not be empty", name)
+	}
+	// Validate against a placeholder init image; whether one is actually
+	// present is checked when the runs are built.
+	probe := generation{Images: [][]byte{{0}}}
+	for i := range a.Values {
+		if err := a.apply(&probe, i); err != nil {
+			return fmt.Errorf("xy_grid.%s.values[%d]: %w", name, i, err)
+		}
+	}
+	return nil
+}
+
+// apply sets the axis parameter of gen to its i-th value.
+func (a xyAxis) apply(gen *generation, i int) error {
+	value := a.Values[i]
+	if a.Param == "sampler" {
+		s, ok := value.(string)
+		if !ok || s == "" {
+			return fmt.Errorf("sampler must be a non-empty string")
+		}
+		gen.Sampler = s
+		return nil
+	}
+
+	f, ok := value.(float64)
+	if !ok {
+		return fmt.Errorf("%s must be a number", a.Param)
+	}
+	switch a.Param {
+	case "steps":
+		if f < 1 || f != float64(int(f)) {
+			return fmt.Errorf("steps must be a positive integer")
+		}
+		gen.Steps = int(f)
+	case "cfg_scale":
+		if f <= 0 {
+			return fmt.Errorf("cfg_scale must be positive")
+		}
+		gen.CfgScale = f
+	case "seed":
+		if f < 0 || f != float64(int64(f)) {
+			return fmt.Errorf("seed must be a non-negative integer")
+		}
+		gen.Seed = int64(f)
+	case "strength":
+		if f <= 0 || f > 1 {
+			return fmt.Errorf("strength must be in (0, 1]")
+		}
+		// Strength only means something for img2img, so the most recent
+		// image becomes the init image.
+		if len(gen.Images) > 0 {
+			gen.InitImage = gen.Images[len(gen.Images)-1]
+			gen.Images = nil
+		}
+		if len(gen.InitImage) == 0 {
+			return fmt.Errorf("strength requires an init image")
+		}
+		gen.Strength = f
+	case "image_guidance", "guidance":
+		if f <= 0 {
+			return fmt.Errorf("%s must be positive", a.Param)
+		}
+		if a.Param == "guidance" {
+			gen.Guidance = &f
+		} else {
+			gen.ImageGuidance = &f
+		}
+	default:
+		return fmt.Errorf("unsupported parameter %q", a.Param)
+	}
+	return nil
+}
+
+func (g xyGrid) validate() error {
+	if g.X.Param == g.Y.Param {
+		return fmt.Errorf("xy_grid axes must use different parameters")
+	}
+	if err := g.X.validate("x"); err != nil {
+		return err
+	}
+	if err := g.Y.validate("y"); err != nil {
+		return err
+	}
+	if cells := len(g.X.Values) * len(g.Y.Values); cells > maxGridCells {
+		return fmt.Errorf("xy_grid has %d cells, at most %d are allowed", cells, maxGridCells)
+	}
+	return nil
+}
+
+// runs returns one generation per grid cell in row-major order.
+func (g xyGrid) runs(base generation) ([]generation, error) {
+	var runs []generation
+	for y := range g.Y.Values {
+		for x := range g.X.Values {
+			run := base
+			run.BatchCount = 1
+			if err := g.Y.apply(&run, y); err != nil {
+				return nil, err
+			}
+			if err := g.X.apply(&run, x); err != nil {
+				return nil, err
+			}
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
+
+// labels returns the column and row header labels of the grid.
+func (g xyGrid) labels() ([]string, []string) {
+	cols := make([]string, len(g.X.Values))
+	for i := range cols {
+		cols[i] = g.X.label(i)
+	}
+	rows := make([]string, len(g.Y.Values))
+	for i := range rows {
+		rows[i] = g.Y.label(i)
+	}
+	return cols, rows
+}